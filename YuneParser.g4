@@ -67,6 +67,7 @@ target
 
 assignment
     : variable assignmentOp statementBody
+    | variable LBRACKET subscript=expression RBRACKET assignmentOp statementBody
     ;
 
 assignmentOp
@@ -135,6 +136,9 @@ unaryOp
 
 binaryExpression
     : primary=primaryExpression
+    // indexing is listed before unary expressions so that -xs[i] == -(xs[i])
+    | indexed=binaryExpression LBRACKET subscript=expression RBRACKET // xs[i]
+    | indexed=binaryExpression LBRACKET low=expression COLON high=expression RBRACKET // s[a:b]
     | unaryOp binaryExpression // unary expression
     | function=primaryExpression parenArgument=parenExpression // f(x) has higher precedence than f x
     | left=binaryExpression op=(STAR | SLASH) right=binaryExpression
@@ -2,6 +2,7 @@ package ast
 
 import (
 	"fmt"
+	"slices"
 	"yune/cpp"
 	"yune/util"
 
@@ -17,30 +18,92 @@ func (e AnalyzerError) Error() string {
 }
 
 type Analyzer struct {
-	Interpreter *cpp.Interpreter
-	Errors      *Errors
-	Defined     map[TopLevelDeclaration]struct{}
-	Table       DeclarationTable
-	State       *State
-	MacroStack  []*Macro
+	Evaluator  Evaluator
+	Errors     *Errors
+	Defined    map[TopLevelDeclaration]struct{}
+	Table      DeclarationTable
+	State      *State
+	MacroStack []*Macro
+	// Constants whose evaluation has been postponed.
+	Batch *EvaluationBatch
+	// Collects the top-level declarations used by the code being analyzed, which evaluating it depends on.
+	uses *[]TopLevelDeclaration
 }
 
 // Returns an analyzer with only the relevant data for a top-level analysis.
 func (a Analyzer) TopLevel() Analyzer {
 	return Analyzer{
-		Interpreter: a.Interpreter,
-		Errors:      a.Errors,
-		Defined:     a.Defined,
+		Evaluator: a.Evaluator,
+		Errors:    a.Errors,
+		Defined:   a.Defined,
 		Table: DeclarationTable{
 			topLevelDeclarations: a.Table.topLevelDeclarations,
 		},
 		State: a.State,
+		Batch: a.Batch,
+	}
+}
+
+// Constants whose evaluation is postponed, so that independent constants are evaluated in a single round trip.
+type EvaluationBatch struct {
+	constants   []*ConstantDeclaration
+	evaluations []Evaluation
+	// Functions defined while the batch is not empty, which may use the values of its constants.
+	tainted map[TopLevelDeclaration]struct{}
+}
+
+func NewEvaluationBatch() *EvaluationBatch {
+	return &EvaluationBatch{tainted: map[TopLevelDeclaration]struct{}{}}
+}
+
+// Whether using `decl` requires the constants in the batch to be evaluated first.
+func (b *EvaluationBatch) isUsedBy(decl TopLevelDeclaration) bool {
+	if b == nil {
+		return false
+	}
+	_, tainted := b.tainted[decl]
+	constant, isConstant := decl.(*ConstantDeclaration)
+	return tainted || isConstant && slices.Contains(b.constants, constant)
+}
+
+// Evaluates the constant with the next batch, or immediately if the analyzer has no batch.
+// Constants that use the value of a constant in the batch are evaluated after the batch.
+func (a Analyzer) evaluateConstant(d *ConstantDeclaration, evaluation ConstantEvaluation) {
+	if a.Batch == nil {
+		d.value = a.Evaluate(evaluation, d.Name.Span, nil)
+		a.Define(d)
+		return
+	}
+	if slices.ContainsFunc(evaluation.Uses, a.Batch.isUsedBy) {
+		a.EvaluateBatch()
+	}
+	a.Batch.constants = append(a.Batch.constants, d)
+	a.Batch.evaluations = append(a.Batch.evaluations, evaluation)
+}
+
+// Evaluates the postponed constants and defines them.
+func (a Analyzer) EvaluateBatch() {
+	if a.Batch == nil || len(a.Batch.constants) == 0 {
+		return
+	}
+	constants, evaluations := a.Batch.constants, a.Batch.evaluations
+	*a.Batch = *NewEvaluationBatch()
+	// errors in the batch are unrelated to the macro being expanded, if any
+	a = a.TopLevel()
+	values, errs := a.Evaluator.EvaluateBatch(evaluations)
+	for i, d := range constants {
+		if errs[i] != nil {
+			a.reportEvaluatorError(errs[i], d.Name.Span)
+			panic("Failed to evaluate constant. Error: " + errs[i].Error())
+		}
+		d.value = values[i]
+		a.Define(d)
 	}
 }
 
 func (a Analyzer) ReportError(err error) {
 	*a.Errors = append(*a.Errors, err)
-	a.Interpreter.Close()
+	a.Evaluator.Close()
 	message := err.Error()
 	if len(a.MacroStack) > 0 {
 		message = fmt.Sprintf(
@@ -62,19 +125,50 @@ func (a Analyzer) HasErrors() bool {
 	return len(*a.Errors) > 0
 }
 
-// Evaluate a lowered Expression, assuming that Expression.Analyze has already been called on it.
+// Reports the errors of the evaluator.
+// C++ errors are blamed on the construct at `at`, since clang-repl reports errors asynchronously,
+// which means that the error may stem from an earlier declaration.
+func (a Analyzer) reportEvaluatorError(err error, at Span) {
+	switch err := err.(type) {
+	case cpp.CompileError:
+		errors := a.State.Spans.Translate(err, at)
+		*a.Errors = append(*a.Errors, errors[:len(errors)-1]...)
+		a.ReportError(errors[len(errors)-1])
+	case cpp.EvaluationAborted:
+		a.ReportError(EvaluationError{Message: err.Reason, At: at})
+	case cpp.EvaluationPanic, cpp.ProtocolError:
+		a.ReportError(EvaluationError{Message: err.Error(), At: at})
+	case EvaluationError:
+		a.ReportError(err)
+	}
+}
+
+// Evaluates code at compile time, assuming that it has already been analyzed.
+// `at` is the location of the code, which C++ errors are blamed on.
 // `in` should be non-nil if a macro is being evaluated.
-func (a Analyzer) Evaluate(lowered cpp.Expression, in *Macro) (json *fj.Value) {
-	getType := func(name string) (_type cpp.Type, ok bool) {
+func (a Analyzer) Evaluate(evaluation Evaluation, at Span, in *Macro) (json *fj.Value) {
+	// the evaluation may use the values of the postponed constants
+	a.EvaluateBatch()
+	return a.evaluate(evaluation, at)
+}
+
+// Like Evaluate, but without evaluating the batch, for evaluations that do not use its constants.
+func (a Analyzer) evaluate(evaluation Evaluation, at Span) (json *fj.Value) {
+	getType := func(name string) (_type TypeValue, ok bool) {
 		decl, ok := a.Table.Get(name)
 		if ok {
-			_type = decl.GetDeclaredType().LowerValue()
+			_type = decl.GetDeclaredType()
+		}
+		// the result of a macro depends on the types it requests
+		if topLevel, isTopLevel := decl.(TopLevelDeclaration); isTopLevel && a.uses != nil {
+			*a.uses = append(*a.uses, topLevel)
 		}
 		return
 	}
-	json, err := a.Interpreter.Evaluate(lowered, getType)
+	json, err := a.Evaluator.Evaluate(evaluation, getType)
 	if err != nil {
-		panic("Failed to evaluate lowered expression. Error: " + err.Error())
+		a.reportEvaluatorError(err, at)
+		panic("Failed to evaluate expression. Error: " + err.Error())
 	}
 	return
 }
@@ -98,6 +192,9 @@ func (a Analyzer) GetType(name Name) (TypeValue, Flags) {
 		if !isDone {
 			topLevel.Analyze(a.TopLevel())
 		}
+		if a.uses != nil {
+			*a.uses = append(*a.uses, topLevel)
+		}
 	}
 	// Non-top-level declarations are analyzed in sequential order,
 	// so this type should already be available.
@@ -112,8 +209,9 @@ func (a Analyzer) GetType(name Name) (TypeValue, Flags) {
 // and their full definitions after when they have been type checked
 
 func (a Analyzer) Declare(decl TopLevelDeclaration) {
-	err := a.Interpreter.Declare(decl.LowerDeclaration(a.State))
+	err := a.Evaluator.Declare(decl)
 	if err != nil {
+		a.reportEvaluatorError(err, decl.GetSpan())
 		panic("Failed to declare " + decl.GetName().String)
 	}
 }
@@ -124,8 +222,13 @@ func (a Analyzer) Define(decl TopLevelDeclaration) {
 		panic("Redefinition of declaration " + decl.GetName().String)
 	}
 	a.Defined[decl] = struct{}{}
-	err := a.Interpreter.Declare(decl.LowerDefinition(a.State))
+	// functions may read the constants in the batch when they are called
+	if _, isFunction := decl.(*FunctionDeclaration); isFunction && a.Batch != nil && len(a.Batch.constants) > 0 {
+		a.Batch.tainted[decl] = struct{}{}
+	}
+	err := a.Evaluator.Define(decl)
 	if err != nil {
+		a.reportEvaluatorError(err, decl.GetSpan())
 		panic("Failed to define declaration " + decl.GetName().String)
 	}
 }
@@ -1,5 +1,7 @@
 package ast
 
+import "slices"
+
 var BuiltinDeclarations = []BuiltinDeclaration{
 	{"Type", &TypeType{}, 0},
 	{"Int", &TypeType{}, 0},
@@ -14,12 +16,17 @@ var BuiltinDeclarations = []BuiltinDeclaration{
 		Argument: &TupleType{Elements: []TypeValue{&TypeType{}, &TypeType{}}},
 		Return:   &TypeType{},
 	}, 0},
+	{"Map", &FnType{
+		Argument: &TupleType{Elements: []TypeValue{&TypeType{}, &TypeType{}}},
+		Return:   &TypeType{},
+	}, 0},
 	{"toFloat", &FnType{
 		Argument: &IntType{},
 		Return:   &FloatType{},
 	}, 0},
 	{"Expression", &TypeType{}, 0},
 	{"Statement", &TypeType{}, 0},
+	{"Error", &TypeType{}, 0},
 	{"integerExpression", &FnType{Argument: &TupleType{Elements: []TypeValue{&IntType{}, &IntType{}}}, Return: ExpressionType}, 0},
 	{"floatExpression", &FnType{Argument: &TupleType{Elements: []TypeValue{&IntType{}, &FloatType{}}}, Return: ExpressionType}, 0},
 	{"boolExpression", &FnType{Argument: &TupleType{Elements: []TypeValue{&IntType{}, &BoolType{}}}, Return: ExpressionType}, 0},
@@ -113,6 +120,59 @@ var BuiltinDeclarations = []BuiltinDeclaration{
 		Argument: &StringType{},
 		Return:   &TupleType{},
 	}, IMPURE_FUNCTION},
+	// show(<any type>): String
+	// renders a value in Yune syntax
+	{"show", &FnType{Argument: &UnionType{}, Return: &StringType{}}, 0},
+	// toString(<any type>): String
+	// same as `show`, except that strings are returned as-is
+	{"toString", &FnType{Argument: &UnionType{}, Return: &StringType{}}, 0},
+	// toJson(<any type>): String
+	// encodes a value as JSON, see pb.hpp for the encoding
+	{"toJson", &FnType{Argument: &UnionType{}, Return: &StringType{}}, 0},
+	// fromJson(text: String, <type>): Union[<type>, Error]
+	// decodes a value of a type that is known at compile time
+	{"fromJson", &FnType{
+		Argument: &TupleType{Elements: []TypeValue{&StringType{}, &TypeType{}}},
+		Return:   &UnionType{},
+	}, 0},
+	// print(<any type>): ()
+	{"print", &FnType{Argument: &UnionType{}, Return: &TupleType{}}, IMPURE_FUNCTION},
+	// println(<any type>): ()
+	{"println", &FnType{Argument: &UnionType{}, Return: &TupleType{}}, IMPURE_FUNCTION},
+	// dbg(<any type>): <same type>
+	// prints the value with its location and type to stderr, then returns it
+	{"dbg", &FnType{Argument: &UnionType{}, Return: &UnionType{}}, IMPURE_FUNCTION},
+	// prints without a trailing newline
+	{"printString", &FnType{
+		Argument: &StringType{},
+		Return:   &TupleType{},
+	}, IMPURE_FUNCTION},
+	// reads a line from stdin without the trailing newline, returns () at the end of input
+	{"readLine", &FnType{
+		Argument: &TupleType{},
+		Return:   &UnionType{Variants: []TypeValue{&StringType{}, &TupleType{}}},
+	}, IMPURE_FUNCTION},
+	// reads a whole file
+	{"readFile", &FnType{
+		// path: String
+		Argument: &StringType{},
+		Return:   &UnionType{Variants: []TypeValue{&StringType{}, ErrorType}},
+	}, IMPURE_FUNCTION},
+	// creates or overwrites a file
+	{"writeFile", &FnType{
+		// (path: String, contents: String)
+		Argument: &TupleType{Elements: []TypeValue{&StringType{}, &StringType{}}},
+		Return:   &UnionType{Variants: []TypeValue{&TupleType{}, ErrorType}},
+	}, IMPURE_FUNCTION},
+	// returns () if the environment variable is not set
+	{"getEnv", &FnType{
+		Argument: &StringType{},
+		Return:   &UnionType{Variants: []TypeValue{&StringType{}, &TupleType{}}},
+	}, IMPURE_FUNCTION},
+	{"errorMessage", &FnType{
+		Argument: ErrorType,
+		Return:   &StringType{},
+	}, 0},
 	{"len", &FnType{
 		// also works for lists, but this cannot be expressed in Yune
 		Argument: &StringType{},
@@ -124,6 +184,53 @@ var BuiltinDeclarations = []BuiltinDeclaration{
 		Argument: &TupleType{Elements: []TypeValue{&StringType{}, &IntType{}, &IntType{}}},
 		Return:   &StringType{},
 	}, 0},
+	{"indexOf", &FnType{
+		// (text: String, search: String, offset: Int)
+		Argument: &TupleType{Elements: []TypeValue{&StringType{}, &StringType{}, &IntType{}}},
+		Return:   &UnionType{Variants: []TypeValue{&IntType{}, &TupleType{}}},
+	}, 0},
+	{"split", &FnType{
+		// (text: String, separator: String)
+		Argument: &TupleType{Elements: []TypeValue{&StringType{}, &StringType{}}},
+		Return:   &ListType{Element: &StringType{}},
+	}, 0},
+	{"join", &FnType{
+		// (parts: List(String), separator: String)
+		Argument: &TupleType{Elements: []TypeValue{&ListType{Element: &StringType{}}, &StringType{}}},
+		Return:   &StringType{},
+	}, 0},
+	{"replace", &FnType{
+		// (text: String, from: String, to: String)
+		Argument: &TupleType{Elements: []TypeValue{&StringType{}, &StringType{}, &StringType{}}},
+		Return:   &StringType{},
+	}, 0},
+	{"trim", &FnType{Argument: &StringType{}, Return: &StringType{}}, 0},
+	{"startsWith", &FnType{
+		Argument: &TupleType{Elements: []TypeValue{&StringType{}, &StringType{}}},
+		Return:   &BoolType{},
+	}, 0},
+	{"endsWith", &FnType{
+		Argument: &TupleType{Elements: []TypeValue{&StringType{}, &StringType{}}},
+		Return:   &BoolType{},
+	}, 0},
+	{"upperCase", &FnType{Argument: &StringType{}, Return: &StringType{}}, 0},
+	{"lowerCase", &FnType{Argument: &StringType{}, Return: &StringType{}}, 0},
+	{"repeat", &FnType{
+		Argument: &TupleType{Elements: []TypeValue{&StringType{}, &IntType{}}},
+		Return:   &StringType{},
+	}, 0},
+	{"charToCode", &FnType{Argument: &StringType{}, Return: &IntType{}}, 0},
+	{"codeToChar", &FnType{Argument: &IntType{}, Return: &StringType{}}, 0},
+	{"stringToInt", &FnType{
+		Argument: &StringType{},
+		Return:   &UnionType{Variants: []TypeValue{&IntType{}, &TupleType{}}},
+	}, 0},
+	{"stringToFloat", &FnType{
+		Argument: &StringType{},
+		Return:   &UnionType{Variants: []TypeValue{&FloatType{}, &TupleType{}}},
+	}, 0},
+	{"formatInt", &FnType{Argument: &IntType{}, Return: &StringType{}}, 0},
+	{"formatFloat", &FnType{Argument: &FloatType{}, Return: &StringType{}}, 0},
 	// extracts an element from a list
 	{"get", &FnType{
 		// (list: List(<any type>), index: Int)
@@ -138,6 +245,113 @@ var BuiltinDeclarations = []BuiltinDeclaration{
 		// ()
 		Return: &TupleType{},
 	}, 0},
+	// creates a map from a list of (key, value) tuples
+	{"toMap", &FnType{
+		// List((<key type>, <value type>))
+		Argument: &UnionType{},
+		// Map(<key type>, <value type>)
+		Return: &UnionType{},
+	}, 0},
+	// returns a copy of the map with a key set to a value
+	{"insert", &FnType{
+		// (map: Map(<key type>, <value type>), key: <key type>, value: <value type>)
+		Argument: &TupleType{Elements: []TypeValue{&UnionType{}, &UnionType{}, &UnionType{}}},
+		// Map(<key type>, <value type>)
+		Return: &UnionType{},
+	}, 0},
+	// looks up the value of a key
+	{"lookup", &FnType{
+		// (map: Map(<key type>, <value type>), key: <key type>)
+		Argument: &TupleType{Elements: []TypeValue{&UnionType{}, &UnionType{}}},
+		// Union[<value type>, ()]
+		Return: &UnionType{},
+	}, 0},
+	// returns a copy of the map without a key
+	{"remove", &FnType{
+		// (map: Map(<key type>, <value type>), key: <key type>)
+		Argument: &TupleType{Elements: []TypeValue{&UnionType{}, &UnionType{}}},
+		// Map(<key type>, <value type>)
+		Return: &UnionType{},
+	}, 0},
+	// returns the keys of a map in ascending order
+	{"keys", &FnType{
+		// Map(<key type>, <value type>)
+		Argument: &UnionType{},
+		// List(<key type>)
+		Return: &UnionType{},
+	}, 0},
+	// map(List(<input type>), Fn(<input type>, <output type>)): List(<output type>)
+	{"map", &FnType{
+		Argument: &TupleType{Elements: []TypeValue{&UnionType{}, &UnionType{}}},
+		Return:   &UnionType{},
+	}, 0},
+	// filter(List(<element type>), Fn(<element type>, Bool)): List(<element type>)
+	{"filter", &FnType{
+		Argument: &TupleType{Elements: []TypeValue{&UnionType{}, &UnionType{}}},
+		Return:   &UnionType{},
+	}, 0},
+	// fold(List(<element type>), <result type>, Fn((<result type>, <element type>), <result type>)): <result type>
+	{"fold", &FnType{
+		Argument: &TupleType{Elements: []TypeValue{&UnionType{}, &UnionType{}, &UnionType{}}},
+		Return:   &UnionType{},
+	}, 0},
+	// concat(List(<element type>), List(<element type>)): List(<element type>)
+	{"concat", &FnType{
+		Argument: &TupleType{Elements: []TypeValue{&UnionType{}, &UnionType{}}},
+		Return:   &UnionType{},
+	}, 0},
+	// sort(List(<element type>)) or sort(List(<element type>), Fn((<element type>, <element type>), Bool))
+	// sorts stably by `<` or by the given "less than" function
+	{"sort", &FnType{
+		Argument: &UnionType{},
+		Return:   &UnionType{},
+	}, 0},
+	// truncates towards zero, returns () if the result does not fit in an Int
+	{"toInt", &FnType{
+		Argument: &FloatType{},
+		Return:   &UnionType{Variants: []TypeValue{&IntType{}, &TupleType{}}},
+	}, 0},
+	// rounds half away from zero, returns () if the result does not fit in an Int
+	{"roundToInt", &FnType{
+		Argument: &FloatType{},
+		Return:   &UnionType{Variants: []TypeValue{&IntType{}, &TupleType{}}},
+	}, 0},
+	{"floor", &FnType{Argument: &FloatType{}, Return: &FloatType{}}, 0},
+	{"ceil", &FnType{Argument: &FloatType{}, Return: &FloatType{}}, 0},
+	{"round", &FnType{Argument: &FloatType{}, Return: &FloatType{}}, 0},
+	{"sqrt", &FnType{Argument: &FloatType{}, Return: &FloatType{}}, 0},
+	{"exp", &FnType{Argument: &FloatType{}, Return: &FloatType{}}, 0},
+	{"log", &FnType{Argument: &FloatType{}, Return: &FloatType{}}, 0},
+	{"sin", &FnType{Argument: &FloatType{}, Return: &FloatType{}}, 0},
+	{"cos", &FnType{Argument: &FloatType{}, Return: &FloatType{}}, 0},
+	{"tan", &FnType{Argument: &FloatType{}, Return: &FloatType{}}, 0},
+	{"atan2", &FnType{
+		// (y: Float, x: Float)
+		Argument: &TupleType{Elements: []TypeValue{&FloatType{}, &FloatType{}}},
+		Return:   &FloatType{},
+	}, 0},
+	{"isNaN", &FnType{Argument: &FloatType{}, Return: &BoolType{}}, 0},
+	// abs(Int): Int or abs(Float): Float
+	{"abs", &FnType{
+		Argument: &UnionType{},
+		Return:   &UnionType{},
+	}, 0},
+	// min(Int, Int): Int or min(Float, Float): Float
+	{"min", &FnType{
+		Argument: &TupleType{Elements: []TypeValue{&UnionType{}, &UnionType{}}},
+		Return:   &UnionType{},
+	}, 0},
+	// max(Int, Int): Int or max(Float, Float): Float
+	{"max", &FnType{
+		Argument: &TupleType{Elements: []TypeValue{&UnionType{}, &UnionType{}}},
+		Return:   &UnionType{},
+	}, 0},
+	// pow(Int, Int): Int or pow(Float, Float): Float
+	// panics on a negative Int exponent
+	{"pow", &FnType{
+		Argument: &TupleType{Elements: []TypeValue{&UnionType{}, &UnionType{}}},
+		Return:   &UnionType{},
+	}, 0},
 	{"Union", &FnType{
 		Argument: &ListType{Element: &TypeType{}},
 		Return:   &TypeType{},
@@ -146,6 +360,39 @@ var BuiltinDeclarations = []BuiltinDeclaration{
 	{"inject", &FnType{Argument: &TupleType{}, Return: ExpressionType}, 0},
 }
 
+// The builtins that programs could never declare themselves, which top-level declarations cannot shadow.
+var unshadowableBuiltins = []string{
+	"Type", "Int", "Float", "Bool", "String", "List", "Fn", "toFloat", "Expression", "Statement",
+	"integerExpression", "floatExpression", "boolExpression", "stringExpression",
+	"variableExpression", "unaryExpression", "binaryExpression", "functionCallExpression",
+	"closureExpression", "macroExpression", "listExpression", "tupleExpression",
+	"variableDeclaration", "assignStatement", "branchStatement", "isBranchStatement",
+	"expressionStatement", "panic", "printlnString", "len", "append", "subString", "get", "set",
+	"Union", "inject",
+}
+
+// The C++ names of the builtins that top-level declarations may shadow, mapped by their Yune names.
+// Builtins added after programs could declare the same name are shadowable, so that those programs keep working.
+// Declarations that shadow a builtin are lowered to a different name, see Name.Lower.
+var shadowableBuiltins = func() map[string]string {
+	names := map[string]string{}
+	for _, b := range BuiltinDeclarations {
+		if !slices.Contains(unshadowableBuiltins, b.Name) {
+			names[b.Name] = Name{String: b.Name}.lowerUnshadowed()
+		}
+	}
+	// the value of the type, whose struct is Error_t
+	names["Error"] = "Error_"
+	return names
+}()
+
+// Whether `decl` replaces `other` instead of being a duplicate declaration.
+func shadowsBuiltin(decl TopLevelDeclaration, other TopLevelDeclaration) bool {
+	_, isBuiltin := other.(*BuiltinDeclaration)
+	_, shadowable := shadowableBuiltins[decl.GetName().String]
+	return isBuiltin && shadowable
+}
+
 // A declaration that is written in `pb.hpp`.
 // This struct only makes the compiler aware of it.
 type BuiltinDeclaration struct {
@@ -0,0 +1,321 @@
+package ast
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"yune/cpp"
+
+	fj "github.com/valyala/fastjson"
+)
+
+// Hash of the running compiler, since cached results depend on how it lowers and evaluates code.
+var compilerHash = sync.OnceValue(func() string {
+	hash := sha256.New()
+	path, err := os.Executable()
+	if err == nil {
+		var file *os.File
+		if file, err = os.Open(path); err == nil {
+			_, err = io.Copy(hash, file)
+			file.Close()
+		}
+	}
+	if err != nil {
+		log.Println("Failed to hash the compiler executable, disabling the cache. Error:", err)
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+})
+
+// Caches the results of compile-time evaluations on disk, so that unchanged code is not evaluated again.
+// Results are stored under a hash of the lowered evaluation, the definitions of the declarations it uses,
+// the raw C++ written before it, and the versions of the compiler and runtime headers.
+// Evaluations that use impure functions are not cached, and neither are errors.
+type CachingEvaluator struct {
+	Evaluator
+	state *State
+	dir   string
+	// Hash of the compiler, the runtime headers and the options that affect results.
+	version string
+	// Raw C++ written so far, which evaluations may use.
+	raw           []string
+	rawCheckpoint int
+	// Lowered definitions of the declarations used by evaluations, which do not change once defined.
+	definitions map[TopLevelDeclaration]string
+}
+
+// Wraps `evaluator` with a cache in the "evaluations" directory of `options.CacheDir`,
+// or returns it as is if caching is disabled.
+func NewCachingEvaluator(evaluator Evaluator, options cpp.BuildOptions, state *State) Evaluator {
+	version, ok := cacheVersion(options)
+	if !ok {
+		return evaluator
+	}
+	return &CachingEvaluator{
+		Evaluator:   evaluator,
+		state:       state,
+		dir:         filepath.Join(options.CacheDir, "evaluations"),
+		version:     version,
+		definitions: map[TopLevelDeclaration]string{},
+	}
+}
+
+// Hashes the compiler, the runtime headers and the options that affect cached results.
+// Returns false if caching is disabled or the version cannot be determined.
+func cacheVersion(options cpp.BuildOptions) (version string, ok bool) {
+	if options.CacheDir == "" || options.NoCache || compilerHash() == "" {
+		return
+	}
+	hash := sha256.New()
+	fmt.Fprintln(hash, compilerHash(), options.Evaluator, options.IncludeDirs, options.Defines, options.Libraries)
+	for _, header := range []string{"pb.hpp", "ipc.hpp"} {
+		contents, err := os.ReadFile(filepath.Join(options.RuntimeDir, header))
+		if err != nil {
+			log.Printf("Failed to read '%s', disabling the cache. Error: %s\n", header, err)
+			return
+		}
+		hash.Write(contents)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), true
+}
+
+// Write implements Evaluator.
+func (c *CachingEvaluator) Write(text string) error {
+	c.raw = append(c.raw, text)
+	return c.Evaluator.Write(text)
+}
+
+// Checkpoint implements Evaluator.
+func (c *CachingEvaluator) Checkpoint() {
+	c.rawCheckpoint = len(c.raw)
+	c.Evaluator.Checkpoint()
+}
+
+// Rollback implements Evaluator.
+func (c *CachingEvaluator) Rollback() error {
+	c.raw = c.raw[:c.rawCheckpoint]
+	return c.Evaluator.Rollback()
+}
+
+// Evaluate implements Evaluator.
+// Types requested by macros are stored with the result, which is only reused if they are still the same.
+func (c *CachingEvaluator) Evaluate(evaluation Evaluation, getType func(name string) (TypeValue, bool)) (*fj.Value, error) {
+	key, cacheable := c.key(evaluation)
+	if !cacheable {
+		return c.Evaluator.Evaluate(evaluation, getType)
+	}
+	if value, hit := c.load(key, getType); hit {
+		return value, nil
+	}
+	queries := map[string]string{}
+	value, err := c.Evaluator.Evaluate(evaluation, func(name string) (TypeValue, bool) {
+		_type, ok := getType(name)
+		queries[name] = typeString(_type, ok)
+		return _type, ok
+	})
+	if err == nil {
+		c.store(key, value, queries)
+	}
+	return value, err
+}
+
+// EvaluateBatch implements Evaluator.
+func (c *CachingEvaluator) EvaluateBatch(evaluations []Evaluation) ([]*fj.Value, []error) {
+	values := make([]*fj.Value, len(evaluations))
+	errs := make([]error, len(evaluations))
+	keys := make([]string, len(evaluations))
+	missing := []int{}
+	for i, evaluation := range evaluations {
+		key, cacheable := c.key(evaluation)
+		if cacheable {
+			keys[i] = key
+			if value, hit := c.load(key, nil); hit {
+				values[i] = value
+				continue
+			}
+		}
+		missing = append(missing, i)
+	}
+	if len(missing) == 0 {
+		return values, errs
+	}
+	missingEvaluations := []Evaluation{}
+	for _, i := range missing {
+		missingEvaluations = append(missingEvaluations, evaluations[i])
+	}
+	missingValues, missingErrs := c.Evaluator.EvaluateBatch(missingEvaluations)
+	for j, i := range missing {
+		values[i], errs[i] = missingValues[j], missingErrs[j]
+		if errs[i] == nil && keys[i] != "" {
+			c.store(keys[i], values[i], nil)
+		}
+	}
+	return values, errs
+}
+
+// The cache key of an evaluation, which is not cacheable if it has side effects, such as assigning
+// a global variable, if it uses an impure function or if it uses a declaration that has not been analyzed yet.
+func (c *CachingEvaluator) key(evaluation Evaluation) (key string, cacheable bool) {
+	// code with side effects, e.g. a closure that assigns a global variable
+	switch evaluation := evaluation.(type) {
+	case MacroEvaluation:
+		if evaluation.Macro.Function.GetFlags() != 0 {
+			return "", false
+		}
+	case TypeEvaluation:
+		if evaluation.Expression.GetFlags() != 0 {
+			return "", false
+		}
+	}
+	// the declarations used directly and indirectly
+	used := map[TopLevelDeclaration]bool{}
+	pending := slices.Clone(evaluation.GetUses())
+	for len(pending) > 0 {
+		decl := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if used[decl] {
+			continue
+		}
+		used[decl] = true
+		if decl.GetFlags() != 0 {
+			return "", false
+		}
+		if _, isBuiltin := decl.(*BuiltinDeclaration); isBuiltin {
+			continue
+		}
+		uses, analyzed := c.state.uses[decl]
+		if !analyzed {
+			return "", false
+		}
+		pending = append(pending, uses...)
+	}
+	definitions := []string{}
+	for decl := range used {
+		definition, ok := c.definition(decl)
+		if !ok {
+			return "", false
+		}
+		definitions = append(definitions, definition)
+	}
+	slices.Sort(definitions)
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%T\n%s\n", c.version, evaluation, evaluation.Lower(c.state))
+	for _, text := range c.raw {
+		fmt.Fprintf(hash, "%d\n%s\n", len(text), text)
+	}
+	for _, definition := range definitions {
+		fmt.Fprintf(hash, "%d\n%s\n", len(definition), definition)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), true
+}
+
+// The lowered definition of a declaration, which identifies it in cache keys.
+func (c *CachingEvaluator) definition(decl TopLevelDeclaration) (definition string, ok bool) {
+	if definition, ok = c.definitions[decl]; ok {
+		return
+	}
+	switch decl := decl.(type) {
+	case *BuiltinDeclaration:
+		definition = "builtin " + decl.Name
+	case *ConstantDeclaration:
+		// constants in the current batch have not been evaluated yet
+		if decl.value == nil {
+			return "", false
+		}
+		definition = decl.LowerDefinition(c.state)
+	default:
+		definition = decl.LowerDefinition(c.state)
+	}
+	c.definitions[decl] = definition
+	return definition, true
+}
+
+// Identifies the result of a getType query.
+func typeString(_type TypeValue, ok bool) string {
+	if !ok {
+		return ""
+	}
+	return _type.String()
+}
+
+func (c *CachingEvaluator) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// Reads a cached result, checking that the types requested by the evaluation have not changed.
+func (c *CachingEvaluator) load(key string, getType func(name string) (TypeValue, bool)) (value *fj.Value, hit bool) {
+	contents, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return
+	}
+	entry, err := fj.ParseBytes(contents)
+	if err != nil || entry.Get("value") == nil {
+		log.Printf("Ignoring corrupted evaluation cache entry '%s'.\n", c.path(key))
+		return
+	}
+	queries := entry.GetObject("queries")
+	if queries != nil && queries.Len() > 0 {
+		if getType == nil {
+			return
+		}
+		stale := false
+		queries.Visit(func(name []byte, expected *fj.Value) {
+			_type, ok := getType(string(name))
+			stale = stale || typeString(_type, ok) != string(expected.GetStringBytes())
+		})
+		if stale {
+			return
+		}
+	}
+	log.Printf("Using cached evaluation result '%s'.\n", c.path(key))
+	return entry.Get("value"), true
+}
+
+// Writes a result to the cache. Failures are logged, since the cache is only an optimization.
+func (c *CachingEvaluator) store(key string, value *fj.Value, queries map[string]string) {
+	var entry strings.Builder
+	entry.WriteString(`{ "queries": {`)
+	first := true
+	for name, _type := range queries {
+		if !first {
+			entry.WriteString(", ")
+		}
+		first = false
+		entry.WriteString(strconv.Quote(name) + ": " + strconv.Quote(_type))
+	}
+	entry.WriteString(`}, "value": ` + value.String() + " }")
+	path := c.path(key)
+	if err := writeCacheFile(path, entry.String()); err != nil {
+		log.Println("Failed to write evaluation cache entry. Error:", err)
+	}
+}
+
+// Writes a file in the cache, through a temporary file so that concurrent compilers never read a partial file.
+func writeCacheFile(path string, contents string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "writing-")
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(contents)
+	file.Close()
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+var _ Evaluator = (*CachingEvaluator)(nil)
@@ -60,6 +60,16 @@ func (table *DeclarationTable) Get(name string) (Declaration, bool) {
 	return local, isLocal
 }
 
+// Returns the declaration that `name` refers to, without capturing it like Get.
+func (table *DeclarationTable) resolve(name string) Declaration {
+	for t := table; t != nil; t = t.parent {
+		if local, isLocal := t.localDeclarations[name]; isLocal {
+			return local
+		}
+	}
+	return table.topLevelDeclarations[name]
+}
+
 type Declaration interface {
 	Node
 	GetName() Name
@@ -134,7 +134,17 @@ type UnexpectedLenArgument struct {
 }
 
 func (e UnexpectedLenArgument) Error() string {
-	text := fmt.Sprintf("Expected list or string, but found type '%s'.", e.Found)
+	text := fmt.Sprintf("Expected list, map or string, but found type '%s'.", e.Found)
+	return makeCodeError(text, e.At, "")
+}
+
+type NotIndexable struct {
+	Found TypeValue
+	At    Span
+}
+
+func (e NotIndexable) Error() string {
+	text := fmt.Sprintf("Expected list or string to index, but found type '%s'.", e.Found)
 	return makeCodeError(text, e.At, "")
 }
 
@@ -148,6 +158,67 @@ func (e ExpectedList) Error() string {
 	return makeCodeError(text, e.At, "")
 }
 
+type ExpectedFunction struct {
+	Found TypeValue
+	At    Span
+}
+
+func (e ExpectedFunction) Error() string {
+	text := fmt.Sprintf("Expected function, but found type '%s'.", e.Found)
+	return makeCodeError(text, e.At, "")
+}
+
+type UnorderedElementType struct {
+	Found TypeValue
+	At    Span
+}
+
+func (e UnorderedElementType) Error() string {
+	text := fmt.Sprintf("Cannot sort elements of type '%s' without a comparison function.", e.Found)
+	return makeCodeError(text, e.At, "pass a comparison function: sort(list, less)")
+}
+
+type NotJsonSerializable struct {
+	Found TypeValue
+	At    Span
+}
+
+func (e NotJsonSerializable) Error() string {
+	text := fmt.Sprintf("Values of type '%s' cannot be converted to or from JSON.", e.Found)
+	if _, isStruct := e.Found.(*StructType); isStruct {
+		text += " The only struct with a JSON encoding is `Error`."
+	}
+	return makeCodeError(text, e.At, "")
+}
+
+type ExpectedTypeArgument struct {
+	At Span
+}
+
+func (e ExpectedTypeArgument) Error() string {
+	return makeCodeError("Expected a type as second argument, as in `fromJson(text, List(Int))`.", e.At, "")
+}
+
+type ExpectedMap struct {
+	Found TypeValue
+	At    Span
+}
+
+func (e ExpectedMap) Error() string {
+	text := fmt.Sprintf("Expected map, but found type '%s'.", e.Found)
+	return makeCodeError(text, e.At, "")
+}
+
+type InvalidMapKeyType struct {
+	Found TypeValue
+	At    Span
+}
+
+func (e InvalidMapKeyType) Error() string {
+	text := fmt.Sprintf("Type '%s' cannot be used as map key. Keys must be Int, Bool, String, or tuples of these.", e.Found)
+	return makeCodeError(text, e.At, "")
+}
+
 type ExpectedTuple struct {
 	Found TypeValue
 	At    Span
@@ -240,7 +311,7 @@ type InvalidMainSignature struct {
 }
 
 func (e InvalidMainSignature) Error() string {
-	text := fmt.Sprintf("The main function must have a type signature of '%s', found '%s'.", MainType, e.Found)
+	text := fmt.Sprintf("The main function must have a type signature of '%s' or '%s', found '%s'.", MainType, MainWithArgumentsType, e.Found)
 	return makeCodeError(text, e.At, "")
 }
 
@@ -295,3 +366,28 @@ type CannotDetermineRawType struct {
 func (e CannotDetermineRawType) Error() string {
 	return fmt.Sprintf(`Cannot determine type of raw expression at %s`, e.Span)
 }
+
+// An error reported by clang++ or clang-repl, mapped back to Yune code.
+type CppError struct {
+	Message string
+	At      Span
+	// Whether the error occurred in a user-written raw C++ block.
+	InRawString bool
+}
+
+func (e CppError) Error() string {
+	if e.InRawString {
+		return makeCodeError("C++ error in raw C++ code: "+e.Message, e.At, "in this C++ block")
+	}
+	return makeCodeError("Generated C++ code failed to compile: "+e.Message, e.At, "generated from here")
+}
+
+// An error that occurred while evaluating code at compile time, such as a panic.
+type EvaluationError struct {
+	Message string
+	At      Span
+}
+
+func (e EvaluationError) Error() string {
+	return makeCodeError("Compile-time evaluation failed: "+e.Message, e.At, "while evaluating this")
+}
@@ -0,0 +1,174 @@
+package ast
+
+import (
+	"fmt"
+	"yune/cpp"
+
+	fj "github.com/valyala/fastjson"
+)
+
+// Evaluates Yune code at compile time, for constants, type expressions and macros.
+// Results are encoded as JSON in the format of `toJson_` in pb.hpp.
+type Evaluator interface {
+	// Writes raw C++ that is only available at compile time.
+	Write(text string) error
+	// Makes the prototype of a declaration available to later evaluations.
+	Declare(decl TopLevelDeclaration) error
+	// Makes the analyzed declaration available to later evaluations.
+	Define(decl TopLevelDeclaration) error
+	// `getType` returns the type of a declaration, for macros that request it.
+	Evaluate(evaluation Evaluation, getType func(name string) (TypeValue, bool)) (*fj.Value, error)
+	// Evaluates independent evaluations that do not request types, returning a result or error for each.
+	EvaluateBatch(evaluations []Evaluation) ([]*fj.Value, []error)
+	// Waits until all declarations have been processed, returning an error if any of them failed.
+	WaitForFinish() error
+	// The C++ code of all declarations and definitions, which forms the lowered module.
+	Declared() cpp.Module
+	// Marks the current declarations, which Rollback returns to.
+	Checkpoint()
+	// Forgets everything written, declared, defined and evaluated since the last Checkpoint.
+	Rollback() error
+	Close()
+}
+
+// Creates the evaluator selected by `options.Evaluator`.
+func NewEvaluator(options cpp.BuildOptions, state *State) Evaluator {
+	var evaluator Evaluator
+	switch options.Evaluator {
+	case "go":
+		evaluator = NewGoEvaluator(options, state)
+	case "", "clang-repl":
+		evaluator = NewCppEvaluator(options, state)
+	default:
+		panic(fmt.Sprintf("unexpected evaluator: %s", options.Evaluator))
+	}
+	return NewCachingEvaluator(evaluator, options, state)
+}
+
+// Code that is evaluated at compile time.
+type Evaluation interface {
+	Lower(state *State) cpp.Expression
+	// The top-level declarations used by the code, not including the ones they use in turn.
+	GetUses() []TopLevelDeclaration
+}
+
+// The body of a constant declaration.
+type ConstantEvaluation struct {
+	Body        Block
+	Type        TypeValue
+	HasCaptures bool
+	Uses        []TopLevelDeclaration
+}
+
+func (e ConstantEvaluation) GetUses() []TopLevelDeclaration {
+	return e.Uses
+}
+
+func (e ConstantEvaluation) Lower(state *State) cpp.Expression {
+	return cpp.LambdaBlock(e.Body.Lower(state), e.Type.LowerType(), e.HasCaptures)
+}
+
+// An expression that results in a type, such as a type annotation.
+type TypeEvaluation struct {
+	Expression Expression
+	Uses       []TopLevelDeclaration
+}
+
+func (e TypeEvaluation) GetUses() []TopLevelDeclaration {
+	return e.Uses
+}
+
+func (e TypeEvaluation) Lower(state *State) cpp.Expression {
+	return e.Expression.Lower(state)
+}
+
+// A call to the function of a macro, with the text of the macro and a function to look up types.
+type MacroEvaluation struct {
+	Macro *Macro
+	// The declarations used by the function of the macro.
+	Uses []TopLevelDeclaration
+}
+
+func (e MacroEvaluation) GetUses() []TopLevelDeclaration {
+	return e.Uses
+}
+
+func (e MacroEvaluation) Lower(state *State) cpp.Expression {
+	return fmt.Sprintf(`(%s)(%q, getType_c)`, e.Macro.Function.Lower(state), e.Macro.GetText())
+}
+
+// Evaluates by lowering to C++, which is run by clang-repl.
+type CppEvaluator struct {
+	interpreter *cpp.Interpreter
+	state       *State
+}
+
+func NewCppEvaluator(options cpp.BuildOptions, state *State) *CppEvaluator {
+	return &CppEvaluator{
+		interpreter: cpp.NewInterpreter(options),
+		state:       state,
+	}
+}
+
+// Write implements Evaluator.
+func (e *CppEvaluator) Write(text string) error {
+	return e.interpreter.Write(text)
+}
+
+// Declare implements Evaluator.
+func (e *CppEvaluator) Declare(decl TopLevelDeclaration) error {
+	return e.interpreter.Declare(decl.LowerDeclaration(e.state))
+}
+
+// Define implements Evaluator.
+func (e *CppEvaluator) Define(decl TopLevelDeclaration) error {
+	return e.interpreter.Declare(decl.LowerDefinition(e.state))
+}
+
+// Evaluate implements Evaluator.
+func (e *CppEvaluator) Evaluate(evaluation Evaluation, getType func(name string) (TypeValue, bool)) (*fj.Value, error) {
+	return e.interpreter.Evaluate(evaluation.Lower(e.state), func(name string) (_type cpp.Type, ok bool) {
+		typeValue, ok := getType(name)
+		if ok {
+			_type = typeValue.LowerValue()
+		}
+		return
+	})
+}
+
+// EvaluateBatch implements Evaluator.
+func (e *CppEvaluator) EvaluateBatch(evaluations []Evaluation) ([]*fj.Value, []error) {
+	expressions := []cpp.Expression{}
+	for _, evaluation := range evaluations {
+		expressions = append(expressions, evaluation.Lower(e.state))
+	}
+	return e.interpreter.EvaluateBatch(expressions)
+}
+
+// WaitForFinish implements Evaluator.
+func (e *CppEvaluator) WaitForFinish() error {
+	return e.interpreter.WaitForFinish()
+}
+
+// Declared implements Evaluator.
+func (e *CppEvaluator) Declared() cpp.Module {
+	return e.interpreter.Declared
+}
+
+// Checkpoint implements Evaluator.
+func (e *CppEvaluator) Checkpoint() {
+	e.interpreter.Checkpoint()
+}
+
+// Rollback implements Evaluator.
+func (e *CppEvaluator) Rollback() error {
+	return e.interpreter.Rollback()
+}
+
+// Close implements Evaluator.
+func (e *CppEvaluator) Close() {
+	e.interpreter.Close()
+}
+
+var _ Evaluator = (*CppEvaluator)(nil)
+var _ Evaluator = (*GoEvaluator)(nil)
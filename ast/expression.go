@@ -2,6 +2,7 @@ package ast
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 	"yune/cpp"
 	"yune/util"
@@ -129,6 +130,8 @@ func (String) GetFlags() Flags { return 0 }
 type Variable struct {
 	Name  Name
 	flags Flags
+	// Whether the variable refers to a builtin declaration rather than a declaration that shadows it.
+	builtin bool
 }
 
 func (v Variable) String() string {
@@ -148,6 +151,7 @@ func (v *Variable) GetSpan() Span {
 func (v *Variable) Analyze(expected TypeValue, anal Analyzer) TypeValue {
 	_type, flags := anal.GetType(v.Name)
 	v.flags = flags
+	_, v.builtin = anal.Table.resolve(v.Name.String).(*BuiltinDeclaration)
 	return _type
 }
 
@@ -157,6 +161,9 @@ func (v *Variable) GetFlags() Flags {
 
 // Lower implements Expression.
 func (v *Variable) Lower(state *State) cpp.Expression {
+	if name, shadowable := shadowableBuiltins[v.Name.String]; shadowable && v.builtin {
+		return name
+	}
 	return v.Name.Lower()
 }
 
@@ -165,6 +172,9 @@ type FunctionCall struct {
 	Function         Expression
 	Argument         Expression
 	parameterIsTuple bool
+	// The name of the builtin function that is called, or "" if the function is not a builtin.
+	// A local or top-level declaration with the name of a builtin shadows it.
+	builtin string
 	// A field for storing data that builtin functions need to transfer
 	// between Analyze and Lower.
 	builtinData any
@@ -195,6 +205,14 @@ func (f *FunctionCall) GetFlags() (flags Flags) {
 	if argumentFlags&IMPURE_FUNCTION != 0 || argumentFlags&IMPURE != 0 {
 		flags |= IMPURE
 	}
+	// The same holds for functions passed as one of multiple arguments.
+	if tuple, argumentIsTuple := f.Argument.(*Tuple); argumentIsTuple {
+		for _, element := range tuple.Elements {
+			if element.GetFlags()&IMPURE_FUNCTION != 0 {
+				flags |= IMPURE
+			}
+		}
+	}
 	return
 }
 
@@ -216,14 +234,127 @@ func checkTupleTypeArity(tupleType *TupleType, expected int, at Span, anal Analy
 	}
 }
 
+func checkIsFunction(t TypeValue, at Span, anal Analyzer) (fnType *FnType) {
+	fnType, isFunction := t.(*FnType)
+	if !isFunction {
+		anal.ReportError(ExpectedFunction{Found: t, At: at})
+	}
+	return
+}
+
+// Returns the span of the i-th argument if the argument is a tuple literal,
+// otherwise the span of the whole argument.
+func (f *FunctionCall) argumentSpan(i int) Span {
+	if tuple, isTuple := f.Argument.(*Tuple); isTuple && i < len(tuple.Elements) {
+		return tuple.Elements[i].GetSpan()
+	}
+	return f.Argument.GetSpan()
+}
+
+// Analyzes the arguments of a builtin that takes a list as first argument
+// and a function as last argument. Returns the list type, the function type,
+// and the types of all arguments.
+func (f *FunctionCall) analyzeListFunctionArguments(arity int, anal Analyzer) (*ListType, *FnType, *TupleType) {
+	argumentType := f.Argument.Analyze(nil, anal)
+	tupleArgumentType := checkIsTuple(argumentType, f.Argument.GetSpan(), anal)
+	checkTupleTypeArity(tupleArgumentType, arity, f.Argument.GetSpan(), anal)
+	listType, isList := tupleArgumentType.Elements[0].(*ListType)
+	if !isList {
+		anal.ReportError(ExpectedList{
+			Found: tupleArgumentType.Elements[0],
+			At:    f.argumentSpan(0),
+		})
+	}
+	fnType := checkIsFunction(tupleArgumentType.Elements[arity-1], f.argumentSpan(arity-1), anal)
+	f.parameterIsTuple = true
+	return listType, fnType, tupleArgumentType
+}
+
+// Reports an error if the function type is not equal to the expected one.
+// Used for function arguments of builtins, so that the error shows the complete expected signature.
+func checkFunctionType(found *FnType, expected *FnType, at Span, anal Analyzer) {
+	if !found.Eq(expected) {
+		anal.ReportError(UnexpectedType{
+			Expected: expected,
+			Found:    found,
+			At:       at,
+		})
+	}
+}
+
+// Reports an error if the type is not Int or Float.
+func checkIsNumber(t TypeValue, at Span, anal Analyzer) {
+	if !t.Eq(&IntType{}) && !t.Eq(&FloatType{}) {
+		anal.ReportError(UnexpectedType{
+			Expected: NewUnionType(&IntType{}, &FloatType{}),
+			Found:    t,
+			At:       at,
+		})
+	}
+}
+
+// Returns whether values of a type have a JSON encoding (see pb.hpp).
+func isJsonType(t TypeValue) bool {
+	switch t := t.(type) {
+	case *IntType, *FloatType, *BoolType, *StringType:
+		return true
+	case *ListType:
+		return isJsonType(t.Element)
+	case *MapType:
+		return isJsonType(t.Key) && isJsonType(t.Value)
+	case *TupleType:
+		return !slices.ContainsFunc(t.Elements, func(e TypeValue) bool { return !isJsonType(e) })
+	case *UnionType:
+		return len(t.Variants) > 0 && !slices.ContainsFunc(t.Variants, func(v TypeValue) bool { return !isJsonType(v) })
+	case *StructType:
+		// other structs are opaque compiler types or C++ types, whose fields are unknown
+		return t.Eq(ErrorType)
+	default:
+		return false
+	}
+}
+
+func checkIsJsonType(t TypeValue, at Span, anal Analyzer) {
+	if !isJsonType(t) {
+		anal.ReportError(NotJsonSerializable{Found: t, At: at})
+	}
+}
+
+func checkIsMap(t TypeValue, at Span, anal Analyzer) (mapType *MapType) {
+	mapType, isMap := t.(*MapType)
+	if !isMap {
+		anal.ReportError(ExpectedMap{Found: t, At: at})
+	}
+	if !IsMapKeyType(mapType.Key) {
+		anal.ReportError(InvalidMapKeyType{Found: mapType.Key, At: at})
+	}
+	return
+}
+
+// Analyzes the arguments of a builtin that takes a map as first argument,
+// followed by a key. Returns the map type and the types of all arguments.
+func (f *FunctionCall) analyzeMapKeyArguments(arity int, anal Analyzer) (*MapType, *TupleType) {
+	argumentType := f.Argument.Analyze(nil, anal)
+	tupleArgumentType := checkIsTuple(argumentType, f.Argument.GetSpan(), anal)
+	checkTupleTypeArity(tupleArgumentType, arity, f.Argument.GetSpan(), anal)
+	mapType := checkIsMap(tupleArgumentType.Elements[0], f.Argument.(*Tuple).Elements[0].GetSpan(), anal)
+	keyType := tupleArgumentType.Elements[1]
+	if !IsSubType(keyType, mapType.Key) {
+		anal.ReportError(UnexpectedType{
+			Expected: mapType.Key,
+			Found:    keyType,
+			At:       f.Argument.(*Tuple).Elements[1].GetSpan(),
+		})
+	}
+	f.parameterIsTuple = true
+	return mapType, tupleArgumentType
+}
+
 // Match builtin functions that need to be handled differently as their types
 // cannot be expressed by Yune. Returns `nil` if it is not a special builtin.
-func (f *FunctionCall) AnalyzeBuiltins(anal Analyzer) (returnType TypeValue) {
-	name, functionIsVariable := f.getFunctionName()
-	if !functionIsVariable {
-		return nil
-	}
-	switch name {
+func (f *FunctionCall) AnalyzeBuiltins(expected TypeValue, anal Analyzer) (returnType TypeValue) {
+	f.builtin = f.resolveBuiltin(anal)
+	switch f.builtin {
 	// getTupleElement_(<any tuple type>, index Int): <element type at index>
 	case "getTupleElement_":
 		argumentType := f.Argument.Analyze(nil, anal)
@@ -238,11 +369,51 @@ func (f *FunctionCall) AnalyzeBuiltins(anal Analyzer) (returnType TypeValue) {
 	case "inject":
 		f.Argument.Analyze(nil, anal)
 		return ExpressionType
-	// len(Union[String, List(<any type>)]): Int
+	// (<any type>): String
+	case "show", "toString":
+		f.Argument.Analyze(nil, anal)
+		return &StringType{}
+	// toJson(<JSON type>): String
+	case "toJson":
+		argumentType := f.Argument.Analyze(nil, anal)
+		checkIsJsonType(argumentType, f.Argument.GetSpan(), anal)
+		return &StringType{}
+	// fromJson(text: String, <type>): Union[<type>, Error]
+	case "fromJson":
+		tuple, argumentIsTuple := f.Argument.(*Tuple)
+		if !argumentIsTuple || len(tuple.Elements) != 2 {
+			anal.ReportError(ExpectedTypeArgument{At: f.Argument.GetSpan()})
+		}
+		textType := tuple.Elements[0].Analyze(&StringType{}, anal)
+		if !textType.Eq(&StringType{}) {
+			anal.ReportError(UnexpectedType{
+				Expected: &StringType{},
+				Found:    textType,
+				At:       tuple.Elements[0].GetSpan(),
+			})
+		}
+		// the type is evaluated at compile time, like a type annotation
+		decodedType := &Type{Expression: tuple.Elements[1]}
+		decodedType.Analyze(anal)
+		checkIsJsonType(decodedType.Get(), tuple.Elements[1].GetSpan(), anal)
+		returnType := NewUnionType(decodedType.Get(), ErrorType)
+		f.builtinData = [2]TypeValue{decodedType.Get(), returnType}
+		return returnType
+	// (<any type>): ()
+	case "print", "println":
+		f.Argument.Analyze(nil, anal)
+		return &TupleType{}
+	// dbg(<any type>): <same type>
+	case "dbg":
+		argumentType := f.Argument.Analyze(expected, anal)
+		f.builtinData = argumentType
+		return argumentType
+	// len(Union[String, List(<any type>), Map(<any type>, <any type>)]): Int
 	case "len":
 		argumentType := f.Argument.Analyze(nil, anal)
 		_, isListType := argumentType.(*ListType)
-		if !argumentType.Eq(&StringType{}) && !isListType {
+		_, isMapType := argumentType.(*MapType)
+		if !argumentType.Eq(&StringType{}) && !isListType && !isMapType {
 			anal.ReportError(UnexpectedLenArgument{
 				Found: argumentType,
 				At:    f.Argument.GetSpan(),
@@ -327,6 +498,148 @@ func (f *FunctionCall) AnalyzeBuiltins(anal Analyzer) (returnType TypeValue) {
 		}
 		f.parameterIsTuple = true
 		return &TupleType{}
+	// toMap(List((<key type>, <value type>))): Map(<key type>, <value type>)
+	case "toMap":
+		var expectedArgumentType TypeValue
+		if expectedMapType, expectsMap := expected.(*MapType); expectsMap {
+			// allows `toMap([])` to create an empty map of the expected type
+			expectedArgumentType = &ListType{Element: &TupleType{Elements: []TypeValue{expectedMapType.Key, expectedMapType.Value}}}
+		}
+		argumentType := f.Argument.Analyze(expectedArgumentType, anal)
+		argumentListType, argumentIsList := argumentType.(*ListType)
+		if !argumentIsList {
+			anal.ReportError(ExpectedList{
+				Found: argumentType,
+				At:    f.Argument.GetSpan(),
+			})
+		}
+		entryType := checkIsTuple(argumentListType.Element, f.Argument.GetSpan(), anal)
+		checkTupleTypeArity(entryType, 2, f.Argument.GetSpan(), anal)
+		mapType := &MapType{Key: entryType.Elements[0], Value: entryType.Elements[1]}
+		if !IsMapKeyType(mapType.Key) {
+			anal.ReportError(InvalidMapKeyType{Found: mapType.Key, At: f.Argument.GetSpan()})
+		}
+		return mapType
+	// insert(Map(<key type>, <value type>), <key type>, <value type>): Map(<key type>, <value type>)
+	case "insert":
+		mapType, argumentType := f.analyzeMapKeyArguments(3, anal)
+		valueType := argumentType.Elements[2]
+		if !IsSubType(valueType, mapType.Value) {
+			anal.ReportError(UnexpectedType{
+				Expected: mapType.Value,
+				Found:    valueType,
+				At:       f.Argument.(*Tuple).Elements[2].GetSpan(),
+			})
+		}
+		return mapType
+	// lookup(Map(<key type>, <value type>), <key type>): Union[<value type>, ()]
+	case "lookup":
+		mapType, _ := f.analyzeMapKeyArguments(2, anal)
+		return NewUnionType(mapType.Value, &TupleType{})
+	// remove(Map(<key type>, <value type>), <key type>): Map(<key type>, <value type>)
+	case "remove":
+		mapType, _ := f.analyzeMapKeyArguments(2, anal)
+		return mapType
+	// keys(Map(<key type>, <value type>)): List(<key type>)
+	case "keys":
+		argumentType := f.Argument.Analyze(nil, anal)
+		mapType := checkIsMap(argumentType, f.Argument.GetSpan(), anal)
+		return &ListType{Element: mapType.Key}
+	// abs(<number type>): <number type>
+	case "abs":
+		argumentType := f.Argument.Analyze(nil, anal)
+		checkIsNumber(argumentType, f.Argument.GetSpan(), anal)
+		return argumentType
+	// min, max and pow take two numbers of the same type
+	// (<number type>, <number type>): <number type>
+	case "min", "max", "pow":
+		argumentType := f.Argument.Analyze(nil, anal)
+		tupleArgumentType := checkIsTuple(argumentType, f.Argument.GetSpan(), anal)
+		checkTupleTypeArity(tupleArgumentType, 2, f.Argument.GetSpan(), anal)
+		numberType := tupleArgumentType.Elements[0]
+		checkIsNumber(numberType, f.argumentSpan(0), anal)
+		if !tupleArgumentType.Elements[1].Eq(numberType) {
+			anal.ReportError(UnexpectedType{
+				Expected: numberType,
+				Found:    tupleArgumentType.Elements[1],
+				At:       f.argumentSpan(1),
+			})
+		}
+		f.parameterIsTuple = true
+		return numberType
+	// map(List(<input type>), Fn(<input type>, <output type>)): List(<output type>)
+	case "map":
+		listType, fnType, _ := f.analyzeListFunctionArguments(2, anal)
+		checkFunctionType(fnType, &FnType{Argument: listType.Element, Return: fnType.Return}, f.argumentSpan(1), anal)
+		return &ListType{Element: fnType.Return}
+	// filter(List(<element type>), Fn(<element type>, Bool)): List(<element type>)
+	case "filter":
+		listType, fnType, _ := f.analyzeListFunctionArguments(2, anal)
+		checkFunctionType(fnType, &FnType{Argument: listType.Element, Return: &BoolType{}}, f.argumentSpan(1), anal)
+		return listType
+	// fold(List(<element type>), <result type>, Fn((<result type>, <element type>), <result type>)): <result type>
+	case "fold":
+		listType, fnType, argumentType := f.analyzeListFunctionArguments(3, anal)
+		resultType := fnType.Return
+		checkFunctionType(fnType, &FnType{
+			Argument: &TupleType{Elements: []TypeValue{resultType, listType.Element}},
+			Return:   resultType,
+		}, f.argumentSpan(2), anal)
+		if !IsSubType(argumentType.Elements[1], resultType) {
+			anal.ReportError(UnexpectedType{
+				Expected: resultType,
+				Found:    argumentType.Elements[1],
+				At:       f.argumentSpan(1),
+			})
+		}
+		return resultType
+	// concat(List(<element type>), List(<element type>)): List(<element type>)
+	case "concat":
+		var expectedArgumentType TypeValue
+		if expectedListType, expectsList := expected.(*ListType); expectsList {
+			// allows empty list literals as arguments
+			expectedArgumentType = &TupleType{Elements: []TypeValue{expectedListType, expectedListType}}
+		}
+		argumentType := f.Argument.Analyze(expectedArgumentType, anal)
+		tupleArgumentType := checkIsTuple(argumentType, f.Argument.GetSpan(), anal)
+		checkTupleTypeArity(tupleArgumentType, 2, f.Argument.GetSpan(), anal)
+		firstArgumentListType, firstArgumentIsList := tupleArgumentType.Elements[0].(*ListType)
+		if !firstArgumentIsList {
+			anal.ReportError(ExpectedList{Found: tupleArgumentType.Elements[0], At: f.argumentSpan(0)})
+		}
+		if !tupleArgumentType.Elements[1].Eq(firstArgumentListType) {
+			anal.ReportError(UnexpectedType{
+				Expected: firstArgumentListType,
+				Found:    tupleArgumentType.Elements[1],
+				At:       f.argumentSpan(1),
+			})
+		}
+		f.parameterIsTuple = true
+		return firstArgumentListType
+	// sort(List(<element type>)): List(<element type>)
+	// sort(List(<element type>), less: Fn((<element type>, <element type>), Bool)): List(<element type>)
+	case "sort":
+		argumentType := f.Argument.Analyze(nil, anal)
+		if listType, isList := argumentType.(*ListType); isList {
+			// only types that are ordered in C++ can be sorted without a comparison function
+			if !IsOrderedType(listType.Element) {
+				anal.ReportError(UnorderedElementType{Found: listType.Element, At: f.Argument.GetSpan()})
+			}
+			return listType
+		}
+		tupleArgumentType := checkIsTuple(argumentType, f.Argument.GetSpan(), anal)
+		checkTupleTypeArity(tupleArgumentType, 2, f.Argument.GetSpan(), anal)
+		listType, isList := tupleArgumentType.Elements[0].(*ListType)
+		if !isList {
+			anal.ReportError(ExpectedList{Found: tupleArgumentType.Elements[0], At: f.argumentSpan(0)})
+		}
+		fnType := checkIsFunction(tupleArgumentType.Elements[1], f.argumentSpan(1), anal)
+		checkFunctionType(fnType, &FnType{
+			Argument: &TupleType{Elements: []TypeValue{listType.Element, listType.Element}},
+			Return:   &BoolType{},
+		}, f.argumentSpan(1), anal)
+		f.parameterIsTuple = true
+		return listType
 	default:
 		return nil
 	}
@@ -334,7 +647,7 @@ func (f *FunctionCall) AnalyzeBuiltins(anal Analyzer) (returnType TypeValue) {
 
 // Analyze implements Expression.
 func (f *FunctionCall) Analyze(expected TypeValue, anal Analyzer) (returnType TypeValue) {
-	if returnType = f.AnalyzeBuiltins(anal); returnType != nil {
+	if returnType = f.AnalyzeBuiltins(expected, anal); returnType != nil {
 		return
 	}
 	maybeFunctionType := f.Function.Analyze(nil, anal)
@@ -363,28 +676,47 @@ func (f *FunctionCall) Analyze(expected TypeValue, anal Analyzer) (returnType Ty
 	return
 }
 
-func (f *FunctionCall) getFunctionName() (string, bool) {
+// Returns the name of the builtin function that is called, or "" if the function is not a builtin.
+func (f *FunctionCall) resolveBuiltin(anal Analyzer) string {
 	functionVariable, functionIsVariable := f.Function.(*Variable)
-	if functionIsVariable {
-		return functionVariable.Name.String, true
+	if !functionIsVariable {
+		return ""
+	}
+	name := functionVariable.Name.String
+	// generated by the compiler, so it is not declared
+	if name == "getTupleElement_" {
+		return name
+	}
+	if _, isBuiltin := anal.Table.resolve(name).(*BuiltinDeclaration); isBuiltin {
+		return name
 	}
-	return "", false
+	return ""
 }
 
 // Lower implements Expression.
 func (f *FunctionCall) Lower(state *State) cpp.Expression {
 	// match builtin functions that need to be handled differently
-	{
-		name, functionIsVariable := f.getFunctionName()
-		if functionIsVariable {
-			switch name {
-			case "getTupleElement_":
-				tupleArgument, _ := f.Argument.(*Tuple)
-				tuple := tupleArgument.Elements[0].Lower(state)
-				index := tupleArgument.Elements[1].(*Integer).Value
-				return fmt.Sprintf(`std::get<%d>(%s)`, index, tuple)
-			}
+	switch f.builtin {
+	case "getTupleElement_":
+		tupleArgument, _ := f.Argument.(*Tuple)
+		tuple := tupleArgument.Elements[0].Lower(state)
+		index := tupleArgument.Elements[1].(*Integer).Value
+		return fmt.Sprintf(`std::get<%d>(%s)`, index, tuple)
+	case "fromJson":
+		types := f.builtinData.([2]TypeValue)
+		text := f.Argument.(*Tuple).Elements[0].Lower(state)
+		return fmt.Sprintf(`fromJson_<%s, %s>(%s)`, types[0].LowerType(), types[1].LowerType(), text)
+	case "dbg":
+		argumentType := f.builtinData.(TypeValue)
+		return fmt.Sprintf(`dbg_(%s, %s, %q)`, f.Argument.Lower(state), f.Span.Lower(), argumentType.String())
+	}
+	if builtinsWithSpan[f.builtin] {
+		// passes the location of the call as extra argument, for error messages
+		if f.parameterIsTuple {
+			return fmt.Sprintf(`apply_(%s, std::tuple_cat(%s, std::make_tuple(%s)))`,
+				f.Function.Lower(state), f.Argument.Lower(state), f.Span.Lower())
 		}
+		return fmt.Sprintf(`%s(%s, %s)`, f.Function.Lower(state), f.Argument.Lower(state), f.Span.Lower())
 	}
 	if f.parameterIsTuple {
 		// calls the function with a tuple of arguments
@@ -393,6 +725,19 @@ func (f *FunctionCall) Lower(state *State) cpp.Expression {
 	return fmt.Sprintf(`%s(%s)`, f.Function.Lower(state), f.Argument.Lower(state))
 }
 
+// Builtins that can panic, which take the span of their call as last argument (see pb.hpp).
+var builtinsWithSpan = map[string]bool{
+	"panic":      true,
+	"get":        true,
+	"set":        true,
+	"subString":  true,
+	"repeat":     true,
+	"charToCode": true,
+	"codeToChar": true,
+	"pow":        true,
+	"abs":        true,
+}
+
 type List struct {
 	Span        Span
 	Elements    []Expression
@@ -567,7 +912,10 @@ func (m *Macro) GetText() string {
 
 // Analyze implements Expression.
 func (m *Macro) Analyze(expected TypeValue, anal Analyzer) TypeValue {
-	functionType := m.Function.Analyze(MacroFunctionType, anal)
+	uses := []TopLevelDeclaration{}
+	functionAnal := anal
+	functionAnal.uses = &uses
+	functionType := m.Function.Analyze(MacroFunctionType, functionAnal)
 	if !functionType.Eq(MacroFunctionType) {
 		fmt.Printf("macro function span: %s\n", m.Function.GetSpan())
 		anal.ReportError(UnexpectedType{
@@ -576,10 +924,11 @@ func (m *Macro) Analyze(expected TypeValue, anal Analyzer) TypeValue {
 			At:       m.Function.GetSpan(),
 		})
 	}
-	v := anal.Evaluate(fmt.Sprintf(
-		`(%s)(%q, getType_c)`,
-		m.Function.Lower(anal.State), m.GetText(),
-	), m)
+	// the expansion depends on the function, so the code containing the macro does too
+	if anal.uses != nil {
+		*anal.uses = append(*anal.uses, uses...)
+	}
+	v := anal.Evaluate(MacroEvaluation{Macro: m, Uses: uses}, m.Span, m)
 	// v is Union[String, Expression]
 	// First try to unmarshal a String.
 	errorTupleElements, isErrorTuple := TryUnmarshalTuple(v)
@@ -795,6 +1144,105 @@ const (
 	And          BinaryOp = "and"
 )
 
+// Checks that `t` is an Int, which is required for indices and slice bounds.
+func checkIsIndex(t TypeValue, at Span, anal Analyzer) {
+	if !t.Eq(&IntType{}) {
+		anal.ReportError(UnexpectedType{
+			Expected: &IntType{},
+			Found:    t,
+			At:       at,
+		})
+	}
+}
+
+// Checks that `t` can be indexed, i.e. that it is a String or a List.
+func checkIsIndexable(t TypeValue, at Span, anal Analyzer) {
+	_, isListType := t.(*ListType)
+	if !t.Eq(&StringType{}) && !isListType {
+		anal.ReportError(NotIndexable{
+			Found: t,
+			At:    at,
+		})
+	}
+}
+
+// Indexing of strings and lists: `xs[i]`.
+// Indexing a string results in a string containing a single character.
+type IndexExpression struct {
+	Span       Span
+	Expression Expression
+	Index      Expression
+}
+
+func (i IndexExpression) String() string {
+	return fmt.Sprintf("%s[%s]", i.Expression, i.Index)
+}
+
+// GetSpan implements Expression.
+func (i *IndexExpression) GetSpan() Span {
+	return i.Span
+}
+
+// Analyze implements Expression.
+func (i *IndexExpression) Analyze(expected TypeValue, anal Analyzer) TypeValue {
+	expressionType := i.Expression.Analyze(nil, anal)
+	checkIsIndexable(expressionType, i.Expression.GetSpan(), anal)
+	checkIsIndex(i.Index.Analyze(&IntType{}, anal), i.Index.GetSpan(), anal)
+	listType, isListType := expressionType.(*ListType)
+	if isListType {
+		return listType.Element
+	}
+	return &StringType{}
+}
+
+func (i *IndexExpression) GetFlags() (flags Flags) {
+	return (i.Expression.GetFlags() | i.Index.GetFlags()) & IMPURE
+}
+
+// Lower implements Expression.
+func (i *IndexExpression) Lower(state *State) cpp.Expression {
+	return fmt.Sprintf(`index_(%s, %s, %s)`, i.Expression.Lower(state), i.Index.Lower(state), i.Span.Lower())
+}
+
+// Slicing of strings and lists: `xs[low:high]`.
+// The result has the same type as the sliced expression.
+type SliceExpression struct {
+	Span       Span
+	Expression Expression
+	Low        Expression
+	High       Expression
+}
+
+func (s SliceExpression) String() string {
+	return fmt.Sprintf("%s[%s:%s]", s.Expression, s.Low, s.High)
+}
+
+// GetSpan implements Expression.
+func (s *SliceExpression) GetSpan() Span {
+	return s.Span
+}
+
+// Analyze implements Expression.
+func (s *SliceExpression) Analyze(expected TypeValue, anal Analyzer) TypeValue {
+	expressionType := s.Expression.Analyze(expected, anal)
+	checkIsIndexable(expressionType, s.Expression.GetSpan(), anal)
+	checkIsIndex(s.Low.Analyze(&IntType{}, anal), s.Low.GetSpan(), anal)
+	checkIsIndex(s.High.Analyze(&IntType{}, anal), s.High.GetSpan(), anal)
+	return expressionType
+}
+
+func (s *SliceExpression) GetFlags() (flags Flags) {
+	return (s.Expression.GetFlags() | s.Low.GetFlags() | s.High.GetFlags()) & IMPURE
+}
+
+// Lower implements Expression.
+func (s *SliceExpression) Lower(state *State) cpp.Expression {
+	return fmt.Sprintf(
+		`slice_(%s, %s, %s, %s)`,
+		s.Expression.Lower(state), s.Low.Lower(state), s.High.Lower(state), s.Span.Lower(),
+	)
+}
+
 type StructExpression struct {
 	Span   Span
 	Name   Name
@@ -963,7 +1411,7 @@ func (r *RawString) GetFlags() Flags {
 }
 
 func (r *RawString) Lower(state *State) cpp.Expression {
-	return r.string
+	return state.lowerRawString(r)
 }
 
 type ValueExpression struct {
@@ -1112,6 +1560,8 @@ var _ Expression = &Tuple{}
 var _ Expression = &Macro{}
 var _ Expression = &UnaryExpression{}
 var _ Expression = &BinaryExpression{}
+var _ Expression = &IndexExpression{}
+var _ Expression = &SliceExpression{}
 var _ Expression = &StructExpression{}
 var _ Expression = &Closure{}
 var _ Expression = &RawString{}
@@ -19,12 +19,35 @@ func (state *State) lowerObject(object *fj.Object) string {
 		// // assume func is declared in global scope
 		// std::Function<int, bool> func = func;   // func refers to the variable being declared
 		// std::Function<int, bool> func = ::func; // func refers to the correct definition
-		return "::" + UnmarshalNonEmptyString(v)
+		name := UnmarshalNonEmptyString(v)
+		if builtin, shadowable := shadowableBuiltins[name]; shadowable && !state.shadowedBuiltins[name] {
+			return "::" + builtin
+		}
+		return "::" + Name{String: name}.Lower()
 	case "Box":
 		return fmt.Sprintf(`box_f(%s)`, state.lowerExpressionValue(v))
+	case "Float":
+		// non-finite floats, which JSON numbers cannot represent
+		switch UnmarshalNonEmptyString(v) {
+		case "nan":
+			return "std::numeric_limits<float>::quiet_NaN()"
+		case "inf":
+			return "std::numeric_limits<float>::infinity()"
+		case "-inf":
+			return "-std::numeric_limits<float>::infinity()"
+		default:
+			panic(fmt.Sprintf("unexpected non-finite float: %s", v))
+		}
 	case "Tuple":
 		elements := UnmarshalArray(v, "elements")
 		return fmt.Sprintf(`std::make_tuple(%s)`, util.JoinFunc(elements, ", ", state.lowerExpressionValue))
+	case "Map":
+		// std::map is initialized from a list of pairs, not tuples
+		entries := UnmarshalArray(v, "entries")
+		return fmt.Sprintf(`{ %s }`, util.JoinFunc(entries, ", ", func(entry *fj.Value) string {
+			elements := UnmarshalTuple(entry)
+			return fmt.Sprintf(`{ %s, %s }`, state.lowerExpressionValue(elements[0]), state.lowerExpressionValue(elements[1]))
+		}))
 	default:
 		fields := ""
 		v.GetObject().Visit(func(keyBytes []byte, fieldValue *fj.Value) {
@@ -53,15 +76,18 @@ func (state *State) lowerExpressionValue(data *fj.Value) string {
 // This does not include the name of the type "Closure".
 func (state *State) lowerClosureValue(v *fj.Value) string {
 	id := string(v.GetStringBytes("id"))
-	closure := state.registeredClosures[id]
-	if closure == nil {
-		panic(fmt.Sprintf("Invalid closure ID: '%s'", id))
-	}
 	captureValues := map[string]string{}
 	for _, capture := range UnmarshalArray(v, "captures") {
 		name := string(capture.GetStringBytes("name"))
 		value := state.lowerExpressionValue(capture.Get("value"))
 		captureValues[name] = value
 	}
+	if template, ok := state.closureTemplates[id]; ok {
+		return fillClosureTemplate(template, captureValues)
+	}
+	closure := state.registeredClosures[id]
+	if closure == nil {
+		panic(fmt.Sprintf("Invalid closure ID: '%s'", id))
+	}
 	return closure.LowerComplex(state, captureValues)
 }
@@ -0,0 +1,478 @@
+package ast
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Builtins that are types rather than functions.
+var builtinTypes = map[string]TypeValue{
+	"Type":       &TypeType{},
+	"Int":        &IntType{},
+	"Float":      &FloatType{},
+	"Bool":       &BoolType{},
+	"String":     &StringType{},
+	"Expression": ExpressionType,
+	"Statement":  StatementType,
+	"Error":      ErrorType,
+}
+
+// Reads stdin for `readLine`, shared so that buffered input is not lost between evaluations.
+var goEvaluatorStdin = bufio.NewReader(os.Stdin)
+
+// Builds a variant of Expression or Statement from the (location, ...) arguments of its builtin.
+func newExpressionValue(name string, fieldNames []string, arguments tupleValue) structValue {
+	fields := make([]structField, len(fieldNames))
+	for i, fieldName := range fieldNames {
+		fields[i] = structField{fieldName, arguments[i]}
+	}
+	return newStructValue(name, fields...)
+}
+
+// Fields of the expressions and statements that are built by builtins, in the order of their arguments.
+var expressionBuilders = map[string]struct {
+	Name   string
+	Fields []string
+}{
+	"integerExpression":      {"IntegerExpression", []string{"location", "value"}},
+	"floatExpression":        {"FloatExpression", []string{"location", "value"}},
+	"boolExpression":         {"BoolExpression", []string{"location", "value"}},
+	"stringExpression":       {"StringExpression", []string{"location", "value"}},
+	"variableExpression":     {"VariableExpression", []string{"location", "name"}},
+	"unaryExpression":        {"UnaryExpression", []string{"location", "op", "expression"}},
+	"binaryExpression":       {"BinaryExpression", []string{"location", "op", "left", "right"}},
+	"functionCallExpression": {"FunctionCallExpression", []string{"location", "function", "argument"}},
+	"closureExpression":      {"ClosureExpression", []string{"location", "parameters", "returnType", "body"}},
+	"macroExpression":        {"MacroExpression", []string{"location", "macro", "text"}},
+	"listExpression":         {"ListExpression", []string{"location", "elements"}},
+	"tupleExpression":        {"TupleExpression", []string{"location", "elements"}},
+	"variableDeclaration":    {"VariableDeclaration", []string{"name", "type", "body"}},
+}
+
+// Converts a float to an int like `checkedToInt_` in pb.hpp, returning () if it does not fit.
+func checkedToInt(value float64) any {
+	if math.IsNaN(value) || value < math.MinInt32 || value >= -math.MinInt32 {
+		return tupleValue{}
+	}
+	return int32(value)
+}
+
+func floatFunction(f func(float64) float64) func(any) any {
+	return func(argument any) any {
+		return float32(f(float64(argument.(float32))))
+	}
+}
+
+// Builtins that take a single Float and return a Float.
+var floatFunctions = map[string]func(any) any{
+	"floor": floatFunction(math.Floor),
+	"ceil":  floatFunction(math.Ceil),
+	"round": floatFunction(math.Round),
+	"sqrt":  floatFunction(math.Sqrt),
+	"exp":   floatFunction(math.Exp),
+	"log":   floatFunction(math.Log),
+	"sin":   floatFunction(math.Sin),
+	"cos":   floatFunction(math.Cos),
+	"tan":   floatFunction(math.Tan),
+}
+
+// Applies an ASCII-only case conversion to every byte, like upperCase and lowerCase in pb.hpp.
+func mapBytes(text string, f func(byte) byte) string {
+	bytes := []byte(text)
+	for i, b := range bytes {
+		bytes[i] = f(b)
+	}
+	return string(bytes)
+}
+
+// Calls a builtin of pb.hpp. `at` is the location of the call, which panics are reported at.
+func (g *GoEvaluator) callBuiltin(name string, argument any, at Span) any {
+	if builder, ok := expressionBuilders[name]; ok {
+		arguments := argument.(tupleValue)
+		switch name {
+		case "unaryExpression":
+			if op := arguments[1].(string); op != ";" && op != "-" {
+				g.panic(Span{}, "Invalid unary operator: '%s'", op)
+			}
+		case "binaryExpression":
+			if op := arguments[1].(string); !slices.Contains([]string{"+", "-", "*", "/", "<", ">"}, op) {
+				g.panic(Span{}, "Invalid binary operator: '%s'", op)
+			}
+		}
+		return newExpressionValue(builder.Name, builder.Fields, arguments)
+	}
+	if f, ok := floatFunctions[name]; ok {
+		return f(argument)
+	}
+	switch name {
+	// types
+	case "List":
+		return &ListType{Element: argument.(TypeValue)}
+	case "Fn":
+		arguments := argument.(tupleValue)
+		return &FnType{Argument: arguments[0].(TypeValue), Return: arguments[1].(TypeValue)}
+	case "Map":
+		arguments := argument.(tupleValue)
+		return &MapType{Key: arguments[0].(TypeValue), Value: arguments[1].(TypeValue)}
+	case "Union":
+		variants := argument.(listValue)
+		if len(variants) == 1 {
+			return variants[0]
+		}
+		// nested unions are flattened and duplicate variants are removed
+		unique := []TypeValue{}
+		for _, variant := range variants {
+			flat := []TypeValue{variant.(TypeValue)}
+			if union, isUnion := variant.(*UnionType); isUnion {
+				flat = union.Variants
+			}
+			for _, variant := range flat {
+				if !slices.ContainsFunc(unique, variant.Eq) {
+					unique = append(unique, variant)
+				}
+			}
+		}
+		return &UnionType{Variants: unique}
+	// expressions
+	case "expressionStatement":
+		return newStructValue("ExpressionStatement", structField{"expression", argument})
+	case "inject":
+		return newStructValue("ValueExpression", structField{"location", int32(0)}, structField{"value", rawJson(g.toJson(argument))})
+	case "panic":
+		g.panic(at, "%s", argument.(string))
+	// output
+	case "show":
+		return g.show(argument)
+	case "toString":
+		return g.toString(argument)
+	case "toJson":
+		return encodeJson(argument)
+	case "fromJson":
+		arguments := argument.(tupleValue)
+		json, err := parseJson(arguments[0].(string))
+		if err != nil {
+			return newError("fromJson: " + err.Error())
+		}
+		value, message := decodeJson(json, arguments[1].(TypeValue))
+		if message != "" {
+			return newError("fromJson: " + message)
+		}
+		return value
+	case "printString", "print":
+		fmt.Print(g.toString(argument))
+		return tupleValue{}
+	case "printlnString", "println":
+		fmt.Println(g.toString(argument))
+		return tupleValue{}
+	// lists and maps
+	case "len":
+		switch value := argument.(type) {
+		case string:
+			return int32(len(value))
+		case listValue:
+			return int32(len(value))
+		case mapValue:
+			return int32(len(value))
+		}
+	case "get":
+		arguments := argument.(tupleValue)
+		list, index := arguments[0].(listValue), arguments[1].(int32)
+		if index < 0 || int(index) >= len(list) {
+			g.panic(at, "get: index %d out of bounds for length %d", index, len(list))
+		}
+		return list[index]
+	case "set":
+		// the list is passed by value, so setting an element only checks the index
+		arguments := argument.(tupleValue)
+		list, index := arguments[0].(listValue), arguments[1].(int32)
+		if index < 0 || int(index) >= len(list) {
+			g.panic(at, "set: index %d out of bounds for length %d", index, len(list))
+		}
+		return tupleValue{}
+	case "append":
+		arguments := argument.(tupleValue)
+		return append(slicesClone(arguments[0].(listValue)), arguments[1])
+	case "concat":
+		arguments := argument.(tupleValue)
+		return append(slicesClone(arguments[0].(listValue)), arguments[1].(listValue)...)
+	case "toMap":
+		m := mapValue{}
+		for _, entry := range argument.(listValue) {
+			entry := entry.(tupleValue)
+			m = m.insert(entry[0], entry[1])
+		}
+		return m
+	case "insert":
+		arguments := argument.(tupleValue)
+		return arguments[0].(mapValue).insert(arguments[1], arguments[2])
+	case "lookup":
+		arguments := argument.(tupleValue)
+		m := arguments[0].(mapValue)
+		if i, found := m.find(arguments[1]); found {
+			return m[i].value
+		}
+		return tupleValue{}
+	case "remove":
+		arguments := argument.(tupleValue)
+		return arguments[0].(mapValue).remove(arguments[1])
+	case "keys":
+		keys := listValue{}
+		for _, entry := range argument.(mapValue) {
+			keys = append(keys, entry.key)
+		}
+		return keys
+	case "map":
+		arguments := argument.(tupleValue)
+		result := listValue{}
+		for _, element := range arguments[0].(listValue) {
+			result = append(result, g.call(arguments[1], element, at))
+		}
+		return result
+	case "filter":
+		arguments := argument.(tupleValue)
+		result := listValue{}
+		for _, element := range arguments[0].(listValue) {
+			if g.call(arguments[1], element, at).(bool) {
+				result = append(result, element)
+			}
+		}
+		return result
+	case "fold":
+		arguments := argument.(tupleValue)
+		result := arguments[1]
+		for _, element := range arguments[0].(listValue) {
+			result = g.call(arguments[2], tupleValue{result, element}, at)
+		}
+		return result
+	case "sort":
+		if list, isList := argument.(listValue); isList {
+			list = slicesClone(list)
+			slices.SortStableFunc(list, compareValues)
+			return list
+		}
+		arguments := argument.(tupleValue)
+		list := slicesClone(arguments[0].(listValue))
+		less := func(a, b any) bool {
+			return g.call(arguments[1], tupleValue{a, b}, at).(bool)
+		}
+		slices.SortStableFunc(list, func(a, b any) int {
+			if less(a, b) {
+				return -1
+			}
+			if less(b, a) {
+				return 1
+			}
+			return 0
+		})
+		return list
+	// strings
+	case "subString":
+		arguments := argument.(tupleValue)
+		s, start, end := arguments[0].(string), arguments[1].(int32), arguments[2].(int32)
+		if start < 0 {
+			g.panic(at, "subString: start (%d) < 0", start)
+		}
+		if int(end) > len(s) {
+			g.panic(at, "subString: end (%d) > len (%d)", end, len(s))
+		}
+		if end < start {
+			g.panic(at, "subString: end (%d) < start (%d)", end, start)
+		}
+		return s[start:end]
+	case "indexOf":
+		arguments := argument.(tupleValue)
+		text, search, offset := arguments[0].(string), arguments[1].(string), arguments[2].(int32)
+		if offset < 0 || int(offset) > len(text) {
+			return tupleValue{}
+		}
+		found := strings.Index(text[offset:], search)
+		if found < 0 {
+			return tupleValue{}
+		}
+		return int32(found) + offset
+	case "split":
+		arguments := argument.(tupleValue)
+		text, separator := arguments[0].(string), arguments[1].(string)
+		parts := listValue{}
+		if separator == "" {
+			// splits into bytes rather than UTF-8 characters, like pb.hpp
+			for i := range len(text) {
+				parts = append(parts, text[i:i+1])
+			}
+			return parts
+		}
+		for _, part := range strings.Split(text, separator) {
+			parts = append(parts, part)
+		}
+		return parts
+	case "join":
+		arguments := argument.(tupleValue)
+		parts := []string{}
+		for _, part := range arguments[0].(listValue) {
+			parts = append(parts, part.(string))
+		}
+		return strings.Join(parts, arguments[1].(string))
+	case "replace":
+		arguments := argument.(tupleValue)
+		text, from, to := arguments[0].(string), arguments[1].(string), arguments[2].(string)
+		if from == "" {
+			return text
+		}
+		return strings.ReplaceAll(text, from, to)
+	case "trim":
+		return strings.Trim(argument.(string), " \t\n\r\f\v")
+	case "startsWith":
+		arguments := argument.(tupleValue)
+		return strings.HasPrefix(arguments[0].(string), arguments[1].(string))
+	case "endsWith":
+		arguments := argument.(tupleValue)
+		return strings.HasSuffix(arguments[0].(string), arguments[1].(string))
+	case "upperCase":
+		return mapBytes(argument.(string), func(b byte) byte {
+			if 'a' <= b && b <= 'z' {
+				return b - 'a' + 'A'
+			}
+			return b
+		})
+	case "lowerCase":
+		return mapBytes(argument.(string), func(b byte) byte {
+			if 'A' <= b && b <= 'Z' {
+				return b - 'A' + 'a'
+			}
+			return b
+		})
+	case "repeat":
+		arguments := argument.(tupleValue)
+		count := arguments[1].(int32)
+		if count < 0 {
+			g.panic(at, "repeat: count (%d) < 0", count)
+		}
+		return strings.Repeat(arguments[0].(string), int(count))
+	case "charToCode":
+		c := argument.(string)
+		if len(c) != 1 {
+			g.panic(at, "charToCode: expected a single character, found '%s'", c)
+		}
+		return int32(c[0])
+	case "codeToChar":
+		code := argument.(int32)
+		if code < 0 || code > 255 {
+			g.panic(at, "codeToChar: code (%d) is not in [0, 256)", code)
+		}
+		return string([]byte{byte(code)})
+	case "stringToInt":
+		text := argument.(string)
+		value, err := strconv.ParseInt(text, 10, 32)
+		// std::from_chars does not accept a leading '+'
+		if err != nil || strings.HasPrefix(text, "+") {
+			return tupleValue{}
+		}
+		return int32(value)
+	case "stringToFloat":
+		text := argument.(string)
+		value, err := strconv.ParseFloat(text, 32)
+		if err != nil || strings.ContainsAny(text, "_") {
+			return tupleValue{}
+		}
+		return float32(value)
+	case "formatInt":
+		return strconv.Itoa(int(argument.(int32)))
+	case "formatFloat":
+		return formatFloat(argument.(float32))
+	// numbers
+	case "toFloat":
+		return float32(argument.(int32))
+	case "toInt":
+		return checkedToInt(math.Trunc(float64(argument.(float32))))
+	case "roundToInt":
+		return checkedToInt(math.Round(float64(argument.(float32))))
+	case "atan2":
+		arguments := argument.(tupleValue)
+		return float32(math.Atan2(float64(arguments[0].(float32)), float64(arguments[1].(float32))))
+	case "isNaN":
+		return math.IsNaN(float64(argument.(float32)))
+	case "abs":
+		switch value := argument.(type) {
+		case int32:
+			if value == math.MinInt32 {
+				g.panic(at, "abs: integer overflow for %d", value)
+			}
+			if value < 0 {
+				return -value
+			}
+			return value
+		case float32:
+			return float32(math.Abs(float64(value)))
+		}
+	case "min":
+		arguments := argument.(tupleValue)
+		if compareValues(arguments[1], arguments[0]) < 0 {
+			return arguments[1]
+		}
+		return arguments[0]
+	case "max":
+		arguments := argument.(tupleValue)
+		if compareValues(arguments[0], arguments[1]) < 0 {
+			return arguments[1]
+		}
+		return arguments[0]
+	case "pow":
+		arguments := argument.(tupleValue)
+		if base, isInt := arguments[0].(int32); isInt {
+			exponent := arguments[1].(int32)
+			if exponent < 0 {
+				g.panic(at, "pow: negative exponent (%d) for int base", exponent)
+			}
+			// squaring the base only overflows if the result does too, like in pb.hpp
+			result, power := int64(1), int64(base)
+			for remaining := exponent; remaining > 0; remaining /= 2 {
+				if remaining%2 == 1 {
+					result *= power
+				}
+				if remaining > 1 {
+					power *= power
+				}
+				if result != int64(int32(result)) || power != int64(int32(power)) {
+					g.panic(at, "pow: integer overflow for %d ^ %d", base, exponent)
+				}
+			}
+			return int32(result)
+		}
+		return float32(math.Pow(float64(arguments[0].(float32)), float64(arguments[1].(float32))))
+	// I/O
+	case "errorMessage":
+		return argument.(structValue).field("message")
+	case "readLine":
+		line, err := goEvaluatorStdin.ReadString('\n')
+		if err != nil && line == "" {
+			return tupleValue{}
+		}
+		return strings.TrimSuffix(line, "\n")
+	case "readFile":
+		path := argument.(string)
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return newError(fmt.Sprintf("readFile: cannot open '%s'", path))
+		}
+		return string(contents)
+	case "writeFile":
+		arguments := argument.(tupleValue)
+		path := arguments[0].(string)
+		if err := os.WriteFile(path, []byte(arguments[1].(string)), 0o644); err != nil {
+			return newError(fmt.Sprintf("writeFile: cannot write '%s'", path))
+		}
+		return tupleValue{}
+	case "getEnv":
+		if value, ok := os.LookupEnv(argument.(string)); ok {
+			return value
+		}
+		return tupleValue{}
+	}
+	evaluationError(at, "'%s' cannot be evaluated by the Go evaluator, use `-evaluator clang-repl` instead.", name)
+	return nil
+}
@@ -0,0 +1,592 @@
+package ast
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"yune/cpp"
+	"yune/util"
+
+	fj "github.com/valyala/fastjson"
+)
+
+// Evaluates by walking the analyzed AST, which does not require clang-repl and avoids compiling C++.
+// Raw C++ cannot be evaluated, but may still be used by code that only runs in the executable.
+// Values are encoded in the same JSON format as the CppEvaluator, see go_value.go.
+type GoEvaluator struct {
+	state        *State
+	declarations map[string]TopLevelDeclaration
+	// Decoded values of global variables, which are stored as JSON in the declaration.
+	// Assignments replace the value for the rest of the session, like globals in clang-repl.
+	constants map[TopLevelDeclaration]any
+	declared  strings.Builder
+	timeout   time.Duration
+	// When the current evaluation times out, or the zero time if it has no time limit.
+	deadline time.Time
+	// The number of function calls being evaluated, which is limited to stop infinite recursion
+	// before it exhausts the stack.
+	depth int
+	// The functions being evaluated, like `callStack_` in pb.hpp.
+	callStack []string
+	// Copies of the declarations, constants and declared C++ that Rollback returns to.
+	checkpoint goCheckpoint
+}
+
+type goCheckpoint struct {
+	declarations map[string]TopLevelDeclaration
+	constants    map[TopLevelDeclaration]any
+	declared     string
+}
+
+// The maximum number of nested function calls during an evaluation.
+const maxCallDepth = 10000
+
+func NewGoEvaluator(options cpp.BuildOptions, state *State) *GoEvaluator {
+	g := &GoEvaluator{
+		timeout:      options.EffectiveEvaluationTimeout(),
+		state:        state,
+		declarations: map[string]TopLevelDeclaration{},
+		constants:    map[TopLevelDeclaration]any{},
+	}
+	// builtins are always available, like the ones in pb.hpp
+	for _, decl := range BuiltinDeclarations {
+		g.declarations[decl.Name] = &decl
+	}
+	g.declared.WriteString(`#include "pb.hpp"` + "\n")
+	return g
+}
+
+// Variables in a scope, which may shadow the variables in the parent scope.
+type goEnvironment struct {
+	parent    *goEnvironment
+	variables map[string]any
+}
+
+func newGoEnvironment(parent *goEnvironment) *goEnvironment {
+	return &goEnvironment{parent: parent, variables: map[string]any{}}
+}
+
+func (e *goEnvironment) lookup(name string) (any, bool) {
+	for ; e != nil; e = e.parent {
+		if value, ok := e.variables[name]; ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// Sets a variable in the scope that defines it.
+func (e *goEnvironment) assign(name string, value any) bool {
+	for ; e != nil; e = e.parent {
+		if _, ok := e.variables[name]; ok {
+			e.variables[name] = value
+			return true
+		}
+	}
+	return false
+}
+
+// Stops the evaluation with an error, which is returned by Evaluate.
+func evaluationError(at Span, format string, args ...any) {
+	panic(EvaluationError{Message: fmt.Sprintf(format, args...), At: at})
+}
+
+// Stops the evaluation with a panic, which is reported like a panic in clang-repl.
+// `at` is the location of the call that panicked, which is empty for builtins that do not report it.
+func (g *GoEvaluator) panic(at Span, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	if at.File != "" {
+		message = fmt.Sprintf("%s:%d:%d: %s", at.File, at.Line, at.Column, message)
+	}
+	callStack := slices.Clone(g.callStack)
+	slices.Reverse(callStack)
+	panic(cpp.EvaluationPanic{Message: message, CallStack: callStack})
+}
+
+// Write implements Evaluator.
+// Raw C++ is ignored, since it is only used by raw C++ expressions, which this evaluator reports as errors.
+func (g *GoEvaluator) Write(text string) error {
+	return nil
+}
+
+// Declare implements Evaluator.
+func (g *GoEvaluator) Declare(decl TopLevelDeclaration) error {
+	g.declarations[decl.GetName().String] = decl
+	g.declared.WriteString(decl.LowerDeclaration(g.state) + "\n")
+	return nil
+}
+
+// Define implements Evaluator.
+func (g *GoEvaluator) Define(decl TopLevelDeclaration) error {
+	g.declarations[decl.GetName().String] = decl
+	g.declared.WriteString(decl.LowerDefinition(g.state) + "\n")
+	return nil
+}
+
+// Evaluate implements Evaluator.
+func (g *GoEvaluator) Evaluate(evaluation Evaluation, getType func(name string) (TypeValue, bool)) (json *fj.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+			case EvaluationError:
+				err = r
+			case cpp.EvaluationPanic:
+				err = r
+			default:
+				panic(r)
+			}
+		}
+	}()
+	g.deadline, g.depth, g.callStack = time.Time{}, 0, nil
+	if g.timeout > 0 {
+		g.deadline = time.Now().Add(g.timeout)
+	}
+	var value any
+	switch evaluation := evaluation.(type) {
+	case ConstantEvaluation:
+		value = g.evaluateBlock(evaluation.Body, newGoEnvironment(nil))
+	case TypeEvaluation:
+		value = g.evaluate(evaluation.Expression, newGoEnvironment(nil))
+	case MacroEvaluation:
+		macro := evaluation.Macro
+		getTypeFunction := hostFunction{
+			Name: "getType",
+			Type: MacroFunctionType.Argument.(*TupleType).Elements[1].(*FnType),
+			Call: func(argument any) any {
+				if _type, ok := getType(argument.(string)); ok {
+					return _type
+				}
+				return tupleValue{}
+			},
+		}
+		function := g.evaluate(&macro.Function, newGoEnvironment(nil))
+		value = g.call(function, tupleValue{macro.GetText(), getTypeFunction}, macro.Span)
+	default:
+		panic(fmt.Sprintf("unexpected ast.Evaluation: %#v", evaluation))
+	}
+	text := g.toJson(value)
+	log.Printf("Go evaluator evaluated to '%s'\n", text)
+	return fj.Parse(text)
+}
+
+// EvaluateBatch implements Evaluator.
+func (g *GoEvaluator) EvaluateBatch(evaluations []Evaluation) (values []*fj.Value, errs []error) {
+	for _, evaluation := range evaluations {
+		value, err := g.Evaluate(evaluation, nil)
+		values = append(values, value)
+		errs = append(errs, err)
+	}
+	return
+}
+
+// WaitForFinish implements Evaluator.
+func (g *GoEvaluator) WaitForFinish() error {
+	return nil
+}
+
+// Declared implements Evaluator.
+func (g *GoEvaluator) Declared() cpp.Module {
+	return g.declared.String()
+}
+
+// Checkpoint implements Evaluator.
+func (g *GoEvaluator) Checkpoint() {
+	g.checkpoint = goCheckpoint{
+		declarations: maps.Clone(g.declarations),
+		constants:    maps.Clone(g.constants),
+		declared:     g.declared.String(),
+	}
+}
+
+// Rollback implements Evaluator.
+func (g *GoEvaluator) Rollback() error {
+	g.declarations = maps.Clone(g.checkpoint.declarations)
+	g.constants = maps.Clone(g.checkpoint.constants)
+	g.declared.Reset()
+	g.declared.WriteString(g.checkpoint.declared)
+	return nil
+}
+
+// Close implements Evaluator.
+func (g *GoEvaluator) Close() {}
+
+// The value of a top-level declaration or builtin.
+func (g *GoEvaluator) global(name string, at Span) any {
+	switch decl := g.declarations[name].(type) {
+	case *FunctionDeclaration:
+		return functionValue{Declaration: decl}
+	case *ConstantDeclaration:
+		if value, ok := g.constants[decl]; ok {
+			return value
+		}
+		if decl.value == nil {
+			evaluationError(at, "'%s' is used before its value has been computed.", name)
+		}
+		value := g.fromJson(decl.value)
+		g.constants[decl] = value
+		return value
+	case *InterfaceDeclaration:
+		// module interfaces only contain the lowered C++ of functions, which cannot be interpreted
+		if decl.IsFunction {
+			evaluationError(at, "'%s' is loaded from a module interface, which the go evaluator cannot call.", name)
+		}
+		if value, ok := g.constants[decl]; ok {
+			return value
+		}
+		value := g.fromJson(decl.value)
+		g.constants[decl] = value
+		return value
+	case *BuiltinDeclaration:
+		return builtinGlobal(name)
+	case nil:
+		evaluationError(at, "'%s' is not declared.", name)
+	default:
+		panic(fmt.Sprintf("unexpected ast.TopLevelDeclaration: %#v", decl))
+	}
+	return nil
+}
+
+// The value of a builtin, which is used even if a top-level declaration shadows it.
+func builtinGlobal(name string) any {
+	if _type, isType := builtinTypes[name]; isType {
+		return _type
+	}
+	return builtinValue{Name: name}
+}
+
+func (g *GoEvaluator) evaluateBlock(block Block, env *goEnvironment) (result any) {
+	for _, statement := range block.Statements {
+		result = g.evaluateStatement(statement, env)
+	}
+	return
+}
+
+// Applies the operator of an assignment such as `+=`.
+func (g *GoEvaluator) applyAssignment(op AssignmentOp, current any, value any, at Span) any {
+	switch op {
+	case Assign:
+		return value
+	case AddAssign:
+		return g.binaryOperation(Add, current, value, at)
+	case SubtractAssign:
+		return g.binaryOperation(Subtract, current, value, at)
+	case MultiplyAssign:
+		return g.binaryOperation(Multiply, current, value, at)
+	case DivideAssign:
+		return g.binaryOperation(Divide, current, value, at)
+	default:
+		panic(fmt.Sprintf("unexpected ast.AssignmentOp: %#v", op))
+	}
+}
+
+func (g *GoEvaluator) evaluateStatement(statement Statement, env *goEnvironment) any {
+	switch s := statement.(type) {
+	case *VariableDeclaration:
+		env.variables[s.Name.String] = g.evaluateBlock(s.Body, newGoEnvironment(env))
+		return tupleValue{}
+	case *Assignment:
+		value := g.evaluateBlock(s.Body, newGoEnvironment(env))
+		current := g.lookupTarget(s.Target.Name, env)
+		g.assignTarget(s.Target.Name, g.applyAssignment(s.Op, current, value, s.GetSpan()), env)
+		return tupleValue{}
+	case *IndexAssignment:
+		list := slicesClone(g.lookupTarget(s.Target.Name, env).(listValue))
+		index := g.evaluate(s.Index, env).(int32)
+		g.checkIndex(index, len(list), s.Span)
+		value := g.evaluateBlock(s.Body, newGoEnvironment(env))
+		list[index] = g.applyAssignment(s.Op, list[index], value, s.Span)
+		g.assignTarget(s.Target.Name, list, env)
+		return tupleValue{}
+	case *BranchStatement:
+		if g.evaluate(s.Condition, env).(bool) {
+			return g.evaluateBlock(s.Then, newGoEnvironment(env))
+		}
+		return g.evaluateBlock(s.Else, newGoEnvironment(env))
+	case *IsBranchStatement:
+		value := g.evaluate(s.Expression, env)
+		variant := g.variantOf(value, s.expressionType)
+		var matches bool
+		if union, isUnion := s.Type.Get().(*UnionType); isUnion {
+			matches = variant != nil && union.HasVariant(variant)
+		} else {
+			matches = variant != nil && variant.Eq(s.Type.Get())
+		}
+		if matches {
+			thenEnv := newGoEnvironment(env)
+			thenEnv.variables[s.Name.String] = value
+			return g.evaluateBlock(s.Then, thenEnv)
+		}
+		return g.evaluateBlock(s.Else, newGoEnvironment(env))
+	case *ExpressionStatement:
+		return g.evaluate(s.Expression, env)
+	default:
+		panic(fmt.Sprintf("unexpected ast.Statement: %#v", statement))
+	}
+}
+
+// The current value of the variable that is assigned to, which is either local or global.
+func (g *GoEvaluator) lookupTarget(target Name, env *goEnvironment) any {
+	if value, ok := env.lookup(target.String); ok {
+		return value
+	}
+	return g.global(target.String, target.Span)
+}
+
+// Sets the variable that is assigned to.
+// Global variables keep their new value in later evaluations, until the session is rolled back.
+func (g *GoEvaluator) assignTarget(target Name, value any, env *goEnvironment) {
+	if env.assign(target.String, value) {
+		return
+	}
+	decl := g.declarations[target.String]
+	switch decl := decl.(type) {
+	case *ConstantDeclaration:
+	case *InterfaceDeclaration:
+		if decl.IsFunction {
+			evaluationError(target.Span, "Cannot assign to function '%s'.", target.String)
+		}
+	default:
+		evaluationError(target.Span, "Cannot assign to '%s', which is not a variable.", target.String)
+	}
+	g.constants[decl] = value
+}
+
+func slicesClone(list listValue) listValue {
+	return append(listValue{}, list...)
+}
+
+func (g *GoEvaluator) checkIndex(index int32, length int, at Span) {
+	if index < 0 || int(index) >= length {
+		g.panic(at, "index %d out of bounds for length %d", index, length)
+	}
+}
+
+func (g *GoEvaluator) evaluate(expression Expression, env *goEnvironment) any {
+	switch e := expression.(type) {
+	case *Integer:
+		return int32(e.Value)
+	case *Float:
+		return float32(e.Value)
+	case *Bool:
+		return e.Value
+	case *String:
+		return e.Value
+	case *Variable:
+		if value, ok := env.lookup(e.Name.String); ok {
+			return value
+		}
+		if e.builtin {
+			return builtinGlobal(e.Name.String)
+		}
+		return g.global(e.Name.String, e.Name.Span)
+	case *FunctionCall:
+		return g.evaluateFunctionCall(e, env)
+	case *List:
+		return listValue(util.Map(e.Elements, func(element Expression) any {
+			return g.evaluate(element, env)
+		}))
+	case *Tuple:
+		if e.isType {
+			return &TupleType{Elements: util.Map(e.Elements, func(element Expression) TypeValue {
+				return g.evaluate(element, env).(TypeValue)
+			})}
+		}
+		return tupleValue(util.Map(e.Elements, func(element Expression) any {
+			return g.evaluate(element, env)
+		}))
+	case *Macro:
+		return g.evaluate(e.Result, env)
+	case *UnaryExpression:
+		value := g.evaluate(e.Expression, env)
+		switch e.Op {
+		case "-":
+			switch value := value.(type) {
+			case int32:
+				return -value
+			case float32:
+				return -value
+			}
+		case ";":
+			return !value.(bool)
+		}
+		panic(fmt.Sprintf("unexpected unary expression: %s", e))
+	case *BinaryExpression:
+		left := g.evaluate(e.Left, env)
+		// `and` and `or` short-circuit, like in C++
+		switch e.Op {
+		case And:
+			return left.(bool) && g.evaluate(e.Right, env).(bool)
+		case Or:
+			return left.(bool) || g.evaluate(e.Right, env).(bool)
+		}
+		return g.binaryOperation(e.Op, left, g.evaluate(e.Right, env), e.Span)
+	case *IndexExpression:
+		value := g.evaluate(e.Expression, env)
+		index := g.evaluate(e.Index, env).(int32)
+		if s, isString := value.(string); isString {
+			g.checkIndex(index, len(s), e.Span)
+			return s[index : index+1]
+		}
+		list := value.(listValue)
+		g.checkIndex(index, len(list), e.Span)
+		return list[index]
+	case *SliceExpression:
+		value := g.evaluate(e.Expression, env)
+		low := g.evaluate(e.Low, env).(int32)
+		high := g.evaluate(e.High, env).(int32)
+		length := 0
+		if s, isString := value.(string); isString {
+			length = len(s)
+		} else {
+			length = len(value.(listValue))
+		}
+		if low < 0 || int(high) > length || high < low {
+			g.panic(e.Span, "slice [%d:%d] out of bounds for length %d", low, high, length)
+		}
+		if s, isString := value.(string); isString {
+			return s[low:high]
+		}
+		return slicesClone(value.(listValue)[low:high])
+	case *Closure:
+		captures := map[string]any{}
+		for name := range e.captures {
+			if value, ok := env.lookup(name); ok {
+				captures[name] = value
+			}
+		}
+		return closureValue{Closure: e, Captures: captures}
+	case *ValueExpression:
+		return g.fromJson(e.value)
+	case *RawString:
+		evaluationError(e.Span, "Raw C++ cannot be evaluated by the Go evaluator, use `-evaluator clang-repl` instead.")
+	default:
+		evaluationError(expression.GetSpan(), "%T cannot be evaluated by the Go evaluator.", expression)
+	}
+	return nil
+}
+
+func (g *GoEvaluator) binaryOperation(op BinaryOp, left any, right any, at Span) any {
+	switch op {
+	case Equal:
+		return valuesEqual(left, right)
+	case NotEqual:
+		return !valuesEqual(left, right)
+	}
+	switch left := left.(type) {
+	case int32:
+		right := right.(int32)
+		switch op {
+		case Add:
+			return left + right
+		case Subtract:
+			return left - right
+		case Multiply:
+			return left * right
+		case Divide:
+			if right == 0 {
+				g.panic(at, "integer division by zero")
+			}
+			return left / right
+		}
+		return compareNumbers(op, left, right)
+	case float32:
+		right := right.(float32)
+		switch op {
+		case Add:
+			return left + right
+		case Subtract:
+			return left - right
+		case Multiply:
+			return left * right
+		case Divide:
+			return left / right
+		}
+		return compareNumbers(op, left, right)
+	case string:
+		if op == Add {
+			return left + right.(string)
+		}
+	}
+	panic(fmt.Sprintf("unexpected binary operation: %T %s %T", left, op, right))
+}
+
+func compareNumbers[T int32 | float32](op BinaryOp, left T, right T) bool {
+	switch op {
+	case Less:
+		return left < right
+	case Greater:
+		return left > right
+	case LessEqual:
+		return left <= right
+	case GreaterEqual:
+		return left >= right
+	default:
+		panic(fmt.Sprintf("unexpected ast.BinaryOp: %#v", op))
+	}
+}
+
+func (g *GoEvaluator) evaluateFunctionCall(f *FunctionCall, env *goEnvironment) any {
+	// match builtin functions that need to be handled differently, like FunctionCall.Lower
+	switch f.builtin {
+	case "getTupleElement_":
+		tupleArgument := f.Argument.(*Tuple)
+		tuple := g.evaluate(tupleArgument.Elements[0], env).(tupleValue)
+		return tuple[tupleArgument.Elements[1].(*Integer).Value]
+	case "dbg":
+		value := g.evaluate(f.Argument, env)
+		fmt.Fprintf(os.Stderr, "[%s:%d:%d] %s: %s\n", f.Span.File, f.Span.Line, f.Span.Column, g.show(value), f.builtinData.(TypeValue))
+		return value
+	}
+	function := g.evaluate(f.Function, env)
+	return g.call(function, g.evaluate(f.Argument, env), f.Span)
+}
+
+// Binds the parameters of a function, which are passed as a tuple if there are multiple.
+func bindParameters(env *goEnvironment, parameters []FunctionParameter, argument any) {
+	if len(parameters) == 1 {
+		env.variables[parameters[0].Name.String] = argument
+		return
+	}
+	for i, parameter := range parameters {
+		env.variables[parameter.Name.String] = argument.(tupleValue)[i]
+	}
+}
+
+// Calls a function value. `at` is the location of the call, which panics are reported at.
+func (g *GoEvaluator) call(function any, argument any, at Span) any {
+	if !g.deadline.IsZero() && time.Now().After(g.deadline) {
+		evaluationError(at, "Evaluation exceeded the time limit of %s (see -eval-timeout).", g.timeout)
+	}
+	if g.depth >= maxCallDepth {
+		evaluationError(at, "Evaluation exceeded the maximum call depth of %d, which may be caused by infinite recursion.", maxCallDepth)
+	}
+	g.depth++
+	defer func() { g.depth-- }()
+	switch function := function.(type) {
+	case functionValue:
+		name := function.Declaration.Name
+		g.callStack = append(g.callStack, fmt.Sprintf("%s (%s:%d:%d)", name.String, name.File, name.Line, name.Column))
+		defer func() { g.callStack = g.callStack[:len(g.callStack)-1] }()
+		env := newGoEnvironment(nil)
+		bindParameters(env, function.Declaration.Parameters, argument)
+		return g.evaluateBlock(function.Declaration.Body, env)
+	case closureValue:
+		env := newGoEnvironment(nil)
+		for name, value := range function.Captures {
+			env.variables[name] = value
+		}
+		env = newGoEnvironment(env)
+		bindParameters(env, function.Closure.Parameters, argument)
+		return g.evaluateBlock(function.Closure.Body, env)
+	case builtinValue:
+		return g.callBuiltin(function.Name, argument, at)
+	case hostFunction:
+		return function.Call(argument)
+	default:
+		panic(fmt.Sprintf("unexpected function value: %#v", function))
+	}
+}
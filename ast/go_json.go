@@ -0,0 +1,447 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"yune/util"
+)
+
+// The JSON encoding of the `toJson` and `fromJson` builtins, which mirrors `encodeJson_`, `JsonParser_`
+// and `decodeJson_` in pb.hpp, including their error messages.
+// This is unrelated to the encoding of compile-time values, see `GoEvaluator.toJson`.
+
+type jsonKind int
+
+const (
+	jsonNull jsonKind = iota
+	jsonBool
+	jsonNumber
+	jsonString
+	jsonArray
+	jsonObject
+)
+
+var jsonKindNames = []string{"null", "boolean", "number", "string", "array", "object"}
+
+// A parsed JSON value, like `JsonValue_`.
+type jsonValue struct {
+	kind    jsonKind
+	boolean bool
+	// The literal of a number or the contents of a string.
+	text     string
+	elements []jsonValue
+	fields   []jsonField
+}
+
+type jsonField struct {
+	name  string
+	value jsonValue
+}
+
+// Returns the first field with the given name, or nil if it does not exist.
+func (v *jsonValue) field(name string) *jsonValue {
+	for i := range v.fields {
+		if v.fields[i].name == name {
+			return &v.fields[i].value
+		}
+	}
+	return nil
+}
+
+// A recursive descent parser for JSON text, like `JsonParser_`.
+// Parse functions panic with a jsonSyntaxError, which parseJson recovers.
+type jsonParser struct {
+	text   string
+	offset int
+}
+
+type jsonSyntaxError string
+
+// Parses the whole text, returning the message of a syntax error.
+func parseJson(text string) (value jsonValue, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			message, ok := r.(jsonSyntaxError)
+			if !ok {
+				panic(r)
+			}
+			err = errors.New(string(message))
+		}
+	}()
+	p := jsonParser{text: text}
+	value = p.parseValue()
+	p.skipWhitespace()
+	if p.offset != len(p.text) {
+		p.fail("unexpected trailing characters")
+	}
+	return
+}
+
+func (p *jsonParser) fail(message string) {
+	panic(jsonSyntaxError(fmt.Sprintf("%s at offset %d", message, p.offset)))
+}
+
+func (p *jsonParser) skipWhitespace() {
+	// the characters of std::isspace
+	for p.offset < len(p.text) && strings.IndexByte(" \t\n\v\f\r", p.text[p.offset]) >= 0 {
+		p.offset++
+	}
+}
+
+func (p *jsonParser) consume(c byte) bool {
+	p.skipWhitespace()
+	if p.offset < len(p.text) && p.text[p.offset] == c {
+		p.offset++
+		return true
+	}
+	return false
+}
+
+func (p *jsonParser) consumeWord(word string) bool {
+	if strings.HasPrefix(p.text[p.offset:], word) {
+		p.offset += len(word)
+		return true
+	}
+	return false
+}
+
+// Skips the next character if it is one of `chars`, without whitespace.
+func (p *jsonParser) accept(chars string) bool {
+	if p.offset < len(p.text) && strings.IndexByte(chars, p.text[p.offset]) >= 0 {
+		p.offset++
+		return true
+	}
+	return false
+}
+
+// Skips a non-empty sequence of digits, returning false if there is none.
+func (p *jsonParser) skipDigits() bool {
+	start := p.offset
+	for p.accept("0123456789") {
+	}
+	return p.offset > start
+}
+
+func (p *jsonParser) parseValue() jsonValue {
+	p.skipWhitespace()
+	if p.offset >= len(p.text) {
+		p.fail("unexpected end of input")
+	}
+	switch c := p.text[p.offset]; {
+	case c == '{':
+		return p.parseObject()
+	case c == '[':
+		return p.parseArray()
+	case c == '"':
+		return jsonValue{kind: jsonString, text: p.parseString()}
+	case c == '-' || c >= '0' && c <= '9':
+		return p.parseNumber()
+	case p.consumeWord("true") || p.consumeWord("false"):
+		return jsonValue{kind: jsonBool, boolean: c == 't'}
+	case p.consumeWord("null"):
+		return jsonValue{kind: jsonNull}
+	}
+	p.fail("unexpected character")
+	return jsonValue{}
+}
+
+func (p *jsonParser) parseObject() jsonValue {
+	value := jsonValue{kind: jsonObject}
+	p.offset++ // {
+	if p.consume('}') {
+		return value
+	}
+	for {
+		p.skipWhitespace()
+		if p.offset >= len(p.text) || p.text[p.offset] != '"' {
+			p.fail("expected field name")
+		}
+		name := p.parseString()
+		if !p.consume(':') {
+			p.fail("expected ':'")
+		}
+		value.fields = append(value.fields, jsonField{name, p.parseValue()})
+		if !p.consume(',') {
+			break
+		}
+	}
+	if !p.consume('}') {
+		p.fail("expected ',' or '}'")
+	}
+	return value
+}
+
+func (p *jsonParser) parseArray() jsonValue {
+	value := jsonValue{kind: jsonArray, elements: []jsonValue{}}
+	p.offset++ // [
+	if p.consume(']') {
+		return value
+	}
+	for {
+		value.elements = append(value.elements, p.parseValue())
+		if !p.consume(',') {
+			break
+		}
+	}
+	if !p.consume(']') {
+		p.fail("expected ',' or ']'")
+	}
+	return value
+}
+
+// Parses `-? (0 | [1-9][0-9]*) (. [0-9]+)? ([eE] [+-]? [0-9]+)?`.
+func (p *jsonParser) parseNumber() jsonValue {
+	start := p.offset
+	p.accept("-")
+	if p.accept("123456789") {
+		p.skipDigits()
+	} else if !p.accept("0") {
+		p.fail("invalid number")
+	}
+	if p.accept(".") && !p.skipDigits() {
+		p.fail("expected digits after '.'")
+	}
+	if p.accept("eE") {
+		p.accept("+-")
+		if !p.skipDigits() {
+			p.fail("expected digits in exponent")
+		}
+	}
+	return jsonValue{kind: jsonNumber, text: p.text[start:p.offset]}
+}
+
+func (p *jsonParser) parseHex4() uint32 {
+	if p.offset+4 > len(p.text) {
+		p.fail("incomplete unicode escape")
+	}
+	codePoint, err := strconv.ParseUint(p.text[p.offset:p.offset+4], 16, 32)
+	if err != nil {
+		p.fail("invalid unicode escape")
+	}
+	p.offset += 4
+	return uint32(codePoint)
+}
+
+func (p *jsonParser) parseString() string {
+	var s strings.Builder
+	p.offset++ // "
+	for p.offset < len(p.text) {
+		c := p.text[p.offset]
+		p.offset++
+		if c == '"' {
+			return s.String()
+		}
+		if c != '\\' {
+			s.WriteByte(c)
+			continue
+		}
+		if p.offset >= len(p.text) {
+			break
+		}
+		escaped := p.text[p.offset]
+		p.offset++
+		switch escaped {
+		case '"', '\\', '/':
+			s.WriteByte(escaped)
+		case 'b':
+			s.WriteByte('\b')
+		case 'f':
+			s.WriteByte('\f')
+		case 'n':
+			s.WriteByte('\n')
+		case 'r':
+			s.WriteByte('\r')
+		case 't':
+			s.WriteByte('\t')
+		case 'u':
+			codePoint := p.parseHex4()
+			// combine UTF-16 surrogate pairs
+			if codePoint >= 0xD800 && codePoint < 0xDC00 && p.consumeWord(`\u`) {
+				low := p.parseHex4()
+				codePoint = 0x10000 + (codePoint-0xD800)<<10 + (low - 0xDC00)
+			}
+			appendUtf8(&s, codePoint)
+		default:
+			p.fail("invalid escape sequence")
+		}
+	}
+	p.fail("unterminated string")
+	return ""
+}
+
+// Appends a code point as UTF-8, without rejecting invalid code points like `appendUtf8` in pb.hpp.
+func appendUtf8(s *strings.Builder, codePoint uint32) {
+	switch {
+	case codePoint < 0x80:
+		s.WriteByte(byte(codePoint))
+	case codePoint < 0x800:
+		s.Write([]byte{byte(0xC0 | codePoint>>6), byte(0x80 | codePoint&0x3F)})
+	case codePoint < 0x10000:
+		s.Write([]byte{byte(0xE0 | codePoint>>12), byte(0x80 | (codePoint>>6)&0x3F), byte(0x80 | codePoint&0x3F)})
+	default:
+		s.Write([]byte{byte(0xF0 | codePoint>>18), byte(0x80 | (codePoint>>12)&0x3F), byte(0x80 | (codePoint>>6)&0x3F), byte(0x80 | codePoint&0x3F)})
+	}
+}
+
+// Encodes a value like `encodeJson_`.
+func encodeJson(value any) string {
+	switch value := value.(type) {
+	case int32:
+		return strconv.Itoa(int(value))
+	case bool:
+		return strconv.FormatBool(value)
+	case float32:
+		switch {
+		case math.IsNaN(float64(value)):
+			return `"NaN"`
+		case math.IsInf(float64(value), 1):
+			return `"Infinity"`
+		case math.IsInf(float64(value), -1):
+			return `"-Infinity"`
+		}
+		return formatFloatLiteral(value)
+	case string:
+		return stringToJson(value)
+	case structValue:
+		// Error is the only struct with a JSON encoding
+		return fmt.Sprintf(`{"message":%s}`, stringToJson(value.field("message").(string)))
+	case listValue:
+		return "[" + util.JoinFunc(value, ",", encodeJson) + "]"
+	case tupleValue:
+		return "[" + util.JoinFunc(value, ",", encodeJson) + "]"
+	case mapValue:
+		entries := []string{}
+		for _, entry := range value {
+			entries = append(entries, fmt.Sprintf("[%s,%s]", encodeJson(entry.key), encodeJson(entry.value)))
+		}
+		return "[" + strings.Join(entries, ",") + "]"
+	default:
+		panic(fmt.Sprintf("unexpected value in toJson: %#v", value))
+	}
+}
+
+func jsonKindError(expected string, json jsonValue) string {
+	return fmt.Sprintf("expected %s, found %s", expected, jsonKindNames[json.kind])
+}
+
+func isJsonInteger(json jsonValue) bool {
+	return json.kind == jsonNumber && !strings.ContainsAny(json.text, ".eE")
+}
+
+// Decodes a value of the given type like `decodeJson_`, returning an error message that is empty on success.
+func decodeJson(json jsonValue, t TypeValue) (any, string) {
+	switch t := t.(type) {
+	case *IntType:
+		if !isJsonInteger(json) {
+			return nil, jsonKindError("integer", json)
+		}
+		i, err := strconv.ParseInt(json.text, 10, 32)
+		if err != nil {
+			return nil, fmt.Sprintf("integer %s is out of range", json.text)
+		}
+		return int32(i), ""
+	case *FloatType:
+		if json.kind == jsonString {
+			switch json.text {
+			case "NaN":
+				return float32(math.NaN()), ""
+			case "Infinity":
+				return float32(math.Inf(1)), ""
+			case "-Infinity":
+				return float32(math.Inf(-1)), ""
+			}
+			return nil, jsonKindError("number", json)
+		}
+		if json.kind != jsonNumber {
+			return nil, jsonKindError("number", json)
+		}
+		// like strtof, numbers that are out of range become infinite
+		f, err := strconv.ParseFloat(json.text, 32)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return nil, fmt.Sprintf("invalid number %s", json.text)
+		}
+		return float32(f), ""
+	case *BoolType:
+		if json.kind != jsonBool {
+			return nil, jsonKindError("boolean", json)
+		}
+		return json.boolean, ""
+	case *StringType:
+		if json.kind != jsonString {
+			return nil, jsonKindError("string", json)
+		}
+		return json.text, ""
+	case *StructType:
+		// Error is the only struct with a JSON encoding
+		if json.kind != jsonObject {
+			return nil, jsonKindError("object", json)
+		}
+		message := json.field("message")
+		if message == nil {
+			return nil, "missing field 'message'"
+		}
+		text, err := decodeJson(*message, &StringType{})
+		if err != "" {
+			return nil, err
+		}
+		return newError(text.(string)), ""
+	case *ListType:
+		if json.kind != jsonArray {
+			return nil, jsonKindError("array", json)
+		}
+		list := listValue{}
+		for i, element := range json.elements {
+			value, err := decodeJson(element, t.Element)
+			if err != "" {
+				return nil, fmt.Sprintf("[%d]: %s", i, err)
+			}
+			list = append(list, value)
+		}
+		return list, ""
+	case *TupleType:
+		if json.kind != jsonArray {
+			return nil, jsonKindError("array", json)
+		}
+		if len(json.elements) != len(t.Elements) {
+			return nil, fmt.Sprintf("expected array of length %d, found length %d", len(t.Elements), len(json.elements))
+		}
+		tuple := tupleValue{}
+		for i, element := range json.elements {
+			value, err := decodeJson(element, t.Elements[i])
+			if err != "" {
+				return nil, fmt.Sprintf("[%d]: %s", i, err)
+			}
+			tuple = append(tuple, value)
+		}
+		return tuple, ""
+	case *MapType:
+		entries, err := decodeJson(json, &ListType{Element: &TupleType{Elements: []TypeValue{t.Key, t.Value}}})
+		if err != "" {
+			return nil, err
+		}
+		m := mapValue{}
+		for _, entry := range entries.(listValue) {
+			m = m.insert(entry.(tupleValue)[0], entry.(tupleValue)[1])
+		}
+		return m, ""
+	case *UnionType:
+		if t.HasVariant(&IntType{}) && isJsonInteger(json) {
+			return decodeJson(json, &IntType{})
+		}
+		// tries the variants in order until one succeeds
+		errors := []string{}
+		for _, variant := range t.Variants {
+			value, err := decodeJson(json, variant)
+			if err == "" {
+				return value, ""
+			}
+			errors = append(errors, err)
+		}
+		return nil, fmt.Sprintf("no union variant matches (%s)", strings.Join(errors, "; "))
+	default:
+		panic(fmt.Sprintf("unexpected type in fromJson: %s", t))
+	}
+}
@@ -0,0 +1,573 @@
+package ast
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"yune/util"
+
+	fj "github.com/valyala/fastjson"
+)
+
+// Values of the GoEvaluator are represented as follows, mirroring their C++ representation in pb.hpp:
+//
+//	Int: int32, Float: float32, Bool: bool, String: string, Type: TypeValue,
+//	tuples: tupleValue, lists: listValue, maps: mapValue,
+//	Expression, Statement and Error: structValue,
+//	functions: functionValue, builtinValue, closureValue or hostFunction.
+//
+// Values are immutable, so operations that change a value return a copy.
+type tupleValue []any
+
+type listValue []any
+
+// Entries sorted by key, like std::map.
+type mapValue []mapEntry
+
+type mapEntry struct {
+	key   any
+	value any
+}
+
+// A value of an opaque struct type such as Expression, e.g. `{ "IntegerExpression": { "location": 0, "value": 1 } }`.
+type structValue struct {
+	// The name of the variant, e.g. "IntegerExpression".
+	Name   string
+	Fields []structField
+	Type   *StructType
+	// Whether the C++ value is stored in a Box_t, which is part of its JSON encoding.
+	Boxed bool
+}
+
+type structField struct {
+	Name  string
+	Value any
+}
+
+func (s structValue) field(name string) any {
+	for _, field := range s.Fields {
+		if field.Name == name {
+			return field.Value
+		}
+	}
+	panic(fmt.Sprintf("%s does not have field '%s'", s.Name, name))
+}
+
+// JSON that is inserted into the encoding as-is, such as the value of a ValueExpression.
+type rawJson string
+
+type functionValue struct {
+	Declaration *FunctionDeclaration
+}
+
+type builtinValue struct {
+	Name string
+}
+
+type closureValue struct {
+	Closure  *Closure
+	Captures map[string]any
+}
+
+// A function that is only available at compile time, such as the `getType` argument of macros.
+type hostFunction struct {
+	Name string
+	Type *FnType
+	Call func(argument any) any
+}
+
+// Variants of the Expression and Statement types, which are encoded in a Box (see pb.hpp).
+var boxedStructs = map[string]bool{
+	"FunctionCallExpression": true,
+	"ListExpression":         true,
+	"TupleExpression":        true,
+	"ClosureExpression":      true,
+	"MacroExpression":        true,
+	"UnaryExpression":        true,
+	"BinaryExpression":       true,
+	"VariableDeclaration":    true,
+	"AssignStatement":        true,
+	"BranchStatement":        true,
+	"IsBranchStatement":      true,
+}
+
+var statementStructs = []string{"VariableDeclaration", "AssignStatement", "BranchStatement", "IsBranchStatement", "ExpressionStatement"}
+
+func newStructValue(name string, fields ...structField) structValue {
+	structType := ExpressionType
+	if name == "Error" {
+		structType = ErrorType
+	} else if slices.Contains(statementStructs, name) {
+		structType = StatementType
+	}
+	return structValue{Name: name, Fields: fields, Type: structType, Boxed: boxedStructs[name]}
+}
+
+func newError(message string) structValue {
+	return newStructValue("Error", structField{"message", message})
+}
+
+// Compares values like `==` in C++.
+func valuesEqual(a any, b any) bool {
+	switch a := a.(type) {
+	case TypeValue:
+		b, ok := b.(TypeValue)
+		return ok && a.Eq(b)
+	case tupleValue:
+		b, ok := b.(tupleValue)
+		return ok && slices.EqualFunc(a, b, valuesEqual)
+	case listValue:
+		b, ok := b.(listValue)
+		return ok && slices.EqualFunc(a, b, valuesEqual)
+	case mapValue:
+		b, ok := b.(mapValue)
+		return ok && slices.EqualFunc(a, b, func(x, y mapEntry) bool {
+			return valuesEqual(x.key, y.key) && valuesEqual(x.value, y.value)
+		})
+	case structValue:
+		b, ok := b.(structValue)
+		return ok && a.Name == b.Name && slices.EqualFunc(a.Fields, b.Fields, func(x, y structField) bool {
+			return x.Name == y.Name && valuesEqual(x.Value, y.Value)
+		})
+	case int32, float32, bool, string, rawJson, functionValue, builtinValue:
+		return a == b
+	default:
+		return false
+	}
+}
+
+// Orders values like `<` in C++, which is used for map keys and `sort`.
+func compareValues(a any, b any) int {
+	switch a := a.(type) {
+	case int32:
+		return cmp.Compare(a, b.(int32))
+	case float32:
+		return cmp.Compare(a, b.(float32))
+	case string:
+		return strings.Compare(a, b.(string))
+	case bool:
+		if a == b.(bool) {
+			return 0
+		} else if a {
+			return 1
+		}
+		return -1
+	case tupleValue:
+		return slices.CompareFunc(a, b.(tupleValue), compareValues)
+	case listValue:
+		return slices.CompareFunc(a, b.(listValue), compareValues)
+	default:
+		panic(fmt.Sprintf("Values of type %T cannot be ordered.", a))
+	}
+}
+
+func (m mapValue) find(key any) (int, bool) {
+	return slices.BinarySearchFunc(m, key, func(entry mapEntry, key any) int {
+		return compareValues(entry.key, key)
+	})
+}
+
+func (m mapValue) insert(key any, value any) mapValue {
+	i, found := m.find(key)
+	if found {
+		m = slices.Clone(m)
+		m[i].value = value
+		return m
+	}
+	return slices.Insert(slices.Clone(m), i, mapEntry{key, value})
+}
+
+func (m mapValue) remove(key any) mapValue {
+	i, found := m.find(key)
+	if !found {
+		return m
+	}
+	return slices.Delete(slices.Clone(m), i, i+1)
+}
+
+// The type of a function value.
+func (g *GoEvaluator) functionType(function any) TypeValue {
+	switch function := function.(type) {
+	case functionValue:
+		return function.Declaration.GetDeclaredType()
+	case closureValue:
+		return getFunctionType(function.Closure.Parameters, function.Closure.ReturnType)
+	case builtinValue:
+		return g.state.registeredTypeValues[function.Name]
+	case hostFunction:
+		return function.Type
+	default:
+		return nil
+	}
+}
+
+// Whether `value` is a value of type `t`.
+// Empty lists and maps are of every list and map type.
+func (g *GoEvaluator) hasType(value any, t TypeValue) bool {
+	switch t := t.(type) {
+	case *TypeType:
+		_, ok := value.(TypeValue)
+		return ok
+	case *IntType:
+		_, ok := value.(int32)
+		return ok
+	case *FloatType:
+		_, ok := value.(float32)
+		return ok
+	case *BoolType:
+		_, ok := value.(bool)
+		return ok
+	case *StringType:
+		_, ok := value.(string)
+		return ok
+	case *TupleType:
+		tuple, ok := value.(tupleValue)
+		if !ok || len(tuple) != len(t.Elements) {
+			return false
+		}
+		for i, element := range tuple {
+			if !g.hasType(element, t.Elements[i]) {
+				return false
+			}
+		}
+		return true
+	case *ListType:
+		list, ok := value.(listValue)
+		return ok && util.All(list, func(element any) bool {
+			return g.hasType(element, t.Element)
+		})
+	case *MapType:
+		m, ok := value.(mapValue)
+		return ok && util.All(m, func(entry mapEntry) bool {
+			return g.hasType(entry.key, t.Key) && g.hasType(entry.value, t.Value)
+		})
+	case *FnType:
+		functionType := g.functionType(value)
+		return functionType != nil && functionType.Eq(t)
+	case *StructType:
+		s, ok := value.(structValue)
+		return ok && s.Type.Eq(t)
+	case *UnionType:
+		return util.Any(t.Variants, func(variant TypeValue) bool {
+			return g.hasType(value, variant)
+		})
+	default:
+		panic(fmt.Sprintf("unexpected ast.TypeValue: %#v", t))
+	}
+}
+
+// Finds the variant of the static type `t` that holds `value`, like std::variant does in C++.
+func (g *GoEvaluator) variantOf(value any, t TypeValue) TypeValue {
+	union, isUnion := t.(*UnionType)
+	if !isUnion {
+		return t
+	}
+	for _, variant := range union.Variants {
+		if g.hasType(value, variant) {
+			return variant
+		}
+	}
+	return nil
+}
+
+// Escapes a string like `toJson_(const String_t &)` in pb.hpp, which operates on bytes.
+func stringToJson(s string) string {
+	var builder strings.Builder
+	builder.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			builder.WriteString(`\"`)
+		case '\\':
+			builder.WriteString(`\\`)
+		case '\b':
+			builder.WriteString(`\b`)
+		case '\f':
+			builder.WriteString(`\f`)
+		case '\n':
+			builder.WriteString(`\n`)
+		case '\r':
+			builder.WriteString(`\r`)
+		case '\t':
+			builder.WriteString(`\t`)
+		default:
+			if c < 0x20 {
+				fmt.Fprintf(&builder, `\u%04x`, c)
+			} else {
+				builder.WriteByte(c)
+			}
+		}
+	}
+	builder.WriteByte('"')
+	return builder.String()
+}
+
+// Formats a float like `std::format("{}", f)`, which is the shortest representation
+// that parses back to the same float, in either fixed or scientific notation.
+func formatFloat(f float32) string {
+	switch {
+	case math.IsNaN(float64(f)):
+		return "nan"
+	case math.IsInf(float64(f), 1):
+		return "inf"
+	case math.IsInf(float64(f), -1):
+		return "-inf"
+	}
+	fixed := strconv.FormatFloat(float64(f), 'f', -1, 32)
+	scientific := strconv.FormatFloat(float64(f), 'e', -1, 32)
+	if len(scientific) < len(fixed) {
+		return scientific
+	}
+	return fixed
+}
+
+// Formats a finite float so that it contains a '.' or exponent, like `toJson_(const float &)` and `show_`.
+func formatFloatLiteral(f float32) string {
+	s := formatFloat(f)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+func joinJson(elements []any, toJson func(any) string) string {
+	return "[" + util.JoinFunc(elements, ", ", toJson) + "]"
+}
+
+func boxJson(json string, boxed bool) string {
+	if boxed {
+		return fmt.Sprintf(`{ "Box": %s }`, json)
+	}
+	return json
+}
+
+func typeToJson(t TypeValue) string {
+	switch t := t.(type) {
+	case *TypeType:
+		return `{ "TypeType": {} }`
+	case *IntType:
+		return `{ "IntType": {} }`
+	case *FloatType:
+		return `{ "FloatType": {} }`
+	case *BoolType:
+		return `{ "BoolType": {} }`
+	case *StringType:
+		return `{ "StringType": {} }`
+	case *TupleType:
+		return boxJson(fmt.Sprintf(`{ "TupleType": { "elements": [%s] } }`, util.JoinFunc(t.Elements, ", ", typeToJson)), true)
+	case *ListType:
+		return boxJson(fmt.Sprintf(`{ "ListType": { "element": %s } }`, typeToJson(t.Element)), true)
+	case *MapType:
+		return boxJson(fmt.Sprintf(`{ "MapType": { "key": %s, "value": %s } }`, typeToJson(t.Key), typeToJson(t.Value)), true)
+	case *FnType:
+		return boxJson(fmt.Sprintf(`{ "FnType": { "argument": %s, "returnType": %s } }`, typeToJson(t.Argument), typeToJson(t.Return)), true)
+	case *StructType:
+		fields := util.JoinFunc(t.Fields, ", ", func(field StructTypeField) string {
+			return fmt.Sprintf(`{ "name": %s, "type": %s }`, stringToJson(field.Name), typeToJson(field.Type))
+		})
+		return boxJson(fmt.Sprintf(`{ "StructType": { "name": %s, "fields": [%s] } }`, stringToJson(t.Name), fields), true)
+	case *UnionType:
+		return boxJson(fmt.Sprintf(`{ "UnionType": { "variants": [%s] } }`, util.JoinFunc(t.Variants, ", ", typeToJson)), true)
+	default:
+		panic(fmt.Sprintf("unexpected ast.TypeValue: %#v", t))
+	}
+}
+
+// Encodes a value like `toJson_` in pb.hpp.
+// Closures are registered in the state, so that they can be lowered later on.
+func (g *GoEvaluator) toJson(value any) string {
+	switch value := value.(type) {
+	case int32:
+		return strconv.Itoa(int(value))
+	case float32:
+		if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+			return fmt.Sprintf(`{ "Float": "%s" }`, formatFloat(value))
+		}
+		return formatFloatLiteral(value)
+	case bool:
+		return strconv.FormatBool(value)
+	case string:
+		return stringToJson(value)
+	case rawJson:
+		return string(value)
+	case TypeValue:
+		return typeToJson(value)
+	case tupleValue:
+		return fmt.Sprintf(`{ "Tuple": { "elements": %s } }`, joinJson(value, g.toJson))
+	case listValue:
+		return joinJson(value, g.toJson)
+	case mapValue:
+		entries := util.Map(value, func(entry mapEntry) any {
+			return tupleValue{entry.key, entry.value}
+		})
+		return fmt.Sprintf(`{ "Map": { "entries": %s } }`, joinJson(entries, g.toJson))
+	case structValue:
+		fields := util.JoinFunc(value.Fields, ", ", func(field structField) string {
+			return fmt.Sprintf(`%s: %s`, stringToJson(field.Name), g.toJson(field.Value))
+		})
+		return boxJson(fmt.Sprintf(`{ %s: { %s } }`, stringToJson(value.Name), fields), value.Boxed)
+	case functionValue:
+		return fmt.Sprintf(`{ "Function": %s }`, stringToJson(value.Declaration.Name.String))
+	case builtinValue:
+		return fmt.Sprintf(`{ "Function": %s }`, stringToJson(value.Name))
+	case closureValue:
+		captures := []string{}
+		for _, name := range slices.Sorted(maps.Keys(value.Closure.captures)) {
+			captures = append(captures, fmt.Sprintf(
+				`{ "name": %s, "type": { "TypeId": %s }, "value": %s }`,
+				stringToJson(name),
+				stringToJson(g.state.registerTypeValue(value.Closure.captures[name])),
+				g.toJson(value.Captures[name]),
+			))
+		}
+		id := g.state.registerClosure(value.Closure)
+		return fmt.Sprintf(`{ "Closure": { "captures": [%s], "id": %s } }`, strings.Join(captures, ", "), stringToJson(id))
+	case hostFunction:
+		panic(EvaluationError{Message: fmt.Sprintf("'%s' is compile-time-only and cannot be stored.", value.Name)})
+	default:
+		panic(fmt.Sprintf("unexpected value in Go evaluator: %#v", value))
+	}
+}
+
+// Decodes a value that was encoded by `toJson_`, such as the value of a constant.
+func (g *GoEvaluator) fromJson(data *fj.Value) any {
+	switch data.Type() {
+	case fj.TypeTrue, fj.TypeFalse:
+		return data.GetBool()
+	case fj.TypeString:
+		return string(data.GetStringBytes())
+	case fj.TypeNumber:
+		if i, err := data.Int64(); err == nil {
+			return int32(i)
+		}
+		return float32(data.GetFloat64())
+	case fj.TypeArray:
+		return listValue(util.Map(data.GetArray(), g.fromJson))
+	case fj.TypeObject:
+		return g.objectFromJson(data)
+	default:
+		panic(fmt.Sprintf("unexpected fastjson.Type: %s", data.Type()))
+	}
+}
+
+func (g *GoEvaluator) objectFromJson(data *fj.Value) any {
+	key, v := fjUnmarshalStruct(data.GetObject())
+	switch key {
+	case "TypeType", "IntType", "FloatType", "BoolType", "StringType",
+		"TupleType", "ListType", "MapType", "FnType", "StructType", "UnionType", "TypeId":
+		return g.state.UnmarshalTypeValue(data)
+	case "Box":
+		value := g.fromJson(v)
+		if s, isStruct := value.(structValue); isStruct {
+			s.Boxed = true
+			return s
+		}
+		return value
+	case "Float":
+		switch UnmarshalNonEmptyString(v) {
+		case "nan":
+			return float32(math.NaN())
+		case "inf":
+			return float32(math.Inf(1))
+		default:
+			return float32(math.Inf(-1))
+		}
+	case "Tuple":
+		return tupleValue(util.Map(UnmarshalArray(v, "elements"), g.fromJson))
+	case "Map":
+		m := mapValue{}
+		for _, entry := range UnmarshalArray(v, "entries") {
+			elements := UnmarshalTuple(entry)
+			m = m.insert(g.fromJson(elements[0]), g.fromJson(elements[1]))
+		}
+		return m
+	case "Function":
+		return g.global(UnmarshalNonEmptyString(v), Span{})
+	case "Closure":
+		id := UnmarshalNonEmptyString(v, "id")
+		closure := g.state.registeredClosures[id]
+		if closure == nil {
+			panic(fmt.Sprintf("Invalid closure ID: '%s'", id))
+		}
+		captures := map[string]any{}
+		for _, capture := range UnmarshalArray(v, "captures") {
+			captures[UnmarshalNonEmptyString(capture, "name")] = g.fromJson(capture.Get("value"))
+		}
+		return closureValue{Closure: closure, Captures: captures}
+	case "ValueExpression":
+		return newStructValue(key,
+			structField{"location", g.fromJson(v.Get("location"))},
+			structField{"value", rawJson(v.Get("value").String())},
+		)
+	default:
+		fields := []structField{}
+		v.GetObject().Visit(func(keyBytes []byte, fieldValue *fj.Value) {
+			fields = append(fields, structField{string(keyBytes), g.fromJson(fieldValue)})
+		})
+		return newStructValue(key, fields...)
+	}
+}
+
+func showType(t TypeValue) string {
+	switch t := t.(type) {
+	case *TupleType:
+		return "(" + util.JoinFunc(t.Elements, ", ", showType) + ")"
+	case *ListType:
+		return fmt.Sprintf("List(%s)", showType(t.Element))
+	case *MapType:
+		return fmt.Sprintf("Map(%s, %s)", showType(t.Key), showType(t.Value))
+	case *FnType:
+		return fmt.Sprintf("Fn(%s, %s)", showType(t.Argument), showType(t.Return))
+	case *UnionType:
+		return "Union[" + util.JoinFunc(t.Variants, ", ", showType) + "]"
+	default:
+		return t.String()
+	}
+}
+
+// Like show, except that strings are not quoted. Values of union types are the value of their active variant,
+// so a union holding a string is not quoted either, like in pb.hpp.
+func (g *GoEvaluator) toString(value any) string {
+	if s, isString := value.(string); isString {
+		return s
+	}
+	return g.show(value)
+}
+
+// Renders a value in Yune syntax like `show_` in pb.hpp.
+func (g *GoEvaluator) show(value any) string {
+	switch value := value.(type) {
+	case int32:
+		return strconv.Itoa(int(value))
+	case float32:
+		if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+			return formatFloat(value)
+		}
+		return formatFloatLiteral(value)
+	case bool:
+		return strconv.FormatBool(value)
+	case string:
+		return stringToJson(value)
+	case TypeValue:
+		return showType(value)
+	case tupleValue:
+		return "(" + util.JoinFunc(value, ", ", g.show) + ")"
+	case listValue:
+		return "[" + util.JoinFunc(value, ", ", g.show) + "]"
+	case mapValue:
+		return "toMap([" + util.JoinFunc(value, ", ", func(entry mapEntry) string {
+			return fmt.Sprintf("(%s, %s)", g.show(entry.key), g.show(entry.value))
+		}) + "])"
+	case structValue:
+		if value.Name == "Error" {
+			return fmt.Sprintf("Error(%s)", g.show(value.field("message")))
+		}
+		return g.toJson(value)
+	default:
+		return g.toJson(value)
+	}
+}
@@ -0,0 +1,362 @@
+package ast
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"yune/cpp"
+
+	fj "github.com/valyala/fastjson"
+)
+
+// Version of the format of module interfaces, which must be increased whenever it changes.
+const interfaceFormatVersion = 1
+
+// A declaration loaded from a module interface, which was analyzed, evaluated and lowered
+// when the interface was written.
+type InterfaceDeclaration struct {
+	Name       Name
+	Type       TypeValue
+	Flags      Flags
+	IsFunction bool
+	// The value of a constant.
+	value       *fj.Value
+	declaration cpp.Declaration
+	definition  cpp.Definition
+}
+
+// GetSpan implements TopLevelDeclaration.
+func (d *InterfaceDeclaration) GetSpan() Span {
+	return d.Name.GetSpan()
+}
+
+// GetName implements TopLevelDeclaration.
+func (d *InterfaceDeclaration) GetName() Name {
+	return d.Name
+}
+
+// GetFlags implements TopLevelDeclaration.
+func (d *InterfaceDeclaration) GetFlags() Flags {
+	return d.Flags
+}
+
+// GetDeclaredType implements TopLevelDeclaration.
+func (d *InterfaceDeclaration) GetDeclaredType() TypeValue {
+	return d.Type
+}
+
+// Analyze implements TopLevelDeclaration.
+// Declarations are declared and defined when their interface is loaded, so there is nothing to analyze.
+func (d *InterfaceDeclaration) Analyze(anal Analyzer) {}
+
+// LowerDeclaration implements TopLevelDeclaration.
+func (d *InterfaceDeclaration) LowerDeclaration(state *State) cpp.Declaration {
+	return d.declaration
+}
+
+// LowerDefinition implements TopLevelDeclaration.
+func (d *InterfaceDeclaration) LowerDefinition(state *State) cpp.Definition {
+	return d.definition
+}
+
+var _ TopLevelDeclaration = (*InterfaceDeclaration)(nil)
+
+// The interface of an analyzed module, stored as JSON in the "interfaces" directory of the cache.
+// It contains everything that the analysis of the module added to the session,
+// so that loading it has the same effect as analyzing the module again.
+type interfaceFile struct {
+	Version      int
+	RawOutput    string
+	Declarations []interfaceDeclaration
+	// Types registered in State, in the format read by UnmarshalTypeValue.
+	TypeValues map[string]json.RawMessage
+	// Closures registered in State, see closureTemplate.
+	Closures map[string]string
+	// The source of the files that the spans refer to, by file name.
+	Sources    map[string]string
+	Lines      []interfaceSpan
+	RawStrings []interfaceRawString
+}
+
+type interfaceDeclaration struct {
+	Name       string
+	Span       interfaceSpan
+	IsFunction bool
+	Type       json.RawMessage
+	Flags      Flags
+	Value      json.RawMessage `json:",omitempty"`
+	// The lowered C++.
+	Declaration string
+	Definition  string
+	// The names of the top-level declarations it uses, see State.uses.
+	Uses []string
+}
+
+// A span without its source, which is stored once per file.
+type interfaceSpan struct {
+	File   string
+	Line   int
+	Column int
+	Length int
+}
+
+type interfaceRawString struct {
+	Span interfaceSpan
+	Text string
+}
+
+func newInterfaceSpan(span Span) interfaceSpan {
+	return interfaceSpan{span.File, span.Line, span.Column, span.Length}
+}
+
+func (s interfaceSpan) span(sources map[string]string) Span {
+	return Span{File: s.File, Source: sources[s.File], Line: s.Line, Column: s.Column, Length: s.Length}
+}
+
+// Marks where the value of a capture goes in a closure template.
+func closurePlaceholder(name string) string {
+	return "\x00" + name + "\x00"
+}
+
+// Lowers a registered closure with placeholders instead of the values of its captures,
+// so that its values can be lowered without its AST.
+func closureTemplate(closure *Closure, state *State) string {
+	placeholders := map[string]string{}
+	for name := range closure.captures {
+		placeholders[name] = closurePlaceholder(name)
+	}
+	return closure.LowerComplex(state, placeholders)
+}
+
+// Replaces the placeholders of a closure template with the lowered values of its captures.
+func fillClosureTemplate(template string, captureValues map[string]string) string {
+	for name, value := range captureValues {
+		template = strings.ReplaceAll(template, closurePlaceholder(name), value)
+	}
+	return template
+}
+
+// Identifies the interface of the next imported file.
+// Declarations of all files imported before it are visible to it, so its key depends on theirs.
+func (s *Session) nextInterfaceKey(path string, source string) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d\n%s\n%s\n%d\n%s\n%d\n%s\n", interfaceFormatVersion, s.cacheVersion, s.interfaceKey, len(path), path, len(source), source)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (s *Session) interfacePath(key string) string {
+	return filepath.Join(s.interfaceDir, key[:2], key+".json")
+}
+
+// Loads the interface of an imported file that was written when an earlier compilation analyzed it.
+// Returns false if there is no such interface, in which case the file should be analyzed with Import.
+func (s *Session) LoadInterface(path string, source string) (loaded bool, errors Errors) {
+	if s.interfaceDir == "" {
+		return
+	}
+	key := s.nextInterfaceKey(path, source)
+	contents, err := os.ReadFile(s.interfacePath(key))
+	if err != nil {
+		return
+	}
+	var file interfaceFile
+	if err := json.Unmarshal(contents, &file); err != nil || file.Version != interfaceFormatVersion {
+		log.Printf("Ignoring invalid interface '%s' of '%s'.\n", s.interfacePath(key), path)
+		return
+	}
+	declarations, typeValues, err := s.decodeInterface(file)
+	if err != nil {
+		log.Printf("Ignoring invalid interface '%s' of '%s'. Error: %s\n", s.interfacePath(key), path, err)
+		return
+	}
+	for _, decl := range declarations {
+		if other, exists := s.declarations[decl.Name.String]; exists && !shadowsBuiltin(decl, other) {
+			errors = append(errors, DuplicateDeclaration{First: other, Second: decl})
+		}
+	}
+	if len(errors) > 0 {
+		return
+	}
+	log.Printf("Loading the interface of '%s'.\n", path)
+	if err := s.evaluator.Write(file.RawOutput); err != nil {
+		return true, Errors{err}
+	}
+	if file.RawOutput != "" {
+		s.state.rawOutputs = append(s.state.rawOutputs, file.RawOutput)
+	}
+	for _, line := range file.Lines {
+		span := line.span(file.Sources)
+		s.state.Spans.lines[sourceLine{span.File, span.Line}] = span
+	}
+	for _, r := range file.RawStrings {
+		s.state.Spans.rawStrings = append(s.state.Spans.rawStrings, NewRawString(r.Span.span(file.Sources), r.Text))
+	}
+	maps.Copy(s.state.registeredTypeValues, typeValues)
+	maps.Copy(s.state.closureTemplates, file.Closures)
+	for _, decl := range declarations {
+		if _, isBuiltin := s.declarations[decl.Name.String].(*BuiltinDeclaration); isBuiltin {
+			s.state.shadowedBuiltins[decl.Name.String] = true
+		}
+		s.declarations[decl.Name.String] = decl
+	}
+	for i, decl := range declarations {
+		uses := []TopLevelDeclaration{}
+		for _, name := range file.Declarations[i].Uses {
+			uses = append(uses, s.declarations[name])
+		}
+		s.state.uses[decl] = uses
+	}
+	// functions are declared first, so that definitions can use functions defined after them,
+	// while constants are only defined, as when they are analyzed
+	for _, decl := range declarations {
+		if !decl.IsFunction {
+			continue
+		}
+		if err := s.evaluator.Declare(decl); err != nil {
+			return true, Errors{err}
+		}
+	}
+	for _, decl := range declarations {
+		if err := s.evaluator.Define(decl); err != nil {
+			return true, Errors{err}
+		}
+		s.defined[decl] = struct{}{}
+	}
+	module := Module{RawOutput: file.RawOutput}
+	for _, decl := range declarations {
+		module.Declarations = append(module.Declarations, decl)
+	}
+	s.addReusable(module, fingerprints(module), s.imported)
+	s.interfaceKey = key
+	return true, nil
+}
+
+// Decodes the declarations and types of an interface, returning an error if they are malformed.
+func (s *Session) decodeInterface(file interfaceFile) (declarations []*InterfaceDeclaration, typeValues map[string]TypeValue, err error) {
+	// the Unmarshal functions panic on malformed JSON
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	unmarshalTypeValue := func(data json.RawMessage) TypeValue {
+		return s.state.UnmarshalTypeValue(fj.MustParseBytes(data))
+	}
+	for _, d := range file.Declarations {
+		decl := &InterfaceDeclaration{
+			Name:        Name{String: d.Name, Span: d.Span.span(file.Sources)},
+			Type:        unmarshalTypeValue(d.Type),
+			Flags:       d.Flags,
+			IsFunction:  d.IsFunction,
+			declaration: d.Declaration,
+			definition:  d.Definition,
+		}
+		if !d.IsFunction {
+			decl.value = fj.MustParseBytes(d.Value)
+		}
+		declarations = append(declarations, decl)
+	}
+	typeValues = map[string]TypeValue{}
+	for id, data := range file.TypeValues {
+		typeValues[id] = unmarshalTypeValue(data)
+	}
+	return
+}
+
+// Analyzes an imported file, writing its interface so that later compilations can load it instead.
+// Files must be imported after the files they import.
+// Declarations of the session given to ReuseImports are reused if they have not changed.
+func (s *Session) Import(path string, source string, m Module) (errors Errors) {
+	before := s.state.clone()
+	fingerprints := fingerprints(m)
+	s.writeRawOutput(m)
+	if m, errors = s.reuse(m, fingerprints, s.previousState, s.defined); len(errors) > 0 {
+		return
+	}
+	if errors = s.analyze(m, s.declarations, s.defined); len(errors) > 0 {
+		return
+	}
+	if errors = s.waitForFinish(); len(errors) > 0 {
+		return
+	}
+	s.addReusable(m, fingerprints, s.imported)
+	if s.interfaceDir != "" {
+		s.interfaceKey = s.nextInterfaceKey(path, source)
+		if err := writeCacheFile(s.interfacePath(s.interfaceKey), s.encodeInterface(m, before)); err != nil {
+			log.Printf("Failed to write the interface of '%s'. Error: %s\n", path, err)
+		}
+	}
+	return
+}
+
+// Encodes what the analysis of the module added to the state, which was `before` it was analyzed.
+func (s *Session) encodeInterface(m Module, before *State) string {
+	file := interfaceFile{
+		Version:    interfaceFormatVersion,
+		RawOutput:  m.RawOutput,
+		TypeValues: map[string]json.RawMessage{},
+		Closures:   map[string]string{},
+		Sources:    map[string]string{},
+	}
+	addSpan := func(span Span) interfaceSpan {
+		if span.Source != "" {
+			file.Sources[span.File] = span.Source
+		}
+		return newInterfaceSpan(span)
+	}
+	for _, decl := range m.Declarations {
+		d := interfaceDeclaration{
+			Name:        decl.GetName().String,
+			Span:        addSpan(decl.GetSpan()),
+			Type:        json.RawMessage(MarshalTypeValue(decl.GetDeclaredType())),
+			Flags:       decl.GetFlags(),
+			Declaration: decl.LowerDeclaration(s.state),
+			Definition:  decl.LowerDefinition(s.state),
+		}
+		switch decl := decl.(type) {
+		case *FunctionDeclaration:
+			d.IsFunction = true
+		case *ConstantDeclaration:
+			d.Value = json.RawMessage(decl.value.String())
+		}
+		for _, used := range s.state.uses[decl] {
+			d.Uses = append(d.Uses, used.GetName().String)
+		}
+		file.Declarations = append(file.Declarations, d)
+	}
+	// lowering closures registers the types of their captures, so they are lowered before collecting types
+	for id, closure := range s.state.registeredClosures {
+		if _, existed := before.registeredClosures[id]; !existed {
+			file.Closures[id] = closureTemplate(closure, s.state)
+		}
+	}
+	for id, typeValue := range s.state.registeredTypeValues {
+		if _, existed := before.registeredTypeValues[id]; !existed {
+			file.TypeValues[id] = json.RawMessage(MarshalTypeValue(typeValue))
+		}
+	}
+	for line, span := range s.state.Spans.lines {
+		if _, existed := before.Spans.lines[line]; !existed {
+			file.Lines = append(file.Lines, addSpan(span))
+		}
+	}
+	slices.SortFunc(file.Lines, func(a, b interfaceSpan) int {
+		return cmp.Or(strings.Compare(a.File, b.File), cmp.Compare(a.Line, b.Line))
+	})
+	for _, r := range s.state.Spans.rawStrings[len(before.Spans.rawStrings):] {
+		file.RawStrings = append(file.RawStrings, interfaceRawString{addSpan(r.Span), r.string})
+	}
+	contents, err := json.Marshal(file)
+	if err != nil {
+		log.Panicf("Failed to encode module interface. Error: %s\n", err)
+	}
+	return string(contents)
+}
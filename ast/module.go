@@ -1,7 +1,13 @@
 package ast
 
 import (
+	"cmp"
+	"fmt"
 	"log"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
 	"yune/cpp"
 )
 
@@ -9,30 +15,342 @@ type Module struct {
 	RawOutput    string
 	Imports      []string
 	Declarations []TopLevelDeclaration
+	// Arguments of `// yune:build` directives, which set cpp.BuildOptions.
+	BuildDirectives [][]string
 }
 
 func JoinModules(modules ...Module) (result Module) {
 	for _, m := range modules {
 		result.Declarations = append(result.Declarations, m.Declarations...)
+		result.BuildDirectives = append(result.BuildDirectives, m.BuildDirectives...)
 	}
 	return
 }
 
-func (m Module) Lower() (lowered cpp.Module, hasMainFunction bool, errors Errors) {
-	declarations := map[string]TopLevelDeclaration{}
+// Lowers the module to C++, also returning the table needed to map C++ diagnostics back to the module.
+func (m Module) Lower(options cpp.BuildOptions) (lowered cpp.Module, spans *SpanTable, hasMainFunction bool, errors Errors) {
+	session := NewSession(options)
+	lowered, spans, hasMainFunction, errors = session.Lower(m)
+	if len(errors) == 0 {
+		session.Close()
+	}
+	return
+}
+
+// Keeps imported modules analyzed and declared in an evaluator, so that the modules importing them
+// can be lowered repeatedly without analyzing the imports again, as done by `yune daemon`.
+// Imported files are added with LoadInterface or Import, followed by FinishImports.
+type Session struct {
+	evaluator    Evaluator
+	state        *State
+	declarations map[string]TopLevelDeclaration
+	defined      map[TopLevelDeclaration]struct{}
+	// The state after analyzing the imports, which is restored before lowering the next module.
+	checkpoint *State
+	// Whether a module has been lowered since the imports were analyzed.
+	dirty bool
+	// Directory of the module interfaces, or empty if they are disabled.
+	interfaceDir string
+	cacheVersion string
+	// Key of the interface of the last imported file.
+	interfaceKey string
+	// The declarations of the module that was last lowered without errors, by name,
+	// which are reused by the next module if their source has not changed.
+	// While importing, these are the imported declarations of the session given to ReuseImports instead.
+	previous map[string]previousDeclaration
+	// The state in which the imported declarations of `previous` were analyzed, or nil.
+	previousState *State
+	// The declarations of the imported files by name, which a later session can reuse.
+	imported map[string]previousDeclaration
+	// The declarations of the module that was last lowered, by name, which Units splits into translation units.
+	lowered map[string]TopLevelDeclaration
+}
+
+type previousDeclaration struct {
+	decl        TopLevelDeclaration
+	fingerprint string
+	uses        []TopLevelDeclaration
+}
 
+func NewSession(options cpp.BuildOptions) *Session {
+	state := NewState()
+	s := &Session{
+		evaluator:    NewEvaluator(options, state),
+		state:        state,
+		declarations: map[string]TopLevelDeclaration{},
+		defined:      map[TopLevelDeclaration]struct{}{},
+		imported:     map[string]previousDeclaration{},
+	}
+	// the go evaluator interprets the AST of functions, which interfaces do not contain
+	if version, ok := cacheVersion(options); ok && options.Evaluator != "go" {
+		s.interfaceDir = filepath.Join(options.CacheDir, "interfaces")
+		s.cacheVersion = version
+	}
 	// Register builtin declarations
 	for _, decl := range BuiltinDeclarations {
-		declarations[decl.GetName().String] = &decl
+		s.declarations[decl.GetName().String] = &decl
+	}
+	return s
+}
+
+// Makes the files imported after this reuse the declarations that `previous` imported instead of analyzing them again,
+// if neither their source nor the declarations they use have changed, as done by `yune daemon` when an import changes.
+// The reused declarations are shared with `previous`, which should be closed once the imports are finished.
+func (s *Session) ReuseImports(previous *Session) {
+	s.previous = previous.imported
+	s.previousState = previous.state
+}
+
+// Marks the imported files as shared by all modules lowered by the session.
+// The session is closed if the imports have errors.
+func (s *Session) FinishImports() (errors Errors) {
+	s.previous, s.previousState = nil, nil
+	if errors = s.waitForFinish(); len(errors) > 0 {
+		s.Close()
+		return
+	}
+	s.checkpoint = s.state.clone()
+	s.evaluator.Checkpoint()
+	return
+}
+
+// Lowers a module that may use the declarations of the imports,
+// undoing the declarations of the module that was lowered before.
+// Declarations of the previous module are reused instead of being analyzed again
+// if neither their source nor the declarations they use have changed.
+func (s *Session) Lower(m Module) (lowered cpp.Module, spans *SpanTable, hasMainFunction bool, errors Errors) {
+	last := *s.state
+	if s.dirty {
+		*s.state = *s.checkpoint.clone()
+		if err := s.evaluator.Rollback(); err != nil {
+			log.Panicf("Failed to undo the declarations of the previous module. Error: %s\n", err)
+		}
+	}
+	s.dirty = true
+	declarations := maps.Clone(s.declarations)
+	defined := maps.Clone(s.defined)
+	spans = s.state.Spans
+	s.lowered = nil
+	fingerprints := fingerprints(m)
+	s.writeRawOutput(m)
+	if m, errors = s.reuse(m, fingerprints, &last, defined); len(errors) > 0 {
+		return
+	}
+	if errors = s.analyze(m, declarations, defined); len(errors) > 0 {
+		return
+	}
+	_, hasMainFunction = declarations["main"]
+	if errors = s.waitForFinish(); len(errors) > 0 {
+		return
+	}
+	s.previous = map[string]previousDeclaration{}
+	s.addReusable(m, fingerprints, s.previous)
+	s.lowered = declarations
+	lowered = s.evaluator.Declared()
+	return
+}
+
+// Identifies the source of each declaration of the module by its location and the lines from its start
+// up to the next declaration in the same file, along with the raw C++ of the module that it may use.
+// Declarations without source, such as generated ones, have no fingerprint.
+func fingerprints(m Module) map[string]string {
+	byFile := map[string][]TopLevelDeclaration{}
+	for _, decl := range m.Declarations {
+		if span := decl.GetSpan(); span.Source != "" && span.Line > 0 {
+			byFile[span.File] = append(byFile[span.File], decl)
+		}
+	}
+	result := map[string]string{}
+	for file, decls := range byFile {
+		slices.SortFunc(decls, func(a, b TopLevelDeclaration) int {
+			return cmp.Compare(a.GetSpan().Line, b.GetSpan().Line)
+		})
+		lines := slices.Collect(strings.Lines(decls[0].GetSpan().Source))
+		for i, decl := range decls {
+			start, end := decl.GetSpan().Line-1, len(lines)
+			if i+1 < len(decls) {
+				end = decls[i+1].GetSpan().Line - 1
+			}
+			if start >= end || end > len(lines) {
+				continue
+			}
+			result[decl.GetName().String] = fmt.Sprintf(
+				"%d\n%s\n%s:%d\n%s", len(m.RawOutput), m.RawOutput, file, start+1, strings.Join(lines[start:end], ""),
+			)
+		}
+	}
+	return result
+}
+
+// Adds the declarations of the module that were analyzed and have a fingerprint to `reusable`.
+func (s *Session) addReusable(m Module, fingerprints map[string]string, reusable map[string]previousDeclaration) {
+	for _, decl := range m.Declarations {
+		name := decl.GetName().String
+		uses, analyzed := s.state.uses[decl]
+		if fingerprints[name] != "" && analyzed {
+			reusable[name] = previousDeclaration{decl, fingerprints[name], uses}
+		}
+	}
+}
+
+// Replaces the declarations of the module that are unchanged since the previous module with their analyzed
+// versions, declaring and defining them in the evaluator and adding them to `defined`.
+// A declaration is only reused if all declarations of the previous module that it uses are reused too.
+// `last` is the state in which they were analyzed.
+func (s *Session) reuse(m Module, fingerprints map[string]string, last *State, defined map[TopLevelDeclaration]struct{}) (_ Module, errors Errors) {
+	reused := map[TopLevelDeclaration]bool{}
+	for _, decl := range m.Declarations {
+		name := decl.GetName().String
+		if previous, ok := s.previous[name]; ok && fingerprints[name] == previous.fingerprint {
+			reused[previous.decl] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for decl := range reused {
+			for _, used := range s.previous[decl.GetName().String].uses {
+				previous, isPrevious := s.previous[used.GetName().String]
+				if isPrevious && previous.decl == used && !reused[used] {
+					delete(reused, decl)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	if len(reused) == 0 {
+		return m, nil
+	}
+	log.Printf("Reusing %d of %d declarations, which have not changed.\n", len(reused), len(m.Declarations))
+	// the values of reused constants may refer to closures and types registered while analyzing them
+	for id, closure := range last.registeredClosures {
+		if _, exists := s.state.registeredClosures[id]; !exists {
+			s.state.registeredClosures[id] = closure
+		}
+	}
+	for id, typeValue := range last.registeredTypeValues {
+		if _, exists := s.state.registeredTypeValues[id]; !exists {
+			s.state.registeredTypeValues[id] = typeValue
+		}
+	}
+	for id, template := range last.closureTemplates {
+		if _, exists := s.state.closureTemplates[id]; !exists {
+			s.state.closureTemplates[id] = template
+		}
+	}
+	m.Declarations = slices.Clone(m.Declarations)
+	// declarations are defined after the ones they use, in the order they were analyzed
+	order := []TopLevelDeclaration{}
+	visited := map[TopLevelDeclaration]bool{}
+	var visit func(decl TopLevelDeclaration)
+	visit = func(decl TopLevelDeclaration) {
+		if !reused[decl] || visited[decl] {
+			return
+		}
+		visited[decl] = true
+		for _, used := range s.previous[decl.GetName().String].uses {
+			visit(used)
+		}
+		order = append(order, decl)
+	}
+	for i, decl := range m.Declarations {
+		if previous, ok := s.previous[decl.GetName().String]; ok && reused[previous.decl] {
+			m.Declarations[i] = previous.decl
+			visit(previous.decl)
+		}
+	}
+	for _, decl := range order {
+		s.state.uses[decl] = s.previous[decl.GetName().String].uses
+		switch decl := decl.(type) {
+		case *FunctionDeclaration:
+			s.state.registerFunction(decl.Name.String, decl.GetDeclaredType())
+		case *InterfaceDeclaration:
+			if !decl.IsFunction {
+				continue
+			}
+		default:
+			continue
+		}
+		if err := s.evaluator.Declare(decl); err != nil {
+			return m, Errors{err}
+		}
+	}
+	for _, decl := range order {
+		if err := s.evaluator.Define(decl); err != nil {
+			return m, Errors{err}
+		}
+		defined[decl] = struct{}{}
+	}
+	return m, nil
+}
+
+// Splits the module that was last lowered without errors into translation units, one per source file,
+// which all include the declarations of the module.
+// Modules with raw C++ are compiled as a single unit by moving all definitions to the header,
+// since the raw C++ may define non-inline functions or variables, which cannot be included by several units.
+func (s *Session) Units() (units cpp.Units) {
+	decls := slices.Collect(maps.Values(s.lowered))
+	slices.SortFunc(decls, func(a, b TopLevelDeclaration) int {
+		return cmp.Or(
+			strings.Compare(a.GetSpan().File, b.GetSpan().File),
+			cmp.Compare(a.GetSpan().Line, b.GetSpan().Line),
+			strings.Compare(a.GetName().String, b.GetName().String),
+		)
+	})
+	units.Header = `#include "pb.hpp"` + "\n" + strings.Join(s.state.rawOutputs, "\n") + "\n"
+	byFile := map[string]int{}
+	for _, decl := range decls {
+		if _, isBuiltin := decl.(*BuiltinDeclaration); isBuiltin {
+			continue
+		}
+		units.Header += decl.LowerDeclaration(s.state) + "\n"
+		file := decl.GetSpan().File
+		i, exists := byFile[file]
+		if !exists {
+			i = len(units.Units)
+			byFile[file] = i
+			units.Units = append(units.Units, cpp.Unit{Name: file})
+		}
+		units.Units[i].Code += decl.LowerDefinition(s.state) + "\n"
+	}
+	if len(s.state.rawOutputs) > 0 {
+		// only the unit that calls `main` includes the header
+		for _, unit := range units.Units {
+			units.Header += unit.Code
+		}
+		units.Units = nil
+	}
+	return
+}
+
+func (s *Session) Close() {
+	s.evaluator.Close()
+}
+
+// Writes the raw C++ of the module, which its declarations may use.
+func (s *Session) writeRawOutput(m Module) {
+	if err := s.evaluator.Write(m.RawOutput); err != nil {
+		log.Panicf("Failed to emit raw C++ output. Error: %s\n", err)
+	}
+	if m.RawOutput != "" {
+		s.state.rawOutputs = append(s.state.rawOutputs, m.RawOutput)
 	}
+}
+
+// Analyzes the declarations of the module, adding them to `declarations` and `defined`.
+// The raw C++ of the module should be written before.
+func (s *Session) analyze(m Module, declarations map[string]TopLevelDeclaration, defined map[TopLevelDeclaration]struct{}) (errors Errors) {
 	// get unique mapping of name -> declaration
 	for _, decl := range m.Declarations {
 		name := decl.GetName()
 		other, exists := declarations[name.String]
 
-		if exists {
+		if exists && !shadowsBuiltin(decl, other) {
 			errors = append(errors, DuplicateDeclaration{First: other, Second: decl})
 		} else {
+			if exists {
+				s.state.shadowedBuiltins[name.String] = true
+			}
 			declarations[name.String] = decl
 		}
 	}
@@ -40,27 +358,25 @@ func (m Module) Lower() (lowered cpp.Module, hasMainFunction bool, errors Errors
 		return
 	}
 	anal := Analyzer{
-		Interpreter: cpp.NewInterpreter(),
-		Errors:      &errors,
-		Defined:     map[TopLevelDeclaration]struct{}{},
+		Evaluator: s.evaluator,
+		Errors:    &errors,
+		Defined:   defined,
 		Table: DeclarationTable{
 			topLevelDeclarations: declarations,
 		},
-		State: NewState(),
-	}
-	if err := anal.Interpreter.Write(m.RawOutput); err != nil {
-		log.Panicf("Failed to emit raw C++ output. Error: %s\n", err)
+		State: s.state,
+		Batch: NewEvaluationBatch(),
 	}
 	for _, decl := range declarations {
 		anal.Table.Add(decl)
 	}
-	_, hasMainFunction = declarations["main"]
 	for _, decl := range declarations {
 		_, evaluated := anal.Defined[decl]
 		if !evaluated {
 			decl.Analyze(anal)
 		}
 	}
+	anal.EvaluateBatch()
 	if len(errors) > 0 {
 		return
 	}
@@ -78,11 +394,17 @@ func (m Module) Lower() (lowered cpp.Module, hasMainFunction bool, errors Errors
 			len(declarations),
 		)
 	}
-	if err := anal.Interpreter.WaitForFinish(); err != nil {
-		errors = append(errors, err)
-		return
+	return
+}
+
+// Waits until the evaluator has processed all declarations, translating the errors it reports.
+func (s *Session) waitForFinish() (errors Errors) {
+	if err := s.evaluator.WaitForFinish(); err != nil {
+		if compileError, ok := err.(cpp.CompileError); ok {
+			errors = append(errors, s.state.Spans.Translate(compileError, Span{})...)
+		} else {
+			errors = append(errors, err)
+		}
 	}
-	lowered = anal.Interpreter.Declared
-	anal.Interpreter.Close()
 	return
 }
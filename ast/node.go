@@ -21,8 +21,9 @@ func (s Span) String() string {
 	return fmt.Sprintf("%d:%d", s.Line, s.Column)
 }
 
+// Lowers a span to a `Span_t` (see pb.hpp) for runtime error messages.
 func (s Span) Lower() cpp.Expression {
-	return fmt.Sprintf(`Span(%d, %d)`, s.Line, s.Column)
+	return fmt.Sprintf(`Span_t{%q, %d, %d}`, s.File, s.Line, s.Column)
 }
 
 type Name struct {
@@ -32,6 +33,15 @@ type Name struct {
 
 // Lowers a name, renaming in case of naming conflicts with reserved identifiers.
 func (n Name) Lower() string {
+	// the C++ name of a shadowable builtin is taken by the builtin, which may be used elsewhere
+	if _, shadowable := shadowableBuiltins[n.String]; shadowable {
+		return "shadowing_" + n.String
+	}
+	return n.lowerUnshadowed()
+}
+
+// Lowers a name that is not renamed for shadowing a builtin.
+func (n Name) lowerUnshadowed() string {
 	switch n.String {
 	// main function cannot be a C++ struct with operator(), which Yune generates by default
 	// so it is renamed and a wrapper is generated
@@ -40,6 +50,10 @@ func (n Name) Lower() string {
 	// namespace std is used in pb.hpp, so it conflicts with globals with the same name
 	case "std":
 		return "std_"
+	// C library functions that are declared in the global namespace
+	case "remove", "abs", "pow", "floor", "ceil", "round",
+		"sqrt", "exp", "log", "sin", "cos", "tan", "atan2":
+		return n.String + "_"
 	// C++ keywords
 	case "alignas",
 		"alignof",
@@ -2,15 +2,29 @@ package ast
 
 import (
 	"fmt"
+	"maps"
 	"regexp"
+	"slices"
+	"strings"
+	"yune/cpp"
 )
 
 // Stores global state that needs to be retained between Analyze and Lower steps.
 type State struct {
 	// Stores closures that need to be serializable from C++.
 	registeredClosures map[string]*Closure
+	// Lowered closures loaded from module interfaces, see closureTemplate.
+	closureTemplates map[string]string
 	// Stores type values that need to be serializable from C++.
 	registeredTypeValues map[string]TypeValue
+	// Records which Yune code the lowered C++ originates from.
+	Spans *SpanTable
+	// The top-level declarations used by each analyzed function and constant.
+	uses map[TopLevelDeclaration][]TopLevelDeclaration
+	// The raw C++ at the top of the analyzed modules, which their declarations may use.
+	rawOutputs []string
+	// The builtins that top-level declarations shadow, see shadowableBuiltins.
+	shadowedBuiltins map[string]bool
 }
 
 func NewState() *State {
@@ -20,10 +34,132 @@ func NewState() *State {
 	}
 	return &State{
 		registeredClosures:   map[string]*Closure{},
+		closureTemplates:     map[string]string{},
 		registeredTypeValues: registeredTypeValues,
+		Spans: &SpanTable{
+			lines: map[sourceLine]Span{},
+		},
+		uses:             map[TopLevelDeclaration][]TopLevelDeclaration{},
+		shadowedBuiltins: map[string]bool{},
 	}
 }
 
+// Copies the state, so that it can be restored after analyzing declarations that are discarded.
+func (s *State) clone() *State {
+	return &State{
+		registeredClosures:   maps.Clone(s.registeredClosures),
+		closureTemplates:     maps.Clone(s.closureTemplates),
+		registeredTypeValues: maps.Clone(s.registeredTypeValues),
+		Spans: &SpanTable{
+			lines:      maps.Clone(s.Spans.lines),
+			rawStrings: slices.Clone(s.Spans.rawStrings),
+		},
+		uses:             maps.Clone(s.uses),
+		rawOutputs:       slices.Clone(s.rawOutputs),
+		shadowedBuiltins: maps.Clone(s.shadowedBuiltins),
+	}
+}
+
+type sourceLine struct {
+	File string
+	Line int
+}
+
+// Maps the locations of C++ diagnostics, which refer to Yune source through `#line` directives,
+// back to the constructs they were lowered from.
+type SpanTable struct {
+	// The first span recorded on each line, which is the outermost statement.
+	lines      map[sourceLine]Span
+	rawStrings []*RawString
+}
+
+// Lowers a span to a `#line` directive, so that C++ compiler errors and debuggers refer to the Yune source.
+// Returns an empty string for spans without a location, such as those of generated nodes.
+func (s *State) lowerLineDirective(span Span) cpp.Statement {
+	if span.File == "" || span.Line <= 0 {
+		return ""
+	}
+	line := sourceLine{span.File, span.Line}
+	if _, exists := s.Spans.lines[line]; !exists {
+		s.Spans.lines[line] = span
+	}
+	return cpp.LineDirective(span.File, span.Line)
+}
+
+// Lowers a raw C++ block, prefixed by a `#line` directive so that its lines keep their Yune line numbers.
+func (s *State) lowerRawString(r *RawString) cpp.Expression {
+	if r.Span.File == "" || r.Span.Line <= 0 {
+		return r.string
+	}
+	if !slices.Contains(s.Spans.rawStrings, r) {
+		s.Spans.rawStrings = append(s.Spans.rawStrings, r)
+	}
+	return cpp.LineDirective(r.Span.File, r.Span.Line) + r.string
+}
+
+// Finds the construct that a diagnostic originates from.
+// Returns false if the diagnostic does not refer to Yune source.
+func (t *SpanTable) Blame(d cpp.Diagnostic) (err CppError, ok bool) {
+	for _, r := range t.rawStrings {
+		lastLine := r.Span.Line + strings.Count(r.string, "\n")
+		if r.Span.File == d.File && r.Span.Line <= d.Line && d.Line <= lastLine {
+			return CppError{Message: d.Message, At: r.Span, InRawString: true}, true
+		}
+	}
+	if span, exists := t.lines[sourceLine{d.File, d.Line}]; exists {
+		return CppError{Message: d.Message, At: span}, true
+	}
+	// a line without a directive of its own, e.g. a closing brace,
+	// whose source is taken from the closest recorded line before it, or else after it
+	var closest *Span
+	for line, span := range t.lines {
+		if line.File != d.File {
+			continue
+		}
+		if closest == nil || isCloser(span.Line, closest.Line, d.Line) {
+			closest = &span
+		}
+	}
+	if closest == nil {
+		return
+	}
+	return CppError{
+		Message: d.Message,
+		At:      Span{File: d.File, Source: closest.Source, Line: d.Line, Column: 1},
+	}, true
+}
+
+// Whether `line` is closer to `target` than `other`, preferring lines before the target.
+func isCloser(line int, other int, target int) bool {
+	if (line <= target) != (other <= target) {
+		return line <= target
+	}
+	return max(line-target, target-line) < max(other-target, target-other)
+}
+
+// Translates the errors reported by clang into Yune errors.
+// Errors that do not refer to Yune source are blamed on `fallback`, e.g. those reported by clang-repl,
+// unless it is empty, in which case the original CompileError is returned.
+func (t *SpanTable) Translate(compileError cpp.CompileError, fallback Span) (errors Errors) {
+	for _, d := range compileError.Diagnostics {
+		if !d.IsError() {
+			continue
+		}
+		if err, ok := t.Blame(d); ok {
+			errors = append(errors, err)
+		} else if fallback.File != "" {
+			errors = append(errors, CppError{Message: d.Message, At: fallback})
+		}
+	}
+	if len(errors) == 0 {
+		if fallback.File != "" {
+			return Errors{CppError{Message: compileError.Output, At: fallback}}
+		}
+		return Errors{compileError}
+	}
+	return
+}
+
 var invalidIdentifierChar = regexp.MustCompile("[^a-zA-Z_0-9]")
 
 // Maps an arbitrary string to a valid C identifier, except that it may also be a C keyword.
@@ -93,6 +93,8 @@ type Assignment struct {
 	Body        Block
 	HasCaptures bool
 	targetType  TypeValue
+	// Whether the target is a global variable instead of a local one.
+	isGlobal bool
 }
 
 func (a *Assignment) GetSpan() Span {
@@ -102,6 +104,7 @@ func (a *Assignment) GetSpan() Span {
 // Analyze implements Statement.
 func (a *Assignment) Analyze(expected TypeValue, anal Analyzer) TypeValue {
 	a.targetType = a.Target.Analyze(nil, anal)
+	_, a.isGlobal = anal.Table.resolve(a.Target.Name.String).(TopLevelDeclaration)
 	scope := anal.NewScope()
 	bodyType := a.Body.Analyze(a.targetType, scope)
 	if !IsSubType(bodyType, a.targetType) {
@@ -115,8 +118,13 @@ func (a *Assignment) Analyze(expected TypeValue, anal Analyzer) TypeValue {
 	return &TupleType{}
 }
 
-func (a *Assignment) GetFlags() Flags {
-	return a.Body.GetFlags()
+// Assigning a global variable is a side effect, so e.g. evaluations that do so are not cached.
+func (a *Assignment) GetFlags() (flags Flags) {
+	flags = a.Body.GetFlags()
+	if a.isGlobal {
+		flags |= IMPURE
+	}
+	return
 }
 
 // Lower implements Statement.
@@ -146,6 +154,66 @@ const (
 	DivideAssign   AssignmentOp = "/="
 )
 
+// Assignment to a list element: `xs[i] = value`.
+type IndexAssignment struct {
+	Span        Span
+	Target      Variable
+	Index       Expression
+	Op          AssignmentOp
+	Body        Block
+	HasCaptures bool
+	elementType TypeValue
+}
+
+func (a *IndexAssignment) GetSpan() Span {
+	return a.Span
+}
+
+// Analyze implements Statement.
+func (a *IndexAssignment) Analyze(expected TypeValue, anal Analyzer) TypeValue {
+	targetType := a.Target.Analyze(nil, anal)
+	listType, isListType := targetType.(*ListType)
+	if !isListType {
+		anal.ReportError(ExpectedList{
+			Found: targetType,
+			At:    a.Target.GetSpan(),
+		})
+	}
+	checkIsIndex(a.Index.Analyze(&IntType{}, anal), a.Index.GetSpan(), anal)
+	a.elementType = listType.Element
+	scope := anal.NewScope()
+	bodyType := a.Body.Analyze(a.elementType, scope)
+	if !IsSubType(bodyType, a.elementType) {
+		anal.ReportError(AssignmentTypeMismatch{
+			Expected: a.elementType,
+			Found:    bodyType,
+			At:       a.Body.GetSpan(),
+		})
+	}
+	a.HasCaptures = len(*scope.Table.localCaptures) > 0
+	return &TupleType{}
+}
+
+func (a *IndexAssignment) GetFlags() Flags {
+	return a.Index.GetFlags() | a.Body.GetFlags()
+}
+
+// Lower implements Statement.
+func (a *IndexAssignment) Lower(state *State, isLast bool) cpp.Statement {
+	// index_ returns a reference to the element when indexing a list variable
+	lowered := fmt.Sprintf(`index_(%s, %s, %s) %s %s;`,
+		a.Target.Name.Lower(),
+		a.Index.Lower(state),
+		a.Span.Lower(),
+		a.Op,
+		cpp.LambdaBlock(a.Body.Lower(state), a.elementType.LowerType(), a.HasCaptures),
+	)
+	if isLast {
+		lowered += "\nreturn std::make_tuple();"
+	}
+	return lowered
+}
+
 // Always the last statement in a list, since the remaining
 // statements in a block are is in its .Else field.
 type BranchStatement struct {
@@ -267,12 +335,12 @@ func (b *IsBranchStatement) Lower(state *State, isLast bool) cpp.Statement {
 		return fmt.Sprintf(
 			`auto %s = %s;
 if (isSubset_<%s%s>(%s)) {
-    auto %s = getSubset_<%s%s>(%s);
+    auto %s = getSubset_<%s%s>(%s, %s);
     %s
 } else %s`,
 			name, b.Expression.Lower(state),
 			expressionType, isTypes, name,
-			b.Name.Lower(), expressionType, isTypes, name,
+			b.Name.Lower(), expressionType, isTypes, name, b.GetSpan().Lower(),
 			strings.Join(b.Then.Lower(state), "\n"),
 			cpp.Block(b.Else.Lower(state)),
 		)
@@ -281,12 +349,12 @@ if (isSubset_<%s%s>(%s)) {
 		return fmt.Sprintf(
 			`auto %s = %s;
 if (isVariant_<%s, %s>(%s)) {
-    auto %s = getVariant_<%s, %s>(%s);
+    auto %s = getVariant_<%s, %s>(%s, %s);
     %s
 } else %s`,
 			name, b.Expression.Lower(state),
 			expressionType, isType, name,
-			b.Name.Lower(), expressionType, isType, name,
+			b.Name.Lower(), expressionType, isType, name, b.GetSpan().Lower(),
 			strings.Join(b.Then.Lower(state), "\n"),
 			cpp.Block(b.Else.Lower(state)),
 		)
@@ -339,6 +407,9 @@ func (b *Block) GetFlags() (flags Flags) {
 func (b *Block) Lower(state *State) (statements []cpp.Statement) {
 	for i, stmt := range b.Statements {
 		isLast := i+1 == len(b.Statements)
+		if directive := state.lowerLineDirective(stmt.GetSpan()); directive != "" {
+			statements = append(statements, directive)
+		}
 		statements = append(statements, stmt.Lower(state, isLast))
 	}
 	return
@@ -432,6 +503,7 @@ func UnmarshalStatement(data *fj.Value, in *Macro) (stmt Statement) {
 
 var _ Statement = &VariableDeclaration{}
 var _ Statement = &Assignment{}
+var _ Statement = &IndexAssignment{}
 var _ Statement = &BranchStatement{}
 var _ Statement = &IsBranchStatement{}
 var _ Statement = &ExpressionStatement{}
@@ -92,6 +92,8 @@ func (d *FunctionDeclaration) Analyze(anal Analyzer) {
 		return // already (being) analyzed
 	}
 	anal = anal.NewScope()
+	uses := []TopLevelDeclaration{}
+	anal.uses = &uses
 	if err := anal.Table.Add(d); err != nil {
 		panic("Duplicate declaration error in new scope: " + err.Error())
 	}
@@ -100,31 +102,43 @@ func (d *FunctionDeclaration) Analyze(anal Analyzer) {
 	anal.Declare(d)
 	analyzeFunctionBody(anal, d.ReturnType.Get(), d.Body)
 	declaredType := d.GetDeclaredType()
-	if d.GetName().String == "main" && !declaredType.Eq(MainType) {
+	if d.GetName().String == "main" && !declaredType.Eq(MainType) && !declaredType.Eq(MainWithArgumentsType) {
 		anal.ReportError(InvalidMainSignature{
 			Found: d.GetDeclaredType(),
 			At:    d.Name.GetSpan(),
 		})
 	}
+	anal.State.uses[d] = uses
 	anal.Define(d)
 }
 
 // LowerDeclaration implements TopLevelDeclaration.
 func (d *FunctionDeclaration) LowerDeclaration(state *State) cpp.Declaration {
 	params := util.JoinFunc(d.Parameters, ", ", FunctionParameter.Lower)
-	return fmt.Sprintf(`struct %s_ {
+	return fmt.Sprintf(`struct %s {
     %s operator()(%s) const;
     std::string toJson_() const;
-} %s;`, d.Name.String, d.ReturnType.Lower(), params, d.Name.Lower())
+} inline %s;`, d.lowerStructName(), d.ReturnType.Lower(), params, d.Name.Lower())
+}
+
+// The C++ struct of the function, whose operator() is called through the instance named by Name.Lower.
+func (d *FunctionDeclaration) lowerStructName() string {
+	// named after the lowered name, since e.g. `toJson_` would conflict with its own toJson_ member
+	if _, shadowable := shadowableBuiltins[d.Name.String]; shadowable {
+		return d.Name.Lower() + "_"
+	}
+	return d.Name.String + "_"
 }
 
 // LowerDefinition implements TopLevelDeclaration.
 func (d *FunctionDeclaration) LowerDefinition(state *State) cpp.Definition {
 	params := util.JoinFunc(d.Parameters, ", ", FunctionParameter.Lower)
-	return fmt.Sprintf(`inline %s %s_::operator()(%s) const %s
-inline std::string %s_::toJson_() const {
+	// records the call on the Yune call stack, which is printed on panic
+	callStackGuard := fmt.Sprintf(`CallStackGuard_ callStackGuard_(%q, %s);`, d.Name.String, d.Name.Span.Lower())
+	body := append([]cpp.Statement{callStackGuard}, d.Body.Lower(state)...)
+	return fmt.Sprintf(`%sYUNE_INLINE %s %s::operator()(%s) const %s%sYUNE_INLINE std::string %s::toJson_() const {
     return R"({ "Function": "%s" })";
-}`, d.ReturnType.Lower(), d.Name.String, params, cpp.Block(d.Body.Lower(state)), d.Name.String, d.Name.String)
+}`, state.lowerLineDirective(d.Name.Span), d.ReturnType.Lower(), d.lowerStructName(), params, cpp.Block(body), cpp.GeneratedLineDirective(), d.lowerStructName(), d.Name.String)
 }
 
 func (d FunctionDeclaration) GetName() Name {
@@ -192,6 +206,9 @@ func (d *ConstantDeclaration) Analyze(anal Analyzer) {
 	}
 	if d.Type.Get() != nil {
 		_, isAnalyzed := anal.Defined[d]
+		if !isAnalyzed && anal.Batch.isUsedBy(d) {
+			return // evaluated with the batch
+		}
 		if !isAnalyzed {
 			anal.ReportError(CyclicDependency{In: d})
 		}
@@ -199,6 +216,8 @@ func (d *ConstantDeclaration) Analyze(anal Analyzer) {
 	}
 	declaredType := d.Type.Analyze(anal)
 	scope := anal.NewScope()
+	uses := []TopLevelDeclaration{}
+	scope.uses = &uses
 	bodyType := d.Body.Analyze(declaredType, scope)
 
 	if !IsSubType(bodyType, declaredType) {
@@ -214,8 +233,8 @@ func (d *ConstantDeclaration) Analyze(anal Analyzer) {
 		})
 	}
 	hasCaptures := len(*scope.Table.localCaptures) > 0
-	d.value = anal.Evaluate(cpp.LambdaBlock(d.Body.Lower(anal.State), declaredType.LowerType(), hasCaptures), nil)
-	anal.Define(d)
+	anal.State.uses[d] = uses
+	anal.evaluateConstant(d, ConstantEvaluation{Body: d.Body, Type: declaredType, HasCaptures: hasCaptures, Uses: uses})
 }
 
 func (d *ConstantDeclaration) GetFlags() Flags {
@@ -230,7 +249,7 @@ func (d ConstantDeclaration) LowerDeclaration(state *State) cpp.Declaration {
 // LowerDefinition implements TopLevelDeclaration.
 func (d ConstantDeclaration) LowerDefinition(state *State) cpp.Definition {
 	return fmt.Sprintf(
-		"inline %s %s(%s);",
+		"YUNE_INLINE %s %s(%s);",
 		d.Type.Lower(), d.Name.Lower(), state.lowerExpressionValue(d.value),
 	)
 }
@@ -1,6 +1,7 @@
 package ast
 
 import (
+	"slices"
 	"yune/cpp"
 
 	fj "github.com/valyala/fastjson"
@@ -40,7 +41,11 @@ func (t *Type) Analyze(anal Analyzer) TypeValue {
 		})
 	}
 	t.beingAnalyzed = true
-	expressionType := t.Expression.Analyze(&TypeType{}, anal.TopLevel())
+	// type expressions rarely use constants, so the batch is only evaluated first if necessary
+	uses := []TopLevelDeclaration{}
+	typeAnal := anal.TopLevel()
+	typeAnal.uses = &uses
+	expressionType := t.Expression.Analyze(&TypeType{}, typeAnal)
 	// TODO: check if expressionType is part of the union TypeType rather than equal
 	// (is this necessary?)
 	if !expressionType.Eq(&TypeType{}) {
@@ -50,7 +55,10 @@ func (t *Type) Analyze(anal Analyzer) TypeValue {
 			At:       t.Expression.GetSpan(),
 		})
 	}
-	json := anal.Evaluate(t.Expression.Lower(anal.State), nil)
+	if slices.ContainsFunc(uses, anal.Batch.isUsedBy) {
+		anal.EvaluateBatch()
+	}
+	json := anal.evaluate(TypeEvaluation{Expression: t.Expression, Uses: uses}, t.Expression.GetSpan())
 	t.value = anal.State.UnmarshalTypeValue(json)
 	t.beingAnalyzed = false
 	return t.value
@@ -13,6 +13,13 @@ var MainType = &FnType{
 	Return:   &TupleType{},
 }
 
+// Alternative signature of main that receives the command-line arguments
+// and returns the exit status.
+var MainWithArgumentsType = &FnType{
+	Argument: &ListType{Element: &StringType{}},
+	Return:   &IntType{},
+}
+
 func literalType(name string, _type TypeValue) TypeValue {
 	return &StructType{
 		Name: name,
@@ -33,6 +40,9 @@ var StringLiteralType = literalType("StringLiteral", &StringType{})
 var ExpressionType = &StructType{Name: "Expression", Fields: []StructTypeField{}}
 var StatementType = &StructType{Name: "Statement", Fields: []StructTypeField{}}
 
+// opaque type for errors returned by builtins, see `errorMessage`
+var ErrorType = &StructType{Name: "Error", Fields: []StructTypeField{}}
+
 var ParameterType = &StructType{Name: "FunctionParameter", Fields: []StructTypeField{}}
 var BlockType = &ListType{Element: StatementType}
 
@@ -185,6 +195,53 @@ func (l ListType) LowerValue() cpp.Value {
 	return "box_f(ListType_t{ .element = " + l.Element.LowerValue() + " })"
 }
 
+type MapType struct {
+	DefaultTypeValue
+	Key   TypeValue
+	Value TypeValue
+}
+
+func (m MapType) String() string {
+	return "Map(" + m.Key.String() + ", " + m.Value.String() + ")"
+}
+
+func (m *MapType) Eq(other TypeValue) bool {
+	otherMap, ok := other.(*MapType)
+	return ok && m.Key.Eq(otherMap.Key) && m.Value.Eq(otherMap.Value)
+}
+func (m MapType) LowerType() cpp.Type {
+	return "Map_t<" + m.Key.LowerType() + ", " + m.Value.LowerType() + ">"
+}
+func (m MapType) LowerValue() cpp.Value {
+	return "box_f(MapType_t{ .key = " + m.Key.LowerValue() + ", .value = " + m.Value.LowerValue() + " })"
+}
+
+// Returns whether values of this type can be used as map keys,
+// which requires them to be ordered in C++.
+// Floats are not allowed, since NaN is not ordered, which breaks the ordering of `std::map`.
+func IsMapKeyType(t TypeValue) bool {
+	switch t := t.(type) {
+	case *IntType, *BoolType, *StringType:
+		return true
+	case *TupleType:
+		return util.All(t.Elements, IsMapKeyType)
+	default:
+		return false
+	}
+}
+
+// Returns whether values of this type are ordered in C++, so that they can be sorted without a comparison function.
+func IsOrderedType(t TypeValue) bool {
+	switch t := t.(type) {
+	case *IntType, *FloatType, *BoolType, *StringType:
+		return true
+	case *TupleType:
+		return util.All(t.Elements, IsOrderedType)
+	default:
+		return false
+	}
+}
+
 type FnType struct {
 	DefaultTypeValue
 	Argument TypeValue
@@ -228,7 +285,7 @@ func (s StructTypeField) String() string {
 }
 
 func (s StructTypeField) LowerValue() cpp.Type {
-	return fmt.Sprintf(`{%s, %s}`, s.Name, s.Type.LowerValue())
+	return fmt.Sprintf(`{String_t(%q), %s}`, s.Name, s.Type.LowerValue())
 }
 
 type StructType struct {
@@ -251,7 +308,7 @@ func (s StructType) LowerType() cpp.Type {
 }
 func (s StructType) LowerValue() cpp.Type {
 	return fmt.Sprintf(
-		`box_f(StructType_t{ .name = %s, .fields = { %s }  })`,
+		`box_f(StructType_t{ .name = String_t(%q), .fields = { %s }  })`,
 		s.Name, util.JoinFunc(s.Fields, ", ", StructTypeField.LowerValue),
 	)
 }
@@ -330,6 +387,42 @@ func NewUnionType(variants ...TypeValue) TypeValue {
 	return &UnionType{Variants: uniqueVariants}
 }
 
+// Marshals a TypeValue in the format of `toJson_` in pb.hpp, which UnmarshalTypeValue reads.
+func MarshalTypeValue(t TypeValue) string {
+	marshalTypeValues := func(types []TypeValue) string {
+		return "[" + util.JoinFunc(types, ", ", MarshalTypeValue) + "]"
+	}
+	switch t := t.(type) {
+	case *TypeType:
+		return `{ "TypeType": {} }`
+	case *IntType:
+		return `{ "IntType": {} }`
+	case *FloatType:
+		return `{ "FloatType": {} }`
+	case *BoolType:
+		return `{ "BoolType": {} }`
+	case *StringType:
+		return `{ "StringType": {} }`
+	case *TupleType:
+		return fmt.Sprintf(`{ "TupleType": { "elements": %s } }`, marshalTypeValues(t.Elements))
+	case *ListType:
+		return fmt.Sprintf(`{ "ListType": { "element": %s } }`, MarshalTypeValue(t.Element))
+	case *MapType:
+		return fmt.Sprintf(`{ "MapType": { "key": %s, "value": %s } }`, MarshalTypeValue(t.Key), MarshalTypeValue(t.Value))
+	case *FnType:
+		return fmt.Sprintf(`{ "FnType": { "argument": %s, "returnType": %s } }`, MarshalTypeValue(t.Argument), MarshalTypeValue(t.Return))
+	case *StructType:
+		fields := util.JoinFunc(t.Fields, ", ", func(field StructTypeField) string {
+			return fmt.Sprintf(`{ "name": %q, "type": %s }`, field.Name, MarshalTypeValue(field.Type))
+		})
+		return fmt.Sprintf(`{ "StructType": { "name": %q, "fields": [%s] } }`, t.Name, fields)
+	case *UnionType:
+		return fmt.Sprintf(`{ "UnionType": { "variants": %s } }`, marshalTypeValues(t.Variants))
+	default:
+		panic(fmt.Sprintf("unexpected TypeValue when marshalling: %#v", t))
+	}
+}
+
 // Tries to unmarshal a TypeValue, returning nil if the union key does not match an Expression.
 func (state *State) UnmarshalTypeValue(data *fj.Value) (t TypeValue) {
 	key, v := fjUnmarshalStruct(data.GetObject())
@@ -352,6 +445,11 @@ func (state *State) UnmarshalTypeValue(data *fj.Value) (t TypeValue) {
 		t = &ListType{
 			Element: state.UnmarshalTypeValue(v.Get("element")),
 		}
+	case "MapType":
+		t = &MapType{
+			Key:   state.UnmarshalTypeValue(v.Get("key")),
+			Value: state.UnmarshalTypeValue(v.Get("value")),
+		}
 	case "FnType":
 		t = &FnType{
 			Argument: state.UnmarshalTypeValue(v.Get("argument")),
@@ -386,12 +484,18 @@ func (state *State) getObjectValueType(object *fj.Object) TypeValue {
 	key, v := fjUnmarshalStruct(object)
 	switch key {
 	case "TypeType", "IntType", "FloatType", "BoolType",
-		"StringType", "TupleType", "ListType", "FnType",
+		"StringType", "TupleType", "ListType", "MapType", "FnType",
 		"StructType", "UnionType", "TypeId":
 		return &TypeType{}
 	case "Tuple":
 		elementTypes := util.Map(UnmarshalArray(v, "elements"), state.getValueType)
 		return &TupleType{Elements: elementTypes}
+	case "Map":
+		keyTypes, valueTypes := util.Map2(UnmarshalArray(v, "entries"), func(entry *fj.Value) (TypeValue, TypeValue) {
+			elements := UnmarshalTuple(entry)
+			return state.getValueType(elements[0]), state.getValueType(elements[1])
+		})
+		return &MapType{Key: NewUnionType(keyTypes...), Value: NewUnionType(valueTypes...)}
 	case "IntegerExpression", "FloatExpression", "BoolExpression", "StringExpression",
 		"VariableExpression", "FunctionCallExpression", "ListExpression", "TupleExpression",
 		"MacroExpression", "UnaryExpression", "BinaryExpression", "StructExpression", "ClosureExpression":
@@ -400,6 +504,8 @@ func (state *State) getObjectValueType(object *fj.Object) TypeValue {
 		return state.registeredTypeValues[string(v.GetStringBytes())]
 	case "Box":
 		return state.getValueType(v)
+	case "Float":
+		return &FloatType{}
 	default:
 		return &StructType{Name: key}
 	}
@@ -435,6 +541,7 @@ var _ TypeValue = (*BoolType)(nil)
 var _ TypeValue = (*StringType)(nil)
 var _ TypeValue = (*TupleType)(nil)
 var _ TypeValue = (*ListType)(nil)
+var _ TypeValue = (*MapType)(nil)
 var _ TypeValue = (*FnType)(nil)
 var _ TypeValue = (*StructType)(nil)
 var _ TypeValue = (*UnionType)(nil)
@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"testing"
+	"yune/cpp"
+)
 
 // Parse-only benchmark for the standard library
 func BenchmarkParseStandardLibrary(b *testing.B) {
@@ -14,6 +17,6 @@ func BenchmarkParseStandardLibrary(b *testing.B) {
 // Parse+analyse benchmark for the standard library
 func BenchmarkCompileStandardLibrary(b *testing.B) {
 	for b.Loop() {
-		runModuleFromFile("std.un")
+		runModuleFromFile("std.un", nil, cpp.BuildOptions{})
 	}
 }
@@ -1,9 +1,16 @@
 package cpp
 
 import (
+	"embed"
+	"fmt"
 	"strings"
 )
 
+// The runtime headers, which generated code includes from BuildOptions.RuntimeDir.
+//
+//go:embed pb.hpp ipc.hpp
+var RuntimeHeaders embed.FS
+
 type Value = string
 type Type = string
 
@@ -26,6 +33,20 @@ func String(s string) string {
 
 type Expression = string
 
+// A `#line` directive, which makes the C++ compiler attribute the following lines to the given source file.
+// It is surrounded by newlines, since directives must be on their own line.
+func LineDirective(file string, line int) Statement {
+	return fmt.Sprintf("\n#line %d %q\n", line, file)
+}
+
+// The file that generated code is attributed to, so that it is not attributed to the Yune source before it.
+const GeneratedFile = "<generated>"
+
+// A `#line` directive that ends the effect of the directives before it, for code that is not lowered from Yune source.
+func GeneratedLineDirective() Statement {
+	return LineDirective(GeneratedFile, 1)
+}
+
 func Block(b []Statement) string {
 	return "{\n" + strings.Join(b, "\n") + "\n}"
 }
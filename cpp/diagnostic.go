@@ -0,0 +1,70 @@
+package cpp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A diagnostic reported by clang++ or clang-repl.
+// Thanks to `#line` directives, `File` and `Line` refer to Yune source if the code was generated from Yune.
+type Diagnostic struct {
+	File     string
+	Line     int
+	Column   int
+	Severity string
+	Message  string
+}
+
+func (d Diagnostic) IsError() bool {
+	return d.Severity != "warning"
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s", d.File, d.Line, d.Column, d.Severity, d.Message)
+}
+
+// Matches e.g. `main.un:4:8: error: use of undeclared identifier 'y'`.
+var diagnosticPattern = regexp.MustCompile(`^(.+?):(\d+):(\d+): (error|fatal error|warning): (.*)$`)
+
+// Extracts the errors and warnings from the output of clang.
+// Notes and source excerpts are skipped, since they refer to generated C++.
+func ParseDiagnostics(output string) (diagnostics []Diagnostic) {
+	for _, line := range strings.Split(output, "\n") {
+		match := diagnosticPattern.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if match == nil {
+			continue
+		}
+		lineNumber, _ := strconv.Atoi(match[2])
+		column, _ := strconv.Atoi(match[3])
+		diagnostics = append(diagnostics, Diagnostic{
+			File:     match[1],
+			Line:     lineNumber,
+			Column:   column,
+			Severity: match[4],
+			Message:  match[5],
+		})
+	}
+	return
+}
+
+// Returned when clang++ or clang-repl fails to compile generated code.
+type CompileError struct {
+	Diagnostics []Diagnostic
+	// The raw output of the compiler, used if no diagnostics could be parsed.
+	Output string
+}
+
+func (e CompileError) Error() string {
+	messages := []string{}
+	for _, d := range e.Diagnostics {
+		if d.IsError() {
+			messages = append(messages, d.String())
+		}
+	}
+	if len(messages) == 0 {
+		return "C++ compilation failed:\n" + e.Output
+	}
+	return "C++ compilation failed:\n" + strings.Join(messages, "\n")
+}
@@ -8,7 +8,12 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	fj "github.com/valyala/fastjson"
 )
@@ -23,70 +28,242 @@ func newLogFile() *os.File {
 	return file
 }
 
-type ProxyStderr struct{}
+// Forwards the stderr of clang-repl, collecting its diagnostics.
+// When clang-repl fails to parse its input, the interpreter is stopped with a CompileError.
+type ProxyStderr struct {
+	interpreter *Interpreter
+	// The output that may belong to the diagnostics of an input that failed to parse.
+	output strings.Builder
+	lock   sync.Mutex
+}
 
 // Write implements io.Writer.
-func (ProxyStderr) Write(p []byte) (n int, err error) {
+func (w *ProxyStderr) Write(p []byte) (n int, err error) {
 	n, err = os.Stderr.Write(p)
 	if err != nil {
 		return
 	}
-	if strings.Contains(string(p), "error: Parsing failed.") {
-		err = fmt.Errorf("clang-repl returned an error, stopping evaluation.")
-		// NOTE: using this for now since errors returned from this function are simply ignored
-		log.Fatalf("%s", err)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.output.Write(p)
+	output := w.output.String()
+	if strings.Contains(output, "error: Parsing failed.") {
+		w.interpreter.fail(CompileError{
+			Diagnostics: ParseDiagnostics(output),
+			Output:      output,
+		})
+		w.output.Reset()
+	} else if !strings.Contains(output, "error") {
+		w.output.Reset()
 	}
 	return
 }
 
-var _ io.Writer = ProxyStderr{}
+// Discards the output so far, which is called once clang-repl has parsed every input that was written.
+func (w *ProxyStderr) reset() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.output.Reset()
+}
+
+var _ io.Writer = &ProxyStderr{}
+
+// Environment variable that passes the path of the compiler's socket to ipc.hpp.
+const CompilerSocketVariable = "YUNE_COMPILER_SOCKET"
+
+// How long clang-repl may take to start and connect to the compiler, which includes parsing pb.hpp.
+const startTimeout = time.Minute
 
-// should be unused according to https://en.wikipedia.org/wiki/List_of_TCP_and_UDP_port_numbers
-// (synchronised with ipc.hpp)
-const YuneCompilerPort = 11555
+// How long clang-repl may keep running after its connection is closed, before it is killed.
+const exitTimeout = time.Second
 
-func NewInterpreter() *Interpreter {
+// Starts clang-repl, compiling with the given options.
+// Sanitizers, debug information and linker flags only apply to executables.
+func NewInterpreter(options BuildOptions) *Interpreter {
 	// Create connection
-	// TODO: close connection at some point
-	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", YuneCompilerPort))
+	// The socket is placed in a private directory, so that concurrent compilers do not collide
+	// and other users cannot connect to it.
+	socketDir, err := os.MkdirTemp("", "yune-")
 	if err != nil {
-		log.Fatalln("Failed to start TCP connection with clang-repl. Error:", err)
+		log.Fatalln("Failed to create directory for the clang-repl socket. Error:", err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(socketDir, "compiler.sock"))
+	if err != nil {
+		os.RemoveAll(socketDir)
+		log.Fatalln("Failed to open socket for clang-repl. Error:", err)
+	}
+	r := &Interpreter{
+		options:   options,
+		listener:  listener,
+		socketDir: socketDir,
+		logFile:   newLogFile(),
+		Declared:  `#include "pb.hpp"` + "\n",
 	}
+	r.start()
+	return r
+}
+
+// Starts the clang-repl process and waits for ipc.hpp to connect.
+func (r *Interpreter) start() {
+	r.inputs = 0
 	// Start REPL and setup inputs/outputs
-	cmd := exec.Command("clang-repl", "-Xcc=-std=c++23", os.ExpandEnv("-Xcc=-I$PWD/cpp"))
+	arguments := []string{}
+	for _, flag := range r.options.compilerFlags() {
+		arguments = append(arguments, "-Xcc="+flag)
+	}
+	cmd := exec.Command("clang-repl", arguments...)
+	cmd.Env = append(os.Environ(), CompilerSocketVariable+"="+r.listener.Addr().String())
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		log.Fatalln("Failed to get stdin pipe from clang-repl command. Error:", err)
 	}
+	r.writer = stdin
+	r.command = cmd
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = ProxyStderr{}
+	r.stderr = &ProxyStderr{interpreter: r}
+	cmd.Stderr = r.stderr
 	if err = cmd.Start(); err != nil {
 		log.Fatalln("Failed to run clang-repl. Error:", err)
 	}
-	r := &Interpreter{
-		writer:   stdin,
-		reader:   nil, // set later
-		command:  cmd,
-		listener: listener,
-		logFile:  newLogFile(),
-		Declared: "",
-	}
-	if err = r.Declare(os.ExpandEnv(`#include "pb.hpp"`)); err != nil {
+	if err = setResourceLimits(cmd.Process.Pid, r.options); err != nil {
+		log.Println("Failed to limit the resources of clang-repl. Error:", err)
+	}
+	if err = r.write(`#include "pb.hpp"`); err != nil {
 		log.Fatalln("Failed to declare PB header through clang-repl. Error:", err)
 	}
-	if err = r.Write(os.ExpandEnv(`#include "ipc.hpp"`) + "\n"); err != nil {
+	if err = r.write(`#include "ipc.hpp"`); err != nil {
 		log.Fatalln("Failed to declare IPC header through clang-repl. Error:", err)
 	}
-	if err = r.Write("#include <thread>\n"); err != nil {
+	if err = r.write("#include <thread>"); err != nil {
 		log.Fatalln("Failed to declare Yune evaluator-specific C++ includes. Error:", err)
 	}
-	// have ipc.hpp connect
-	conn, err := listener.Accept()
+	for _, library := range r.options.Libraries {
+		if err = r.write(fmt.Sprintf("%%lib lib%s.so", library)); err != nil {
+			log.Fatalf("Failed to load library '%s' in clang-repl. Error: %s\n", library, err)
+		}
+	}
+	// have ipc.hpp connect, which never happens if clang-repl fails to start
+	deadline := time.Now().Add(startTimeout)
+	r.listener.(*net.UnixListener).SetDeadline(deadline)
+	conn, err := r.listener.Accept()
+	if err != nil {
+		log.Fatalf("Failed to accept connection from clang-repl within %s. Error: %s\n", startTimeout, err)
+	}
+	r.conn = conn
 	r.reader = bufio.NewReader(conn)
-	return r
+	conn.SetReadDeadline(deadline)
+	hello, err := readMessage(r.reader)
+	if err != nil {
+		log.Fatalln("Failed to read the protocol version from clang-repl. Error:", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if hello.Type != "hello" {
+		log.Fatalf("Expected 'hello' message from clang-repl, found: '%s'.\n", hello.Value)
+	}
+	if version := hello.Value.GetInt("version"); version != ProtocolVersion {
+		log.Fatalf("clang-repl uses protocol version %d but the compiler uses version %d; the runtime headers in '%s' are out of date.\n",
+			version, ProtocolVersion, r.options.RuntimeDir)
+	}
+}
+
+// Kills clang-repl, which has exceeded a limit or crashed, and starts a new one with the same declarations.
+func (r *Interpreter) restart() {
+	log.Println("Restarting clang-repl...")
+	r.writer.Close()
+	r.conn.Close()
+	r.command.Process.Kill()
+	r.command.Wait()
+	r.start()
+	for i, text := range r.history {
+		if i == r.checkpoint.history {
+			r.checkpoint.inputs = r.inputs
+		}
+		if err := r.write(text); err != nil {
+			log.Fatalln("Failed to restore declarations in restarted clang-repl. Error:", err)
+		}
+	}
+	if len(r.history) == r.checkpoint.history {
+		r.checkpoint.inputs = r.inputs
+	}
+}
+
+// Returned when an evaluation is stopped because clang-repl exceeded a limit or crashed.
+// clang-repl is restarted, so that later evaluations can continue.
+type EvaluationAborted struct {
+	Reason string
 }
 
+func (e EvaluationAborted) Error() string {
+	return e.Reason
+}
+
+// Returned when an evaluation panics or throws a C++ exception, which ipc.hpp catches.
+// Unlike an EvaluationAborted error, clang-repl keeps running.
+type EvaluationPanic struct {
+	// Whether a C++ exception was thrown, rather than a Yune panic.
+	Exception bool
+	Message   string
+	// The Yune functions that were being executed, most recent first, e.g. "lastElement (main.un:2:1)".
+	CallStack []string
+}
+
+func (e EvaluationPanic) Error() string {
+	message := "panic: " + e.Message
+	if e.Exception {
+		message = "uncaught C++ exception: " + e.Message
+	}
+	if len(e.CallStack) > 0 {
+		message += "\ncall stack (most recent call first):\n    " + strings.Join(e.CallStack, "\n    ")
+	}
+	return message
+}
+
+// Describes why reading from clang-repl failed and restarts it.
+func (r *Interpreter) abort(err error) error {
+	var reason string
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		reason = fmt.Sprintf("Evaluation exceeded the time limit of %s (see -eval-timeout).", r.options.EffectiveEvaluationTimeout())
+	} else {
+		// the connection is closed when clang-repl exits, so it is killed if it keeps running without it
+		exited := make(chan struct{})
+		go func() {
+			r.command.Wait()
+			close(exited)
+		}()
+		killed := false
+		select {
+		case <-exited:
+		case <-time.After(exitTimeout):
+			r.command.Process.Kill()
+			<-exited
+			killed = true
+		}
+		state := r.command.ProcessState
+		status, _ := state.Sys().(syscall.WaitStatus)
+		switch {
+		case killed:
+			reason = fmt.Sprintf("Lost the connection to clang-repl, which was restarted. Error: %s", err)
+		case status.Signaled() && status.Signal() == syscall.SIGXCPU:
+			reason = fmt.Sprintf("clang-repl exceeded the CPU time limit of %s (see -eval-cpu).", limit(r.options.EvaluationCPU, DefaultEvaluationCPU))
+		case status.Signaled() && limit(r.options.EvaluationMemory, DefaultEvaluationMemory) > 0:
+			reason = fmt.Sprintf("clang-repl was stopped by %s, possibly because it exceeded the memory limit of %d MiB (see -eval-memory).",
+				status.Signal(), limit(r.options.EvaluationMemory, DefaultEvaluationMemory))
+		default:
+			reason = fmt.Sprintf("clang-repl exited during evaluation (%s).", state)
+		}
+	}
+	r.restart()
+	return EvaluationAborted{Reason: reason}
+}
+
+// Prepares code to be sent to clang-repl, which reads input line by line.
+// `#line` directives are removed since they cannot be joined with other lines.
 func sanitize(s string) string {
+	lines := strings.Split(s, "\n")
+	lines = slices.DeleteFunc(lines, func(line string) bool {
+		return strings.HasPrefix(strings.TrimSpace(line), "#line ")
+	})
+	s = strings.Join(lines, "\n")
 	s = strings.TrimRight(s, " \n\t")
 	s = strings.ReplaceAll(s, "\n", "\\\n")
 	return s
@@ -94,12 +271,85 @@ func sanitize(s string) string {
 
 // clang-Interpreter wrapper struct
 type Interpreter struct {
+	options  BuildOptions
 	writer   io.WriteCloser
 	reader   *bufio.Reader
 	command  *exec.Cmd
+	stderr   *ProxyStderr
 	listener net.Listener
-	logFile  *os.File
-	Declared string
+	// Private directory containing the socket that the listener accepts on.
+	socketDir string
+	conn      net.Conn
+	logFile   *os.File
+	Declared  string
+	// Text written after startup, which is written again when clang-repl is restarted.
+	history []string
+	// ID of the previous request, which messages from ipc.hpp refer to.
+	requestID int
+	// The number of inputs that clang-repl has parsed since it was started, each of which `%undo` can undo.
+	inputs     int
+	checkpoint interpreterCheckpoint
+	// Set when clang-repl fails to compile its input, after which no results will arrive.
+	failure     error
+	failureLock sync.Mutex
+}
+
+// The state that Interpreter.Rollback returns to.
+type interpreterCheckpoint struct {
+	inputs   int
+	history  int
+	declared string
+}
+
+// Marks the current declarations, which Rollback returns to.
+func (r *Interpreter) Checkpoint() {
+	r.checkpoint = interpreterCheckpoint{
+		inputs:   r.inputs,
+		history:  len(r.history),
+		declared: r.Declared,
+	}
+}
+
+// Undoes everything written, declared and evaluated since the last Checkpoint, using `%undo`.
+// If clang-repl failed to compile its input in the meantime, it is restarted with the declarations up to the checkpoint instead.
+func (r *Interpreter) Rollback() (err error) {
+	r.history = r.history[:r.checkpoint.history]
+	r.Declared = r.checkpoint.declared
+	if r.Failure() != nil {
+		r.failureLock.Lock()
+		r.failure = nil
+		r.failureLock.Unlock()
+		r.restart()
+		return
+	}
+	log.Printf("Undoing %d clang-repl inputs.\n", r.inputs-r.checkpoint.inputs)
+	for range r.inputs - r.checkpoint.inputs {
+		if err = r.write("%undo"); err != nil {
+			return
+		}
+	}
+	r.inputs = r.checkpoint.inputs
+	return
+}
+
+// Stops waiting for results, reporting `err` from all further interactions.
+func (r *Interpreter) fail(err error) {
+	r.failureLock.Lock()
+	defer r.failureLock.Unlock()
+	if r.failure != nil {
+		return
+	}
+	r.failure = err
+	if r.conn != nil {
+		r.conn.Close()
+	}
+}
+
+// The CompileError reported by clang-repl, if any.
+func (r *Interpreter) Failure() error {
+	r.failureLock.Lock()
+	defer r.failureLock.Unlock()
+	return r.failure
 }
 
 func (r *Interpreter) log(message string) {
@@ -118,9 +368,14 @@ func (r *Interpreter) Close() {
 	if err := r.logFile.Close(); err != nil {
 		log.Println("Failed to close interpreter log file. Error:", err)
 	}
+	// the connection is already closed if clang-repl failed
+	r.conn.Close()
 	if err := r.listener.Close(); err != nil {
 		log.Println("Failed to close connection to C++. Error:", err)
 	}
+	if err := os.RemoveAll(r.socketDir); err != nil {
+		log.Println("Failed to remove clang-repl socket directory. Error:", err)
+	}
 	log.Println("Waiting for clang-repl to exit...")
 	if err := r.command.Wait(); err != nil {
 		log.Println("Failed to wait for clang-repl to exit. Error:", err)
@@ -132,81 +387,204 @@ func (r *Interpreter) Close() {
 func (r *Interpreter) Evaluate(expr Expression, getType func(string) (Type, bool)) (output *fj.Value, err error) {
 	// A thread is created and detached because in order to write the result of a getType query
 	// more code needs to be evaluated by the interpreter, which causes a deadlock with only a single thread.
-	text := "std::thread([]() { compiler_connection.yield(toJson_(" + sanitize(expr) + ")); }).detach();\n"
-	r.log(text)
-	_, err = r.writer.Write([]byte(text))
+	// Panics and C++ exceptions are caught by ipc.hpp and reported as an error message.
+	m, err := r.request(func(id int) string {
+		return fmt.Sprintf("std::thread([]() { compiler_connection.evaluate(%d, %s); }).detach();\n", id, evaluationLambda(expr))
+	}, 1, getType)
+	if err == nil {
+		output, err = evaluationResult(m)
+	}
+	log.Printf("clang-repl evaluated '%s' to '%s'\n", expr, output)
+	return
+}
+
+// Evaluates expressions that do not request types in a single input and round trip,
+// returning a result or error for each. If the whole batch fails, e.g. because clang-repl cannot compile it,
+// that error is returned for each expression.
+func (r *Interpreter) EvaluateBatch(exprs []Expression) (outputs []*fj.Value, errs []error) {
+	lambdas := []string{}
+	for _, expr := range exprs {
+		lambdas = append(lambdas, evaluationLambda(expr))
+	}
+	m, err := r.request(func(id int) string {
+		return fmt.Sprintf("std::thread([]() { compiler_connection.evaluate_batch(%d, %s); }).detach();\n", id, strings.Join(lambdas, ", "))
+	}, len(exprs), func(string) (Type, bool) { return "", false })
+	if err == nil && m.Type != "results" {
+		err = ProtocolError{fmt.Sprintf("Expected 'results' message, found: '%s'.", m.Value)}
+	}
+	if err == nil && len(m.Value.GetArray("results")) != len(exprs) {
+		err = ProtocolError{fmt.Sprintf("Expected %d results in message '%s'.", len(exprs), m.Value)}
+	}
 	if err != nil {
+		for range exprs {
+			outputs = append(outputs, nil)
+			errs = append(errs, err)
+		}
 		return
 	}
-	output, err = r.readResult(getType)
-	log.Printf("clang-repl evaluated '%s' to '%s'\n", expr, output)
+	for _, value := range m.Value.GetArray("results") {
+		result, err := checkMessage(value)
+		var output *fj.Value
+		if err == nil {
+			output, err = evaluationResult(result)
+		}
+		outputs = append(outputs, output)
+		errs = append(errs, err)
+	}
+	log.Printf("clang-repl evaluated a batch of %d expressions.\n", len(exprs))
+	return
+}
+
+// A function that returns the JSON of the expression, which ipc.hpp calls to evaluate it.
+func evaluationLambda(expr Expression) string {
+	return "[]() { return toJson_(" + sanitize(expr) + "); }"
+}
+
+// Writes the text of a new request, given its ID, and waits for the reply.
+// The time limit applies to each of the `evaluations` in the request.
+func (r *Interpreter) request(text func(id int) string, evaluations int, getType func(string) (Type, bool)) (m message, err error) {
+	if err = r.Failure(); err != nil {
+		return
+	}
+	r.requestID++
+	input := text(r.requestID)
+	r.log(input)
+	if _, err = r.writer.Write([]byte(input)); err != nil {
+		return
+	}
+	r.inputs++
+	if timeout := r.options.EffectiveEvaluationTimeout(); timeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(time.Duration(evaluations) * timeout))
+		defer r.conn.SetReadDeadline(time.Time{})
+	}
+	if m, err = r.readReply(r.requestID, getType); err == nil {
+		// the inputs before the reply were parsed, so errors in the output so far are not diagnostics
+		r.stderr.reset()
+	}
 	return
 }
 
-func (r *Interpreter) readResult(getType func(string) (Type, bool)) (result *fj.Value, err error) {
+// Converts a "result" or "error" message to the result of an evaluation.
+func evaluationResult(m message) (*fj.Value, error) {
+	switch m.Type {
+	case "result":
+		return m.Value.Get("value"), nil
+	case "error":
+		callStack := []string{}
+		for _, frame := range m.Value.GetArray("callStack") {
+			callStack = append(callStack, string(frame.GetStringBytes()))
+		}
+		return nil, EvaluationPanic{
+			Exception: string(m.Value.GetStringBytes("kind")) == "exception",
+			Message:   string(m.Value.GetStringBytes("message")),
+			CallStack: callStack,
+		}
+	default:
+		return nil, ProtocolError{fmt.Sprintf("Unexpected '%s' message while waiting for a result.", m.Type)}
+	}
+}
+
+// Reads messages until the reply to request `id` arrives, answering the queries of its evaluation.
+func (r *Interpreter) readReply(id int, getType func(string) (Type, bool)) (m message, err error) {
 	for {
-		var read string
-		read, err = r.reader.ReadString('\n')
+		m, err = r.readMessage()
 		if err != nil {
 			return
 		}
-		log.Printf("clang-repl message: %s", read)
-		message := fj.MustParse(read)
-		if message.Get("finished") != nil {
-			err = fmt.Errorf("Compiler connection reported 'finished' while waiting for a result. Message: '%s'.", message)
+		if m.ID != id {
+			log.Printf("Ignoring message '%s' of earlier request while waiting for request %d.\n", m.Value, id)
+			continue
+		}
+		if m.Type != "getType" {
 			return
 		}
-		if result = message.Get("result"); result != nil {
+		// set the type and signal that it has been set
+		_type, exists := getType(string(m.Value.GetStringBytes("name")))
+		typeValue := "std::nullopt"
+		if exists {
+			typeValue = _type
+		}
+		if err = r.write(fmt.Sprintf("compiler_connection.set_type(%d, %s);", id, typeValue)); err != nil {
+			err = fmt.Errorf("Failed to set type after getType request. Message: '%s'. Error: %s", m.Value, err)
 			return
 		}
-		if nameBytes := message.GetStringBytes("getType"); nameBytes != nil {
-			name := string(nameBytes)
-			// set the type and signal that it has been set
-			_type, exists := getType(name)
-			typeValue := "std::nullopt"
-			if exists {
-				typeValue = _type
-			}
-			if err = r.Write(fmt.Sprintf("compiler_connection.set_type(%s);", typeValue)); err != nil {
-				err = fmt.Errorf("Failed to set type after getType request. Message: '%s'. Error: %s", message, err)
-				return
-			}
-			continue
+	}
+}
+
+// Reads a message from ipc.hpp, describing why that failed if clang-repl stopped.
+func (r *Interpreter) readMessage() (m message, err error) {
+	m, err = readMessage(r.reader)
+	if _, isProtocolError := err.(ProtocolError); err == nil || isProtocolError {
+		if err == nil {
+			log.Printf("clang-repl message: %s\n", m.Value)
 		}
-		err = fmt.Errorf("Could not parse evaluation message: '%s'", message)
 		return
 	}
+	if failure := r.Failure(); failure != nil {
+		err = failure
+	} else {
+		err = r.abort(err)
+	}
+	return
 }
 
 // The interpreter by default only waits for results.
 // This means that Interpreter.Declare may cause an error to be reported by clang-repl,
 // which is then ignored by the interpreter that already closed the connection.
 func (r *Interpreter) WaitForFinish() (err error) {
-	r.Write(`compiler_connection.send_finished();`)
-	read, err := r.reader.ReadString('\n')
-	if err != nil {
+	r.requestID++
+	if err = r.write(fmt.Sprintf("compiler_connection.send_finished(%d);", r.requestID)); err != nil {
 		return
 	}
-	message := fj.MustParse(read)
-	if message.Get("finished") == nil {
-		err = fmt.Errorf("Expected 'finished' message, found: %s", message)
+	for {
+		var m message
+		if m, err = r.readMessage(); err != nil {
+			return
+		}
+		if m.ID != r.requestID {
+			log.Printf("Ignoring message '%s' of earlier request while waiting for 'finished'.\n", m.Value)
+			continue
+		}
+		if m.Type != "finished" {
+			err = ProtocolError{fmt.Sprintf("Expected 'finished' message, found: '%s'.", m.Value)}
+		}
+		return
 	}
-	return
 }
 
 // Write text without expecting a response, such as for global declarations.
 // This does not write to the `Declared` field, which is useful for compile-time-only declarations.
 func (r *Interpreter) Write(text string) (err error) {
-	input := sanitize(text) + "\n"
-	r.log(input)
-	_, err = r.writer.Write([]byte(input))
+	if err = r.write(text); err != nil {
+		return
+	}
+	r.history = append(r.history, text)
+	return
+}
+
+// Writes text that is not written again when clang-repl is restarted.
+func (r *Interpreter) write(text string) (err error) {
+	if err = r.Failure(); err != nil {
+		return
+	}
+	input := sanitize(text)
+	if input == "" {
+		return
+	}
+	r.log(input + "\n")
+	if _, err = r.writer.Write([]byte(input + "\n")); err != nil {
+		return
+	}
+	r.inputs++
 	return
 }
 
 // Write text without expecting a response, such as for global declarations.
 // Text written is appended to the `Declared` field.
 func (r *Interpreter) Declare(text string) (err error) {
-	r.Write(text)
+	if err = r.Write(text); err != nil {
+		return
+	}
 	r.Declared += text + "\n"
 	return
 }
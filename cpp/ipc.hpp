@@ -1,17 +1,22 @@
 #pragma once
 
 #include "pb.hpp"
-#include <arpa/inet.h>
+#include <cstdlib>
+#include <cstring>
 #include <iostream>
+#include <mutex>
 #include <semaphore>
 #include <string>
+#include <vector>
 #include <sys/socket.h>
+#include <sys/un.h>
 #include <unistd.h>
 
 // Alternative to std::promise<Type_t>, which gives missing symbols errors
 // when used with clang-repl.
 struct TypePromise_ {
   std::binary_semaphore sync{0};
+  int id{0};
   std::optional<Type_t> type;
 
   std::optional<Type_t> get() {
@@ -19,87 +24,144 @@ struct TypePromise_ {
     return this->type;
   }
 
-  void set(std::optional<Type_t> type) {
+  void set(int id, std::optional<Type_t> type) {
+    if (id != this->id) {
+      panic(std::format("clang-repl: Received the answer to query {} while "
+                        "waiting for query {}.",
+                        id, this->id));
+    }
     this->type = type;
     this->sync.release();
   }
 };
 
-constexpr int YUNE_COMPILER_PORT = 11555;
+// Environment variable containing the path of the compiler's Unix socket,
+// which is set by the compiler (synchronised with eval.go).
+constexpr const char *YUNE_COMPILER_SOCKET = "YUNE_COMPILER_SOCKET";
+
+// Version of the protocol, which must equal ProtocolVersion in protocol.go.
+constexpr int YUNE_PROTOCOL_VERSION = 2;
 
+// The ID of the request being evaluated on this thread, which messages refer
+// to.
+inline thread_local int requestId_ = 0;
+
+// Sends messages to the compiler, which are described in protocol.go.
 inline class CompilerConnection_ {
 public:
   CompilerConnection_() {
-    socket = ::socket(AF_INET, SOCK_STREAM, 0);
+    const char *path = std::getenv(YUNE_COMPILER_SOCKET);
+    if (path == nullptr) {
+      panic(std::format("clang-repl: {} is not set.", YUNE_COMPILER_SOCKET));
+    }
+    socket = ::socket(AF_UNIX, SOCK_STREAM, 0);
     if (socket == -1) {
       panic("clang-repl: Failed to open compiler connection socket.");
     }
-    sockaddr_in addr{};
-    addr.sin_family = AF_INET;
-    addr.sin_port = ::htons(YUNE_COMPILER_PORT);
-    ::inet_pton(AF_INET, "127.0.0.1", &addr.sin_addr);
+    sockaddr_un addr{};
+    addr.sun_family = AF_UNIX;
+    if (std::strlen(path) >= sizeof(addr.sun_path)) {
+      panic(std::format("clang-repl: Socket path '{}' is too long.", path));
+    }
+    std::strncpy(addr.sun_path, path, sizeof(addr.sun_path) - 1);
 
     int err = connect(socket, (sockaddr *)&addr, sizeof(addr));
     if (err != 0) {
       panic("clang-repl: Failed to connect to the compiler.");
     }
     std::cerr << "clang-repl: Connected to Yune compiler." << std::endl;
+    send(std::format(R"({{ "type": "hello", "version": {} }})",
+                     YUNE_PROTOCOL_VERSION));
   }
 
   ~CompilerConnection_() { ::close(socket); }
 
   std::optional<Type_t> get_type(String_t name) {
-    std::string payload = std::format(R"({{ "getType": "{}" }})"
-                                      "\n",
-                                      name);
-    ssize_t err = ::send(socket, payload.c_str(), payload.size(), 0);
-    if (err == -1) {
-      panic("Failed to send a type query through the compiler connection.");
-    }
+    type_promise.id = requestId_;
+    send(std::format(R"({{ "type": "getType", "id": {}, "name": {} }})",
+                     requestId_, toJson_(name)));
     return type_promise.get();
   }
 
-  void yield(std::string result) const {
-    std::string payload = std::format(R"({{ "result": {} }})"
-                                      "\n",
-                                      result);
-    ssize_t err = ::send(socket, payload.c_str(), payload.size(), 0);
-    if (err == -1) {
-      panic("Failed to send a result through the compiler connection.");
-    }
+  // Evaluates `f` for request `id`, sending its result or the panic or C++
+  // exception that stopped it.
+  template <class F> void evaluate(int id, const F &f) const {
+    throwPanics_ = true;
+    requestId_ = id;
+    send(evaluation_message(id, f));
   }
 
-  void send_finished() const {
-    std::string payload = R"({ "finished": {} })"
-                          "\n";
-    ssize_t err = ::send(socket, payload.c_str(), payload.size(), 0);
-    if (err == -1) {
-      panic("Failed to send a 'finished' message through the compiler "
-            "connection.");
+  // Evaluates each of `fs` in order for request `id`, sending their results
+  // or errors in a single message.
+  template <class... F> void evaluate_batch(int id, const F &...fs) const {
+    throwPanics_ = true;
+    requestId_ = id;
+    // the elements of a braced initializer list are evaluated in order
+    std::vector<std::string> messages{evaluation_message(id, fs)...};
+    std::string results;
+    for (size_t i = 0; i < messages.size(); i++) {
+      results += (i > 0 ? ", " : "") + messages[i];
     }
+    send(std::format(R"({{ "type": "results", "id": {}, "results": [{}] }})",
+                     id, results));
   }
 
-  void set_type(std::optional<Type_t> type) { type_promise.set(type); }
+  void send_finished(int id) const {
+    send(std::format(R"({{ "type": "finished", "id": {} }})", id));
+  }
+
+  void set_type(int id, std::optional<Type_t> type) {
+    type_promise.set(id, type);
+  }
 
 private:
-  std::string read_line() const {
-    std::string result;
-    char c;
+  // The "result" message of `f`, or the "error" message of the panic or C++
+  // exception that stopped it.
+  template <class F>
+  std::string evaluation_message(int id, const F &f) const {
+    try {
+      return std::format(R"({{ "type": "result", "id": {}, "value": {} }})", id,
+                         f());
+    } catch (const Panic_ &thrown) {
+      return error_message(id, "panic", thrown.message, thrown.callStack);
+    } catch (const std::exception &exception) {
+      return error_message(id, "exception", exception.what(), {});
+    } catch (...) {
+      return error_message(id, "exception", "unknown exception", {});
+    }
+  }
 
-    while (true) {
-      ssize_t n = ::recv(socket, &c, 1, 0);
+  std::string error_message(int id, String_t kind, String_t message,
+                            List_t<String_t> call_stack) const {
+    return std::format(R"({{ "type": "error", "id": {}, "kind": {}, )"
+                       R"("message": {}, "callStack": {} }})",
+                       id, toJson_(kind), toJson_(message),
+                       toJson_(call_stack));
+  }
+
+  // Sends a message preceded by its length as a 32-bit big-endian integer.
+  void send(const std::string &message) const {
+    std::lock_guard lock(send_mutex);
+    uint32_t size = message.size();
+    std::string payload{static_cast<char>(size >> 24),
+                        static_cast<char>(size >> 16),
+                        static_cast<char>(size >> 8), static_cast<char>(size)};
+    payload += message;
+    size_t sent = 0;
+    while (sent < payload.size()) {
+      ssize_t n =
+          ::send(socket, payload.data() + sent, payload.size() - sent, 0);
       if (n == -1) {
-        panic("Failed to read line from the compiler connection.");
-      }
-      if (c == '\n') {
-        return result;
+        panic("clang-repl: Failed to send a message through the compiler "
+              "connection.");
       }
-      result += c;
+      sent += n;
     }
   }
 
   int socket{0};
   TypePromise_ type_promise;
+  mutable std::mutex send_mutex;
 } compiler_connection{};
 
 inline struct getType_cf {
@@ -0,0 +1,35 @@
+package cpp
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Applies the memory and CPU limits of the options to a running process.
+func setResourceLimits(pid int, options BuildOptions) error {
+	if memory := limit(options.EvaluationMemory, DefaultEvaluationMemory); memory > 0 {
+		bytes := uint64(memory) << 20
+		if err := prlimit(pid, syscall.RLIMIT_DATA, syscall.Rlimit{Cur: bytes, Max: bytes}); err != nil {
+			return err
+		}
+	}
+	if cpu := limit(options.EvaluationCPU, DefaultEvaluationCPU); cpu > 0 {
+		seconds := uint64((cpu + time.Second - 1) / time.Second)
+		// the soft limit sends SIGXCPU, which is reported as exceeding the limit,
+		// while the hard limit kills a process that ignores it
+		if err := prlimit(pid, syscall.RLIMIT_CPU, syscall.Rlimit{Cur: seconds, Max: seconds + 5}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sets a resource limit of another process, which the syscall package only provides for the current process.
+func prlimit(pid int, resource int, limit syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package cpp
+
+import "log"
+
+// Resource limits are only applied on Linux, elsewhere only the evaluation timeout applies.
+func setResourceLimits(pid int, options BuildOptions) error {
+	log.Println("Memory and CPU limits for clang-repl are only supported on Linux.")
+	return nil
+}
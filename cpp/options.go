@@ -0,0 +1,238 @@
+package cpp
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Options for compiling a module, used for both the executable and the compile-time interpreter.
+type BuildOptions struct {
+	// Directory containing pb.hpp and ipc.hpp, which must be set.
+	RuntimeDir string `flag:"runtime"`
+	// Build with debug information and keep the generated C++ sources,
+	// so that a debugger can step through the Yune source.
+	Debug bool `flag:"g"`
+	// Optimization level passed as -O<level>. Defaults to 0 for debug builds and 1 otherwise.
+	Optimization string `flag:"O"`
+	// Enable link-time optimization.
+	LTO bool `flag:"lto"`
+	// Sanitizers passed as -fsanitize=<sanitizers>, e.g. "address" or "undefined".
+	// These only apply to the executable, since clang-repl cannot load the sanitizer runtimes.
+	Sanitizers  []string `flag:"sanitize"`
+	IncludeDirs []string `flag:"I"`
+	// Preprocessor definitions in the form NAME or NAME=VALUE.
+	Defines []string `flag:"D"`
+	// Libraries to link against, without the "lib" prefix, as with -l.
+	Libraries []string `flag:"l"`
+	// Flags passed to clang++ when linking the executable.
+	LinkerFlags []string `flag:"ldflag"`
+	// How code is evaluated at compile time: "clang-repl" (the default) or "go",
+	// which needs no clang-repl but cannot evaluate raw C++.
+	Evaluator string `flag:"evaluator"`
+	// Maximum duration of a single compile-time evaluation.
+	// Zero uses DefaultEvaluationTimeout and a negative duration disables the limit.
+	EvaluationTimeout time.Duration `flag:"eval-timeout"`
+	// Maximum memory of clang-repl in MiB, enforced with RLIMIT_DATA on Linux.
+	// Zero uses DefaultEvaluationMemory and a negative value disables the limit.
+	EvaluationMemory int `flag:"eval-memory"`
+	// Maximum CPU time of clang-repl over the whole compilation, enforced with RLIMIT_CPU on Linux.
+	// Zero uses DefaultEvaluationCPU and a negative duration disables the limit.
+	EvaluationCPU time.Duration `flag:"eval-cpu"`
+	// Directory in which the results of compile-time evaluations, the interfaces of imported modules
+	// and compiled translation units are cached. Empty disables the cache.
+	CacheDir string
+	// Neither read nor write cached evaluation results, module interfaces and translation units.
+	NoCache bool `flag:"no-cache"`
+	// The flags that were given on the command line, which take precedence over `// yune:build` directives
+	// even if they set the zero value, e.g. -lto=false. Options are named by their flags in `flag` tags.
+	SetFlags []string
+}
+
+const (
+	DefaultEvaluationTimeout = 30 * time.Second
+	DefaultEvaluationMemory  = 4096
+	DefaultEvaluationCPU     = 10 * time.Minute
+)
+
+// Returns the value of a limit, where zero selects the default and a negative value means no limit (0).
+func limit[T time.Duration | int](value T, defaultValue T) T {
+	if value == 0 {
+		return defaultValue
+	}
+	return max(value, 0)
+}
+
+// The maximum duration of a compile-time evaluation, or 0 if there is no limit.
+func (o BuildOptions) EffectiveEvaluationTimeout() time.Duration {
+	return limit(o.EvaluationTimeout, DefaultEvaluationTimeout)
+}
+
+// A flag that can be given multiple times, each value being appended to the list.
+type listFlag struct {
+	list  *[]string
+	split bool
+}
+
+func (f listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(value string) error {
+	if f.split {
+		*f.list = append(*f.list, strings.Split(value, ",")...)
+	} else {
+		*f.list = append(*f.list, value)
+	}
+	return nil
+}
+
+var optimizationLevels = []string{"0", "1", "2", "3", "s", "z"}
+
+var evaluators = []string{"clang-repl", "go"}
+
+// Registers the command-line flags that set the options.
+// The same flags are accepted by `// yune:build` directives in source files.
+func (o *BuildOptions) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.RuntimeDir, "runtime", o.RuntimeDir, "directory containing pb.hpp, ipc.hpp and std.un, instead of the bundled ones")
+	flags.BoolVar(&o.Debug, "g", o.Debug, "build with debug information and keep the generated C++ sources")
+	flags.Func("O", "optimization level: 0, 1, 2, 3, s or z", func(level string) error {
+		if !slices.Contains(optimizationLevels, level) {
+			return fmt.Errorf("invalid optimization level '%s', expected one of %s", level, strings.Join(optimizationLevels, ", "))
+		}
+		o.Optimization = level
+		return nil
+	})
+	flags.BoolVar(&o.LTO, "lto", o.LTO, "enable link-time optimization")
+	flags.Var(listFlag{&o.Sanitizers, true}, "sanitize", "comma-separated sanitizers, e.g. address,undefined")
+	flags.Var(listFlag{&o.IncludeDirs, false}, "I", "add an include directory (repeatable)")
+	flags.Var(listFlag{&o.Defines, false}, "D", "define a preprocessor macro NAME or NAME=VALUE (repeatable)")
+	flags.Var(listFlag{&o.Libraries, false}, "l", "link against a library (repeatable)")
+	flags.Var(listFlag{&o.LinkerFlags, false}, "ldflag", "pass a flag to clang++ when linking (repeatable)")
+	flags.Func("evaluator", "compile-time evaluator: clang-repl or go", func(evaluator string) error {
+		if !slices.Contains(evaluators, evaluator) {
+			return fmt.Errorf("invalid evaluator '%s', expected one of %s", evaluator, strings.Join(evaluators, ", "))
+		}
+		o.Evaluator = evaluator
+		return nil
+	})
+	flags.DurationVar(&o.EvaluationTimeout, "eval-timeout", o.EvaluationTimeout, "maximum duration of a compile-time evaluation, e.g. 1m (default 30s, negative for no limit)")
+	flags.IntVar(&o.EvaluationMemory, "eval-memory", o.EvaluationMemory, "maximum memory of clang-repl in MiB (default 4096, negative for no limit)")
+	flags.DurationVar(&o.EvaluationCPU, "eval-cpu", o.EvaluationCPU, "maximum CPU time of clang-repl (default 10m, negative for no limit)")
+	flags.BoolVar(&o.NoCache, "no-cache", o.NoCache, "do not use cached results of compile-time evaluations, module interfaces or compiled translation units")
+}
+
+// Applies the flags of a `// yune:build` directive.
+// `registerFlags` register flags that are not build options, such as those of the compiler's command line.
+func (o *BuildOptions) ParseDirective(arguments []string, registerFlags ...func(*flag.FlagSet)) error {
+	flags := flag.NewFlagSet("yune:build", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	o.RegisterFlags(flags)
+	for _, register := range registerFlags {
+		register(flags)
+	}
+	if err := flags.Parse(arguments); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument '%s' in yune:build directive", flags.Arg(0))
+	}
+	return nil
+}
+
+// Applies the `// yune:build` directives of the main file to options set on the command line,
+// which take precedence over the directives. Lists of the directives come before those of the command line.
+func (o *BuildOptions) ApplyDirectives(directives [][]string, registerFlags ...func(*flag.FlagSet)) error {
+	options := BuildOptions{}
+	for _, directive := range directives {
+		if err := options.ParseDirective(directive, registerFlags...); err != nil {
+			return fmt.Errorf("invalid yune:build directive '%s': %w", strings.Join(directive, " "), err)
+		}
+	}
+	options.override(*o)
+	*o = options
+	return nil
+}
+
+// Replaces the options that are set in `other` and appends its lists.
+// An option is set if its flag is in `other.SetFlags`, or else if it is not the zero value,
+// e.g. for options that are not set through flags.
+func (o *BuildOptions) override(other BuildOptions) {
+	value := reflect.ValueOf(o).Elem()
+	otherValue := reflect.ValueOf(other)
+	for i := range value.NumField() {
+		field, otherField := value.Field(i), otherValue.Field(i)
+		if field.Kind() == reflect.Slice {
+			field.Set(reflect.AppendSlice(field, otherField))
+		} else if slices.Contains(other.SetFlags, value.Type().Field(i).Tag.Get("flag")) || !otherField.IsZero() {
+			field.Set(otherField)
+		}
+	}
+}
+
+// Records which of the options were set by parsing `flags`, which must be registered with RegisterFlags.
+func (o *BuildOptions) RecordSetFlags(flags *flag.FlagSet) {
+	options := reflect.TypeFor[BuildOptions]()
+	flags.Visit(func(f *flag.Flag) {
+		isOption := slices.ContainsFunc(reflect.VisibleFields(options), func(field reflect.StructField) bool {
+			return field.Tag.Get("flag") == f.Name
+		})
+		if isOption && !slices.Contains(o.SetFlags, f.Name) {
+			o.SetFlags = append(o.SetFlags, f.Name)
+		}
+	})
+}
+
+// Flags used when compiling C++, both by clang++ and clang-repl.
+func (o BuildOptions) compilerFlags() []string {
+	flags := []string{"-std=c++23", o.optimizationFlag(), "-I" + o.RuntimeDir}
+	for _, dir := range o.IncludeDirs {
+		flags = append(flags, "-I"+dir)
+	}
+	for _, define := range o.Defines {
+		flags = append(flags, "-D"+define)
+	}
+	return flags
+}
+
+func (o BuildOptions) optimizationFlag() string {
+	optimization := o.Optimization
+	if optimization == "" {
+		optimization = "1"
+		if o.Debug {
+			optimization = "0"
+		}
+	}
+	return "-O" + optimization
+}
+
+// Flags used when compiling the translation units of the executable, in addition to the compiler flags,
+// and again when linking them.
+func (o BuildOptions) codeGenerationFlags() (flags []string) {
+	if o.Debug {
+		flags = append(flags, "-g")
+	}
+	if o.LTO {
+		flags = append(flags, "-flto")
+	}
+	if len(o.Sanitizers) > 0 {
+		flags = append(flags, "-fsanitize="+strings.Join(o.Sanitizers, ","), "-fno-omit-frame-pointer")
+	}
+	return
+}
+
+// Flags used when linking the executable, which come after the object files.
+func (o BuildOptions) linkFlags() (flags []string) {
+	flags = append(flags, o.LinkerFlags...)
+	for _, library := range o.Libraries {
+		flags = append(flags, "-l"+library)
+	}
+	return
+}
@@ -3,21 +3,38 @@
 // headers also used by Yune programs
 #include <algorithm>
 #include <iostream> // std::cout
+#include <map>      // std::map
 #include <string>   // std::string
 #include <tuple>    // std::tuple, std::apply
 #include <type_traits>
 #include <vector> // std::vector
 
 // headers for this file
+#include <cctype>
+#include <cerrno>
+#include <charconv>
+#include <cmath>
+#include <cstring>
+#include <cstdlib>
 #include <concepts>
+#include <fstream>
 #include <format>
 #include <iomanip>
+#include <iterator>
+#include <limits>
 #include <memory>
+#include <optional>
 #include <sstream>
 #include <string>
 #include <utility>
 #include <variant>
 
+// Definitions of Yune declarations are inline, so that the module can be included anywhere,
+// except when it is split into translation units, which each define their declarations once.
+#ifndef YUNE_INLINE
+#define YUNE_INLINE inline
+#endif
+
 template <class T> struct Box_t {
   constexpr Box_t(T *ptr) : ptr(ptr) {}
 
@@ -77,6 +94,9 @@ template <class... T> struct Union_t {
             },
             subset.variant)) {}
 
+  // Only used as a placeholder, e.g. when decoding JSON.
+  Union_t() = default;
+
   bool operator==(const Union_t<T...> &other) const = default;
 
   std::variant<T...> variant;
@@ -88,8 +108,42 @@ template <> struct Union_t<> {
   bool operator==(const Union_t<> &other) const = default;
 };
 
+// The union of the given types, flattened and without duplicates like `NewUnionType` in the compiler,
+// which is the type itself if only one remains.
+template <class... T> struct TypeList_ {};
+
+template <class List, class T> struct AppendUnique_;
+template <class... Ts, class T> struct AppendUnique_<TypeList_<Ts...>, T> {
+  using type = std::conditional_t<(std::same_as<Ts, T> || ...),
+                                  TypeList_<Ts...>, TypeList_<Ts..., T>>;
+};
+
+template <class List, class... T> struct FlattenUnion_ {
+  using type = List;
+};
+template <class List, class T, class... Rest>
+struct FlattenUnion_<List, T, Rest...>
+    : FlattenUnion_<typename AppendUnique_<List, T>::type, Rest...> {};
+template <class List, class... U, class... Rest>
+struct FlattenUnion_<List, Union_t<U...>, Rest...>
+    : FlattenUnion_<List, U..., Rest...> {};
+
+template <class List> struct UnionOf_;
+template <class T> struct UnionOf_<TypeList_<T>> {
+  using type = T;
+};
+template <class... T> struct UnionOf_<TypeList_<T...>> {
+  using type = Union_t<T...>;
+};
+
+template <class... T>
+using FlatUnion_t =
+    typename UnionOf_<typename FlattenUnion_<TypeList_<>, T...>::type>::type;
+
 template <class T> using List_t = std::vector<T>;
 
+template <class K, class V> using Map_t = std::map<K, V>;
+
 using String_t = std::string;
 
 template <class F, class Return, class... Args>
@@ -159,14 +213,15 @@ struct StringType_t {
 };
 struct TupleType_t;
 struct ListType_t;
+struct MapType_t;
 struct FnType_t;
 struct StructType_t;
 struct UnionType_t;
 
 using Type_t =
     Union_t<TypeType_t, IntType_t, FloatType_t, BoolType_t, StringType_t,
-            Box_t<TupleType_t>, Box_t<ListType_t>, Box_t<FnType_t>,
-            Box_t<StructType_t>, Box_t<UnionType_t>>;
+            Box_t<TupleType_t>, Box_t<ListType_t>, Box_t<MapType_t>,
+            Box_t<FnType_t>, Box_t<StructType_t>, Box_t<UnionType_t>>;
 
 struct TupleType_t {
   List_t<Type_t> elements;
@@ -176,6 +231,11 @@ struct ListType_t {
   Type_t element;
   bool operator==(const ListType_t &other) const = default;
 };
+struct MapType_t {
+  Type_t key;
+  Type_t value;
+  bool operator==(const MapType_t &other) const = default;
+};
 struct FnType_t {
   Type_t argument;
   Type_t returnType;
@@ -350,7 +410,8 @@ inline std::string toJson_(const String_t &s) {
       oss << "\\t";
       break;
     default:
-      if (c < 0x20) {
+      // bytes of multi-byte UTF-8 characters are negative and kept as-is
+      if (static_cast<unsigned char>(c) < 0x20) {
         oss << "\\u" << std::hex << std::setw(4) << std::setfill('0')
             << static_cast<int>(c);
       } else {
@@ -363,7 +424,21 @@ inline std::string toJson_(const String_t &s) {
 }
 inline std::string toJson_(const int &i) { return std::to_string(i); }
 inline std::string toJson_(const bool &b) { return b ? "true" : "false"; }
-inline std::string toJson_(const float &f) { return std::to_string(f); }
+// Floats always contain a '.' or exponent so that they are not read back as
+// integers. Non-finite floats cannot be represented by JSON numbers.
+inline std::string toJson_(const float &f) {
+  if (std::isnan(f)) {
+    return R"({ "Float": "nan" })";
+  }
+  if (std::isinf(f)) {
+    return f > 0 ? R"({ "Float": "inf" })" : R"({ "Float": "-inf" })";
+  }
+  std::string s = std::format("{}", f);
+  if (s.find_first_of(".e") == std::string::npos) {
+    s += ".0";
+  }
+  return s;
+}
 
 inline std::string toJson_(const TypeType_t &) {
   return R"({ "TypeType": {} })";
@@ -380,11 +455,13 @@ inline std::string toJson_(const StringType_t &) {
 }
 std::string toJson_(const TupleType_t &t);
 std::string toJson_(const ListType_t &t);
+std::string toJson_(const MapType_t &t);
 std::string toJson_(const FnType_t &t);
 std::string toJson_(const StructType_t &t);
 std::string toJson_(const UnionType_t &t);
 template <class T> std::string toJson_(List_t<T> list);
 template <class... T> std::string toJson_(std::tuple<T...> tuple);
+template <class K, class V> std::string toJson_(const Map_t<K, V> &map);
 template <class... T> std::string toJson_(const Union_t<T...> &_union);
 std::string toJson_(const IntegerExpression_t &e);
 std::string toJson_(const FloatExpression_t &e);
@@ -444,12 +521,24 @@ template <class... T> std::string toJson_(std::tuple<T...> tuple) {
   return oss.str();
 }
 
+template <class K, class V> std::string toJson_(const Map_t<K, V> &map) {
+  List_t<std::tuple<K, V>> entries;
+  for (const auto &[key, value] : map) {
+    entries.push_back(std::make_tuple(key, value));
+  }
+  return R"({ "Map": { "entries": )" + toJson_(entries) + " } }";
+}
+
 inline std::string toJson_(const TupleType_t &t) {
   return R"({ "TupleType": { "elements": )" + toJson_(t.elements) + " } }";
 }
 inline std::string toJson_(const ListType_t &t) {
   return R"({ "ListType": { "element": )" + toJson_(t.element) + " } }";
 }
+inline std::string toJson_(const MapType_t &t) {
+  return std::format(R"({{ "MapType": {{ "key": {}, "value": {} }} }})",
+                     toJson_(t.key), toJson_(t.value));
+}
 inline std::string toJson_(const FnType_t &t) {
   return std::format(
       R"({{ "FnType": {{ "argument": {}, "returnType": {} }} }})",
@@ -588,6 +677,7 @@ static_assert(std::equality_comparable<BoolType_t>);
 static_assert(std::equality_comparable<StringType_t>);
 static_assert(std::equality_comparable<TupleType_t>);
 static_assert(std::equality_comparable<ListType_t>);
+static_assert(std::equality_comparable<MapType_t>);
 static_assert(std::equality_comparable<FnType_t>);
 static_assert(std::equality_comparable<StructType_t>);
 static_assert(std::equality_comparable<UnionType_t>);
@@ -603,6 +693,8 @@ inline Type_t String = StringType_t{};
 
 inline Type_t Expression = box_f(StructType_t{.name = "Expression"});
 inline Type_t Statement = box_f(StructType_t{.name = "Statement"});
+// named differently than in Yune, since programs may declare their own `Error`
+inline Type_t Error_ = box_f(StructType_t{.name = "Error"});
 
 inline struct List_f {
   Type_t operator()(Type_t element) const {
@@ -618,17 +710,97 @@ inline struct Fn_f {
   std::string toJson_() const { return R"({ "Function": "Fn" })"; }
 } Fn;
 
+inline struct Map_f {
+  Type_t operator()(Type_t key, Type_t value) const {
+    return box_f(MapType_t{.key = key, .value = value});
+  }
+  std::string toJson_() const { return R"({ "Function": "Map" })"; }
+} Map;
+
 inline struct toFloat_f {
   float operator()(int n) const { return n; }
   std::string toJson_() const { return R"({ "Function": "toFloat" })"; }
 } toFloat;
 
+// Location in Yune source code, used to report runtime errors.
+struct Span_t {
+  const char *file;
+  int line;
+  int column;
+};
+
+inline std::string toString_(const Span_t &span) {
+  return std::format("{}:{}:{}", span.file, span.line, span.column);
+}
+
+// A Yune function that is currently being executed.
+struct CallFrame_ {
+  const char *function;
+  Span_t span;
+};
+
+// The Yune call stack, which is printed on panic.
+inline thread_local List_t<CallFrame_> callStack_;
+
+// Pushes a frame on the call stack for the duration of a function call.
+struct CallStackGuard_ {
+  CallStackGuard_(const char *function, Span_t span) {
+    callStack_.push_back({function, span});
+  }
+  ~CallStackGuard_() { callStack_.pop_back(); }
+  CallStackGuard_(const CallStackGuard_ &) = delete;
+  CallStackGuard_ &operator=(const CallStackGuard_ &) = delete;
+};
+
+// The Yune call stack as lines, most recent call first.
+inline List_t<String_t> callStackLines_() {
+  List_t<String_t> lines;
+  for (auto frame = callStack_.rbegin(); frame != callStack_.rend(); frame++) {
+    lines.push_back(
+        std::format("{} ({})", frame->function, toString_(frame->span)));
+  }
+  return lines;
+}
+
+inline void printCallStack_() {
+  if (callStack_.empty()) {
+    return;
+  }
+  std::cerr << "call stack (most recent call first):" << std::endl;
+  for (const auto &line : callStackLines_()) {
+    std::cerr << "    " << line << std::endl;
+  }
+}
+
+// Thrown by `panic` during compile-time evaluation instead of exiting, so that
+// the compiler can report the panic (see ipc.hpp).
+struct Panic_ {
+  String_t message;
+  List_t<String_t> callStack;
+};
+
+// Set on the threads of compile-time evaluations.
+inline thread_local bool throwPanics_ = false;
+
 inline struct panic_f {
   [[noreturn]]
   Union_t<> operator()(String_t message) const {
+    if (throwPanics_) {
+      throw Panic_{.message = message, .callStack = callStackLines_()};
+    }
     std::cerr << "panic: " << message << std::endl;
+    printCallStack_();
     exit(1);
   }
+  // The span is empty if the builtin is not called directly, e.g. when it is
+  // passed to `map`.
+  [[noreturn]]
+  Union_t<> operator()(String_t message, Span_t span) const {
+    if (span.file == nullptr) {
+      (*this)(message);
+    }
+    (*this)(std::format("{}: {}", toString_(span), message));
+  }
   std::string toJson_() const { return R"({ "Function": "panic" })"; }
 } panic;
 
@@ -768,6 +940,14 @@ inline struct variableDeclaration_f {
   }
 } variableDeclaration;
 
+inline struct printString_f {
+  std::tuple<> operator()(String_t str) const {
+    std::cout << str << std::flush;
+    return std::make_tuple();
+  }
+  std::string toJson_() const { return R"({ "Function": "printString" })"; }
+} printString;
+
 inline struct printlnString_f {
   std::tuple<> operator()(String_t str) const {
     std::cout << str << std::endl;
@@ -791,14 +971,20 @@ inline struct len_f {
     return l.size();
   }
   int operator()(String_t s) const { return s.length(); }
+  template <class K, class V> int operator()(const Map_t<K, V> &m) const {
+    return m.size();
+  }
 
   std::string toJson_() const { return R"({ "Function": "len" })"; }
 } len;
 
 inline struct get_f {
-  template <class T = int> T operator()(List_t<T> list, int index) const {
+  template <class T = int>
+  T operator()(List_t<T> list, int index, Span_t span = {}) const {
     if (index < 0 || index >= list.size()) {
-      panic("get: list index out of bounds");
+      panic(std::format("get: index {} out of bounds for length {}", index,
+                        list.size()),
+            span);
     }
     return list[index];
   }
@@ -808,11 +994,15 @@ inline struct get_f {
 
 inline struct set_f {
   template <class T = int>
-  std::tuple<> operator()(List_t<T> list, int index, T element) const {
+  std::tuple<> operator()(List_t<T> list, int index, T element,
+                          Span_t span = {}) const {
     if (index < 0 || index >= list.size()) {
-      panic("set: list index out of bounds");
+      panic(std::format("set: index {} out of bounds for length {}", index,
+                        list.size()),
+            span);
     }
     list[index] = element;
+    return std::make_tuple();
   }
 
   std::string toJson_() const { return R"({ "Function": "set" })"; }
@@ -827,22 +1017,1292 @@ inline struct append_f {
   std::string toJson_() const { return R"({ "Function": "append" })"; }
 } append;
 
+inline struct toMap_f {
+  template <class K, class V>
+  Map_t<K, V> operator()(List_t<std::tuple<K, V>> entries) const {
+    Map_t<K, V> map;
+    for (auto &[key, value] : entries) {
+      map.insert_or_assign(key, value);
+    }
+    return map;
+  }
+  std::string toJson_() const { return R"({ "Function": "toMap" })"; }
+} toMap;
+
+// Key and value parameters are not deduced, so that they can be converted to
+// the map's key and value types (e.g. a variant to a Union).
+inline struct insert_f {
+  template <class K, class V>
+  Map_t<K, V> operator()(Map_t<K, V> map, std::type_identity_t<K> key,
+                         std::type_identity_t<V> value) const {
+    map.insert_or_assign(key, value);
+    return map;
+  }
+  std::string toJson_() const { return R"({ "Function": "insert" })"; }
+} insert;
+
+inline struct lookup_f {
+  // the value type may itself be a union, which is flattened like in Yune
+  template <class K, class V>
+  FlatUnion_t<V, std::tuple<>> operator()(const Map_t<K, V> &map,
+                                          std::type_identity_t<K> key) const {
+    auto it = map.find(key);
+    if (it == map.end()) {
+      return std::make_tuple();
+    }
+    return it->second;
+  }
+  std::string toJson_() const { return R"({ "Function": "lookup" })"; }
+} lookup;
+
+// Named `remove_` since `remove` is declared by the C standard library.
+inline struct remove_f {
+  template <class K, class V>
+  Map_t<K, V> operator()(Map_t<K, V> map, std::type_identity_t<K> key) const {
+    map.erase(key);
+    return map;
+  }
+  std::string toJson_() const { return R"({ "Function": "remove" })"; }
+} remove_;
+
+inline struct keys_f {
+  template <class K, class V>
+  List_t<K> operator()(const Map_t<K, V> &map) const {
+    List_t<K> keys;
+    keys.reserve(map.size());
+    for (const auto &[key, value] : map) {
+      keys.push_back(key);
+    }
+    return keys;
+  }
+  std::string toJson_() const { return R"({ "Function": "keys" })"; }
+} keys;
+
+// -- higher-order list functions --
+
+// Calls a function that takes multiple arguments. Yune cannot distinguish
+// such a function from one taking a single tuple, so the tuple is passed as
+// a whole if the function does not accept the separate arguments.
+template <class F, class... Args>
+decltype(auto) call_(const F &f, Args &&...args) {
+  if constexpr (std::is_invocable_v<const F &, Args...>) {
+    return f(std::forward<Args>(args)...);
+  } else {
+    return f(std::make_tuple(std::forward<Args>(args)...));
+  }
+}
+
+// Calls a function with a single argument. If that argument is a tuple and the
+// function takes its elements as separate arguments, the tuple is unpacked.
+template <class F, class T> decltype(auto) callUnary_(const F &f, T &&arg) {
+  if constexpr (std::is_invocable_v<const F &, T>) {
+    return f(std::forward<T>(arg));
+  } else {
+    return apply_(f, std::forward<T>(arg));
+  }
+}
+
+inline struct map_f {
+  template <class T, class F>
+  auto operator()(const List_t<T> &list, const F &f) const {
+    using U = std::decay_t<decltype(callUnary_(f, list.front()))>;
+    List_t<U> result;
+    result.reserve(list.size());
+    std::transform(list.begin(), list.end(), std::back_inserter(result),
+                   [&](const T &element) { return callUnary_(f, element); });
+    return result;
+  }
+  std::string toJson_() const { return R"({ "Function": "map" })"; }
+} map;
+
+inline struct filter_f {
+  template <class T, class F>
+  List_t<T> operator()(const List_t<T> &list, const F &f) const {
+    List_t<T> result;
+    std::copy_if(list.begin(), list.end(), std::back_inserter(result),
+                 [&](const T &element) { return callUnary_(f, element); });
+    return result;
+  }
+  std::string toJson_() const { return R"({ "Function": "filter" })"; }
+} filter;
+
+inline struct fold_f {
+  template <class T, class U, class F>
+  U operator()(const List_t<T> &list, U initial, const F &f) const {
+    for (const T &element : list) {
+      initial = call_(f, std::move(initial), element);
+    }
+    return initial;
+  }
+  std::string toJson_() const { return R"({ "Function": "fold" })"; }
+} fold;
+
+inline struct concat_f {
+  template <class T>
+  List_t<T> operator()(List_t<T> first, const List_t<T> &second) const {
+    first.insert(first.end(), second.begin(), second.end());
+    return first;
+  }
+  std::string toJson_() const { return R"({ "Function": "concat" })"; }
+} concat;
+
+// Sorts stably, either by `<` or by the given "less than" function.
+inline struct sort_f {
+  template <class T> List_t<T> operator()(List_t<T> list) const {
+    std::stable_sort(list.begin(), list.end());
+    return list;
+  }
+  template <class T, class F>
+  List_t<T> operator()(List_t<T> list, const F &less) const {
+    std::stable_sort(list.begin(), list.end(),
+                     [&](const T &a, const T &b) { return call_(less, a, b); });
+    return list;
+  }
+  std::string toJson_() const { return R"({ "Function": "sort" })"; }
+} sort;
+
 inline struct subString_f {
-  String_t operator()(String_t s, int start, int end) const {
+  String_t operator()(String_t s, int start, int end,
+                      Span_t span = {}) const {
     if (start < 0) {
-      panic(std::format("subString: start ({}) < 0", start));
+      panic(std::format("subString: start ({}) < 0", start), span);
     }
     if (end > s.length()) {
-      panic(std::format("subString: end ({}) > len ({})", end, s.length()));
+      panic(std::format("subString: end ({}) > len ({})", end, s.length()),
+            span);
     }
     if (end < start) {
-      panic(std::format("subString: end ({}) < start ({})", end, start));
+      panic(std::format("subString: end ({}) < start ({})", end, start), span);
     }
     return s.substr(start, end - start);
   }
   std::string toJson_() const { return R"({ "Function": "subString" })"; }
 } subString;
 
+// Implements `xs[i]`. Returns a reference for lists so that `xs[i] = v` can
+// be lowered to an assignment to the result.
+inline struct index_f {
+  template <class T>
+  T &operator()(List_t<T> &list, int index, Span_t span) const {
+    check(index, list.size(), span);
+    return list[index];
+  }
+  template <class T>
+  T operator()(const List_t<T> &list, int index, Span_t span) const {
+    check(index, list.size(), span);
+    return list[index];
+  }
+  String_t operator()(const String_t &s, int index, Span_t span) const {
+    check(index, s.length(), span);
+    return s.substr(index, 1);
+  }
+
+private:
+  static void check(int index, size_t length, Span_t span) {
+    if (index < 0 || index >= length) {
+      panic(std::format("index {} out of bounds for length {}", index, length),
+            span);
+    }
+  }
+} index_;
+
+// Implements `xs[low:high]` for both lists and strings.
+inline struct slice_f {
+  template <class T>
+  List_t<T> operator()(const List_t<T> &list, int low, int high,
+                       Span_t span) const {
+    check(low, high, list.size(), span);
+    return List_t<T>(list.begin() + low, list.begin() + high);
+  }
+  String_t operator()(const String_t &s, int low, int high,
+                      Span_t span) const {
+    check(low, high, s.length(), span);
+    return s.substr(low, high - low);
+  }
+
+private:
+  static void check(int low, int high, size_t length, Span_t span) {
+    if (low < 0 || high > length || high < low) {
+      panic(std::format("slice [{}:{}] out of bounds for length {}", low, high,
+                        length),
+            span);
+    }
+  }
+} slice_;
+
+// -- strings --
+
+inline struct indexOf_f {
+  Union_t<int, std::tuple<>> operator()(String_t text, String_t search,
+                                        int offset) const {
+    if (offset < 0 || offset > text.length()) {
+      return std::make_tuple();
+    }
+    size_t found = text.find(search, offset);
+    if (found == String_t::npos) {
+      return std::make_tuple();
+    }
+    return static_cast<int>(found);
+  }
+  std::string toJson_() const { return R"({ "Function": "indexOf" })"; }
+} indexOf;
+
+inline struct split_f {
+  List_t<String_t> operator()(String_t text, String_t separator) const {
+    List_t<String_t> parts;
+    if (separator.empty()) {
+      for (char c : text) {
+        parts.push_back(String_t(1, c));
+      }
+      return parts;
+    }
+    size_t start = 0;
+    size_t found;
+    while ((found = text.find(separator, start)) != String_t::npos) {
+      parts.push_back(text.substr(start, found - start));
+      start = found + separator.length();
+    }
+    parts.push_back(text.substr(start));
+    return parts;
+  }
+  std::string toJson_() const { return R"({ "Function": "split" })"; }
+} split;
+
+inline struct join_f {
+  String_t operator()(List_t<String_t> parts, String_t separator) const {
+    String_t result;
+    for (size_t i = 0; i < parts.size(); i++) {
+      if (i > 0) {
+        result += separator;
+      }
+      result += parts[i];
+    }
+    return result;
+  }
+  std::string toJson_() const { return R"({ "Function": "join" })"; }
+} join;
+
+inline struct replace_f {
+  String_t operator()(String_t text, String_t from, String_t to) const {
+    if (from.empty()) {
+      return text;
+    }
+    String_t result;
+    size_t start = 0;
+    size_t found;
+    while ((found = text.find(from, start)) != String_t::npos) {
+      result.append(text, start, found - start);
+      result += to;
+      start = found + from.length();
+    }
+    result.append(text, start);
+    return result;
+  }
+  std::string toJson_() const { return R"({ "Function": "replace" })"; }
+} replace;
+
+inline struct trim_f {
+  String_t operator()(String_t text) const {
+    const char *space = " \t\n\r\f\v";
+    size_t start = text.find_first_not_of(space);
+    if (start == String_t::npos) {
+      return "";
+    }
+    size_t end = text.find_last_not_of(space);
+    return text.substr(start, end - start + 1);
+  }
+  std::string toJson_() const { return R"({ "Function": "trim" })"; }
+} trim;
+
+inline struct startsWith_f {
+  bool operator()(String_t text, String_t prefix) const {
+    return text.starts_with(prefix);
+  }
+  std::string toJson_() const { return R"({ "Function": "startsWith" })"; }
+} startsWith;
+
+inline struct endsWith_f {
+  bool operator()(String_t text, String_t suffix) const {
+    return text.ends_with(suffix);
+  }
+  std::string toJson_() const { return R"({ "Function": "endsWith" })"; }
+} endsWith;
+
+// Case conversion only affects ASCII letters.
+inline struct upperCase_f {
+  String_t operator()(String_t text) const {
+    for (char &c : text) {
+      c = std::toupper(static_cast<unsigned char>(c));
+    }
+    return text;
+  }
+  std::string toJson_() const { return R"({ "Function": "upperCase" })"; }
+} upperCase;
+
+inline struct lowerCase_f {
+  String_t operator()(String_t text) const {
+    for (char &c : text) {
+      c = std::tolower(static_cast<unsigned char>(c));
+    }
+    return text;
+  }
+  std::string toJson_() const { return R"({ "Function": "lowerCase" })"; }
+} lowerCase;
+
+inline struct repeat_f {
+  String_t operator()(String_t text, int count, Span_t span = {}) const {
+    if (count < 0) {
+      panic(std::format("repeat: count ({}) < 0", count), span);
+    }
+    String_t result;
+    result.reserve(text.length() * count);
+    for (int i = 0; i < count; i++) {
+      result += text;
+    }
+    return result;
+  }
+  std::string toJson_() const { return R"({ "Function": "repeat" })"; }
+} repeat;
+
+// Strings are sequences of bytes, so character codes are in [0, 256).
+inline struct charToCode_f {
+  int operator()(String_t c, Span_t span = {}) const {
+    if (c.length() != 1) {
+      panic(std::format("charToCode: expected a single character, found '{}'",
+                        c),
+            span);
+    }
+    return static_cast<unsigned char>(c[0]);
+  }
+  std::string toJson_() const { return R"({ "Function": "charToCode" })"; }
+} charToCode;
+
+inline struct codeToChar_f {
+  String_t operator()(int code, Span_t span = {}) const {
+    if (code < 0 || code > 255) {
+      panic(std::format("codeToChar: code ({}) is not in [0, 256)", code),
+            span);
+    }
+    return String_t(1, static_cast<char>(code));
+  }
+  std::string toJson_() const { return R"({ "Function": "codeToChar" })"; }
+} codeToChar;
+
+// Parses a base-10 integer with an optional leading '-'.
+// Returns () if the text is not an integer or does not fit in an Int.
+inline struct stringToInt_f {
+  Union_t<int, std::tuple<>> operator()(String_t text) const {
+    int value;
+    const char *end = text.data() + text.size();
+    auto [ptr, error] = std::from_chars(text.data(), end, value);
+    if (text.empty() || error != std::errc() || ptr != end) {
+      return std::make_tuple();
+    }
+    return value;
+  }
+  std::string toJson_() const { return R"({ "Function": "stringToInt" })"; }
+} stringToInt;
+
+inline struct stringToFloat_f {
+  Union_t<float, std::tuple<>> operator()(String_t text) const {
+    if (text.empty() || std::isspace(static_cast<unsigned char>(text[0]))) {
+      return std::make_tuple();
+    }
+    char *end;
+    errno = 0;
+    float value = std::strtof(text.c_str(), &end);
+    if (errno != 0 || end != text.c_str() + text.size()) {
+      return std::make_tuple();
+    }
+    return value;
+  }
+  std::string toJson_() const { return R"({ "Function": "stringToFloat" })"; }
+} stringToFloat;
+
+inline struct formatInt_f {
+  String_t operator()(int value) const { return std::to_string(value); }
+  std::string toJson_() const { return R"({ "Function": "formatInt" })"; }
+} formatInt;
+
+// Formats a float as the shortest string that parses back to the same value.
+inline struct formatFloat_f {
+  String_t operator()(float value) const { return std::format("{}", value); }
+  std::string toJson_() const { return R"({ "Function": "formatFloat" })"; }
+} formatFloat;
+
+// -- numbers --
+
+// Converts a float to an int, or returns () if the result does not fit.
+inline Union_t<int, std::tuple<>> checkedToInt_(float value) {
+  // the upper bound is exactly representable as a float, unlike INT_MAX
+  constexpr float upper = -static_cast<float>(std::numeric_limits<int>::min());
+  if (std::isnan(value) || value < std::numeric_limits<int>::min() ||
+      value >= upper) {
+    return std::make_tuple();
+  }
+  return static_cast<int>(value);
+}
+
+inline struct toInt_f {
+  Union_t<int, std::tuple<>> operator()(float value) const {
+    return checkedToInt_(std::trunc(value));
+  }
+  std::string toJson_() const { return R"({ "Function": "toInt" })"; }
+} toInt;
+
+inline struct roundToInt_f {
+  Union_t<int, std::tuple<>> operator()(float value) const {
+    return checkedToInt_(std::round(value));
+  }
+  std::string toJson_() const { return R"({ "Function": "roundToInt" })"; }
+} roundToInt;
+
+// Defines a builtin that forwards to a unary float function in <cmath>.
+// Named with an underscore since the C library declares these globally.
+#define FLOAT_FUNCTION_(name)                                                  \
+  inline struct name##_f {                                                     \
+    float operator()(float value) const { return std::name(value); }           \
+    std::string toJson_() const { return R"({ "Function": ")" #name R"(" })"; } \
+  } name##_;
+
+FLOAT_FUNCTION_(floor)
+FLOAT_FUNCTION_(ceil)
+FLOAT_FUNCTION_(round)
+FLOAT_FUNCTION_(sqrt)
+FLOAT_FUNCTION_(exp)
+FLOAT_FUNCTION_(log)
+FLOAT_FUNCTION_(sin)
+FLOAT_FUNCTION_(cos)
+FLOAT_FUNCTION_(tan)
+#undef FLOAT_FUNCTION_
+
+inline struct atan2_f {
+  float operator()(float y, float x) const { return std::atan2(y, x); }
+  std::string toJson_() const { return R"({ "Function": "atan2" })"; }
+} atan2_;
+
+inline struct isNaN_f {
+  bool operator()(float value) const { return std::isnan(value); }
+  std::string toJson_() const { return R"({ "Function": "isNaN" })"; }
+} isNaN;
+
+// The following functions accept either ints or floats.
+
+inline struct abs_f {
+  int operator()(int value, Span_t span = {}) const {
+    // the absolute value of the smallest int does not fit in an int
+    if (value == std::numeric_limits<int>::min()) {
+      panic(std::format("abs: integer overflow for {}", value), span);
+    }
+    return value < 0 ? -value : value;
+  }
+  float operator()(float value, Span_t = {}) const { return std::fabs(value); }
+  std::string toJson_() const { return R"({ "Function": "abs" })"; }
+} abs_;
+
+inline struct min_f {
+  template <class T> T operator()(T a, T b) const { return std::min(a, b); }
+  std::string toJson_() const { return R"({ "Function": "min" })"; }
+} min;
+
+inline struct max_f {
+  template <class T> T operator()(T a, T b) const { return std::max(a, b); }
+  std::string toJson_() const { return R"({ "Function": "max" })"; }
+} max;
+
+inline struct pow_f {
+  int operator()(int base, int exponent, Span_t span = {}) const {
+    if (exponent < 0) {
+      panic(std::format("pow: negative exponent ({}) for int base", exponent),
+            span);
+    }
+    // squaring the base only overflows if the result does too
+    int result = 1;
+    int power = base;
+    for (int remaining = exponent; remaining > 0; remaining /= 2) {
+      if ((remaining % 2 == 1 && __builtin_mul_overflow(result, power, &result)) ||
+          (remaining > 1 && __builtin_mul_overflow(power, power, &power))) {
+        panic(std::format("pow: integer overflow for {} ^ {}", base, exponent),
+              span);
+      }
+    }
+    return result;
+  }
+  float operator()(float base, float exponent, Span_t = {}) const {
+    return std::pow(base, exponent);
+  }
+  std::string toJson_() const { return R"({ "Function": "pow" })"; }
+} pow_;
+
+// -- I/O --
+
+// An error returned by a builtin. Opaque in Yune, see `errorMessage`.
+struct Error_t {
+  String_t message;
+  bool operator==(const Error_t &other) const = default;
+};
+
+inline std::string toJson_(const Error_t &error) {
+  return std::format(R"({{ "Error": {{ "message": {} }} }})",
+                     toJson_(error.message));
+}
+
+inline struct errorMessage_f {
+  String_t operator()(const Error_t &error) const { return error.message; }
+  std::string toJson_() const { return R"({ "Function": "errorMessage" })"; }
+} errorMessage;
+
+inline struct readLine_f {
+  Union_t<String_t, std::tuple<>> operator()() const {
+    String_t line;
+    if (!std::getline(std::cin, line)) {
+      return std::make_tuple();
+    }
+    return line;
+  }
+  std::string toJson_() const { return R"({ "Function": "readLine" })"; }
+} readLine;
+
+inline struct readFile_f {
+  Union_t<String_t, Error_t> operator()(String_t path) const {
+    std::ifstream file(path, std::ios::binary);
+    if (!file) {
+      return Error_t{std::format("readFile: cannot open '{}'", path)};
+    }
+    std::stringstream contents;
+    contents << file.rdbuf();
+    if (file.bad()) {
+      return Error_t{std::format("readFile: cannot read '{}'", path)};
+    }
+    return contents.str();
+  }
+  std::string toJson_() const { return R"({ "Function": "readFile" })"; }
+} readFile;
+
+inline struct writeFile_f {
+  Union_t<std::tuple<>, Error_t> operator()(String_t path,
+                                            String_t contents) const {
+    std::ofstream file(path, std::ios::binary | std::ios::trunc);
+    if (!file) {
+      return Error_t{std::format("writeFile: cannot open '{}'", path)};
+    }
+    file << contents;
+    file.close();
+    if (file.fail()) {
+      return Error_t{std::format("writeFile: cannot write '{}'", path)};
+    }
+    return std::make_tuple();
+  }
+  std::string toJson_() const { return R"({ "Function": "writeFile" })"; }
+} writeFile;
+
+inline struct getEnv_f {
+  Union_t<String_t, std::tuple<>> operator()(String_t name) const {
+    const char *value = std::getenv(name.c_str());
+    if (value == nullptr) {
+      return std::make_tuple();
+    }
+    return String_t(value);
+  }
+  std::string toJson_() const { return R"({ "Function": "getEnv" })"; }
+} getEnv;
+
+// Calls the Yune main function from the C++ main function, passing the
+// command-line arguments and returning the exit status if main accepts them.
+template <class F> int runMain_(const F &main, int argc, char **argv) {
+  if constexpr (std::is_invocable_v<const F &, List_t<String_t>>) {
+    return main(List_t<String_t>(argv + 1, argv + argc)); // skip program name
+  } else {
+    main();
+    return 0;
+  }
+}
+
+// -- showing values --
+
+// Renders values in Yune syntax. Values without a Yune representation, such as
+// functions and expressions, are rendered as JSON.
+inline std::string show_(const int &i) { return std::to_string(i); }
+inline std::string show_(const bool &b) { return b ? "true" : "false"; }
+inline std::string show_(const float &f) {
+  if (!std::isfinite(f)) {
+    return std::format("{}", f); // nan, inf or -inf
+  }
+  std::string s = std::format("{}", f);
+  if (s.find_first_of(".e") == std::string::npos) {
+    s += ".0";
+  }
+  return s;
+}
+inline std::string show_(const String_t &s) { return toJson_(s); }
+inline std::string show_(const Error_t &error) {
+  return std::format("Error({})", show_(error.message));
+}
+inline std::string show_(const TypeType_t &) { return "Type"; }
+inline std::string show_(const IntType_t &) { return "Int"; }
+inline std::string show_(const FloatType_t &) { return "Float"; }
+inline std::string show_(const BoolType_t &) { return "Bool"; }
+inline std::string show_(const StringType_t &) { return "String"; }
+std::string show_(const TupleType_t &t);
+std::string show_(const ListType_t &t);
+std::string show_(const MapType_t &t);
+std::string show_(const FnType_t &t);
+std::string show_(const StructType_t &t);
+std::string show_(const UnionType_t &t);
+template <class T> std::string show_(const Box_t<T> &box);
+template <class T> std::string show_(const List_t<T> &list);
+template <class... T> std::string show_(const std::tuple<T...> &tuple);
+template <class K, class V> std::string show_(const Map_t<K, V> &map);
+template <class... T> std::string show_(const Union_t<T...> &_union);
+// Fallback for all other values.
+template <class T> std::string show_(const T &value);
+
+// Joins the shown elements of a range with ", ".
+template <class Range> std::string showJoined_(const Range &range) {
+  std::string result;
+  for (const auto &element : range) {
+    if (!result.empty()) {
+      result += ", ";
+    }
+    result += show_(element);
+  }
+  return result;
+}
+
+inline std::string show_(const TupleType_t &t) {
+  return std::format("({})", showJoined_(t.elements));
+}
+inline std::string show_(const ListType_t &t) {
+  return std::format("List({})", show_(t.element));
+}
+inline std::string show_(const MapType_t &t) {
+  return std::format("Map({}, {})", show_(t.key), show_(t.value));
+}
+inline std::string show_(const FnType_t &t) {
+  return std::format("Fn({}, {})", show_(t.argument), show_(t.returnType));
+}
+inline std::string show_(const StructType_t &t) { return t.name; }
+inline std::string show_(const UnionType_t &t) {
+  return std::format("Union[{}]", showJoined_(t.variants));
+}
+template <class T> std::string show_(const Box_t<T> &box) {
+  return show_(box.get());
+}
+template <class T> std::string show_(const List_t<T> &list) {
+  return std::format("[{}]", showJoined_(list));
+}
+template <class... T> std::string show_(const std::tuple<T...> &tuple) {
+  std::string result;
+  std::apply(
+      [&](const auto &...elements) {
+        ((result += (result.empty() ? "" : ", ") + show_(elements)), ...);
+      },
+      tuple);
+  return std::format("({})", result);
+}
+template <class K, class V> std::string show_(const Map_t<K, V> &map) {
+  std::string result;
+  for (const auto &[key, value] : map) {
+    if (!result.empty()) {
+      result += ", ";
+    }
+    result += std::format("({}, {})", show_(key), show_(value));
+  }
+  return std::format("toMap([{}])", result);
+}
+template <class... T> std::string show_(const Union_t<T...> &_union) {
+  if constexpr (sizeof...(T) == 0) {
+    return "";
+  } else {
+    return std::visit([](const auto &variant) { return show_(variant); },
+                      _union.variant);
+  }
+}
+template <class T> std::string show_(const T &value) { return toJson_(value); }
+
+inline struct show_f {
+  template <class T> String_t operator()(const T &value) const {
+    return show_(value);
+  }
+  std::string toJson_() const { return R"({ "Function": "show" })"; }
+} show;
+
+// Like `show`, except that strings are not quoted.
+inline struct toString_f {
+  template <class T> String_t operator()(const T &value) const {
+    if constexpr (std::is_same_v<T, String_t>) {
+      return value;
+    } else {
+      return show_(value);
+    }
+  }
+  // the active variant, which is not quoted either if it is a string
+  template <class... T> String_t operator()(const Union_t<T...> &_union) const {
+    if constexpr (sizeof...(T) == 0) {
+      return "";
+    } else {
+      return std::visit([this](const auto &variant) { return (*this)(variant); },
+                        _union.variant);
+    }
+  }
+  std::string toJson_() const { return R"({ "Function": "toString" })"; }
+} toString;
+
+inline struct print_f {
+  template <class T> std::tuple<> operator()(const T &value) const {
+    return printString(toString(value));
+  }
+  std::string toJson_() const { return R"({ "Function": "print" })"; }
+} print;
+
+inline struct println_f {
+  template <class T> std::tuple<> operator()(const T &value) const {
+    return printlnString(toString(value));
+  }
+  std::string toJson_() const { return R"({ "Function": "println" })"; }
+} println;
+
+// Implements `dbg(value)`, which prints a value with its location and static
+// type to stderr and returns it.
+template <class T> T dbg_(T value, Span_t span, const char *type) {
+  std::cerr << std::format("[{}] {}: {}", toString_(span), show_(value), type)
+            << std::endl;
+  return value;
+}
+
+// -- JSON --
+
+// The JSON encoding of Yune values used by `toJson` and `fromJson`. Unlike the
+// encoding of `toJson_`, which is internal to the compiler, it is stable:
+//  - Int and Float are numbers, where encoded floats always contain a '.' or
+//    an exponent. Non-finite floats are the strings "NaN", "Infinity" and
+//    "-Infinity".
+//  - Bool and String are booleans and strings.
+//  - Lists and tuples are arrays. The unit tuple `()` is `[]`.
+//  - Maps are arrays of `[key, value]` arrays.
+//  - Unions are the encoding of their value, without a tag. When decoding, an
+//    integer is decoded as Int if the union contains Int, otherwise the value is
+//    decoded as the first variant that accepts it.
+//  - `Error` is `{ "message": <String> }`. Other structs have no encoding, which
+//    the compiler reports.
+
+// A parsed JSON value.
+struct JsonValue_ {
+  struct Field;
+  enum class Kind { Null, Bool, Number, String, Array, Object };
+
+  Kind kind = Kind::Null;
+  bool boolean = false;
+  // The literal of a number or the contents of a string.
+  String_t text;
+  List_t<JsonValue_> elements;
+  List_t<Field> fields;
+
+  // Returns the field with the given name, or `nullptr` if it does not exist.
+  const JsonValue_ *field(const String_t &name) const;
+};
+
+struct JsonValue_::Field {
+  String_t name;
+  JsonValue_ value;
+};
+
+inline const JsonValue_ *JsonValue_::field(const String_t &name) const {
+  for (const Field &field : fields) {
+    if (field.name == name) {
+      return &field.value;
+    }
+  }
+  return nullptr;
+}
+
+// A recursive descent parser for JSON text.
+struct JsonParser_ {
+  const String_t &text;
+  size_t offset = 0;
+  String_t error;
+
+  // Parses the whole text, returning false on a syntax error.
+  bool parseDocument(JsonValue_ &value) {
+    if (!parseValue(value)) {
+      return false;
+    }
+    skipWhitespace();
+    return offset == text.size() || fail("unexpected trailing characters");
+  }
+
+private:
+  bool fail(const String_t &message) {
+    error = std::format("{} at offset {}", message, offset);
+    return false;
+  }
+
+  void skipWhitespace() {
+    while (offset < text.size() && std::isspace(static_cast<unsigned char>(text[offset]))) {
+      offset++;
+    }
+  }
+
+  bool consume(char c) {
+    skipWhitespace();
+    if (offset < text.size() && text[offset] == c) {
+      offset++;
+      return true;
+    }
+    return false;
+  }
+
+  bool consumeWord(std::string_view word) {
+    if (text.compare(offset, word.size(), word) == 0) {
+      offset += word.size();
+      return true;
+    }
+    return false;
+  }
+
+  bool parseValue(JsonValue_ &value) {
+    skipWhitespace();
+    if (offset >= text.size()) {
+      return fail("unexpected end of input");
+    }
+    char c = text[offset];
+    if (c == '{') {
+      return parseObject(value);
+    }
+    if (c == '[') {
+      return parseArray(value);
+    }
+    if (c == '"') {
+      value.kind = JsonValue_::Kind::String;
+      return parseString(value.text);
+    }
+    if (c == '-' || std::isdigit(static_cast<unsigned char>(c))) {
+      return parseNumber(value);
+    }
+    if (consumeWord("true") || consumeWord("false")) {
+      value.kind = JsonValue_::Kind::Bool;
+      value.boolean = c == 't';
+      return true;
+    }
+    if (consumeWord("null")) {
+      value.kind = JsonValue_::Kind::Null;
+      return true;
+    }
+    return fail("unexpected character");
+  }
+
+  bool parseObject(JsonValue_ &value) {
+    value.kind = JsonValue_::Kind::Object;
+    offset++; // {
+    if (consume('}')) {
+      return true;
+    }
+    do {
+      JsonValue_::Field field;
+      skipWhitespace();
+      if (offset >= text.size() || text[offset] != '"') {
+        return fail("expected field name");
+      }
+      if (!parseString(field.name)) {
+        return false;
+      }
+      if (!consume(':')) {
+        return fail("expected ':'");
+      }
+      if (!parseValue(field.value)) {
+        return false;
+      }
+      value.fields.push_back(std::move(field));
+    } while (consume(','));
+    return consume('}') || fail("expected ',' or '}'");
+  }
+
+  bool parseArray(JsonValue_ &value) {
+    value.kind = JsonValue_::Kind::Array;
+    offset++; // [
+    if (consume(']')) {
+      return true;
+    }
+    do {
+      value.elements.emplace_back();
+      if (!parseValue(value.elements.back())) {
+        return false;
+      }
+    } while (consume(','));
+    return consume(']') || fail("expected ',' or ']'");
+  }
+
+  // Skips the next character if it is one of `chars`, without whitespace.
+  bool accept(const char *chars) {
+    if (offset < text.size() && text[offset] != '\0' &&
+        std::strchr(chars, text[offset]) != nullptr) {
+      offset++;
+      return true;
+    }
+    return false;
+  }
+
+  // Skips a non-empty sequence of digits, returning false if there is none.
+  bool skipDigits() {
+    size_t start = offset;
+    while (accept("0123456789")) {
+    }
+    return offset > start;
+  }
+
+  // Parses `-? (0 | [1-9][0-9]*) (. [0-9]+)? ([eE] [+-]? [0-9]+)?`.
+  bool parseNumber(JsonValue_ &value) {
+    value.kind = JsonValue_::Kind::Number;
+    size_t start = offset;
+    accept("-");
+    if (accept("123456789")) {
+      skipDigits();
+    } else if (!accept("0")) {
+      return fail("invalid number");
+    }
+    if (accept(".") && !skipDigits()) {
+      return fail("expected digits after '.'");
+    }
+    if (accept("eE")) {
+      accept("+-");
+      if (!skipDigits()) {
+        return fail("expected digits in exponent");
+      }
+    }
+    value.text = text.substr(start, offset - start);
+    return true;
+  }
+
+  // Appends a code point as UTF-8.
+  static void appendUtf8(String_t &s, unsigned codePoint) {
+    if (codePoint < 0x80) {
+      s += static_cast<char>(codePoint);
+    } else if (codePoint < 0x800) {
+      s += static_cast<char>(0xC0 | (codePoint >> 6));
+      s += static_cast<char>(0x80 | (codePoint & 0x3F));
+    } else if (codePoint < 0x10000) {
+      s += static_cast<char>(0xE0 | (codePoint >> 12));
+      s += static_cast<char>(0x80 | ((codePoint >> 6) & 0x3F));
+      s += static_cast<char>(0x80 | (codePoint & 0x3F));
+    } else {
+      s += static_cast<char>(0xF0 | (codePoint >> 18));
+      s += static_cast<char>(0x80 | ((codePoint >> 12) & 0x3F));
+      s += static_cast<char>(0x80 | ((codePoint >> 6) & 0x3F));
+      s += static_cast<char>(0x80 | (codePoint & 0x3F));
+    }
+  }
+
+  bool parseHex4(unsigned &codePoint) {
+    if (offset + 4 > text.size()) {
+      return fail("incomplete unicode escape");
+    }
+    auto [ptr, error] = std::from_chars(text.data() + offset,
+                                        text.data() + offset + 4, codePoint, 16);
+    if (error != std::errc() || ptr != text.data() + offset + 4) {
+      return fail("invalid unicode escape");
+    }
+    offset += 4;
+    return true;
+  }
+
+  bool parseString(String_t &s) {
+    offset++; // "
+    while (offset < text.size()) {
+      char c = text[offset++];
+      if (c == '"') {
+        return true;
+      }
+      if (c != '\\') {
+        s += c;
+        continue;
+      }
+      if (offset >= text.size()) {
+        break;
+      }
+      switch (char escaped = text[offset++]) {
+      case '"':
+      case '\\':
+      case '/':
+        s += escaped;
+        break;
+      case 'b':
+        s += '\b';
+        break;
+      case 'f':
+        s += '\f';
+        break;
+      case 'n':
+        s += '\n';
+        break;
+      case 'r':
+        s += '\r';
+        break;
+      case 't':
+        s += '\t';
+        break;
+      case 'u': {
+        unsigned codePoint;
+        if (!parseHex4(codePoint)) {
+          return false;
+        }
+        // combine UTF-16 surrogate pairs
+        if (codePoint >= 0xD800 && codePoint < 0xDC00 &&
+            consumeWord("\\u")) {
+          unsigned low;
+          if (!parseHex4(low)) {
+            return false;
+          }
+          codePoint = 0x10000 + ((codePoint - 0xD800) << 10) + (low - 0xDC00);
+        }
+        appendUtf8(s, codePoint);
+        break;
+      }
+      default:
+        return fail("invalid escape sequence");
+      }
+    }
+    return fail("unterminated string");
+  }
+};
+
+inline String_t encodeJson_(const int &i) { return std::to_string(i); }
+inline String_t encodeJson_(const bool &b) { return b ? "true" : "false"; }
+inline String_t encodeJson_(const float &f) {
+  if (std::isnan(f)) {
+    return R"("NaN")";
+  }
+  if (std::isinf(f)) {
+    return f > 0 ? R"("Infinity")" : R"("-Infinity")";
+  }
+  return toJson_(f);
+}
+inline String_t encodeJson_(const String_t &s) { return toJson_(s); }
+inline String_t encodeJson_(const Error_t &error) {
+  return std::format(R"({{"message":{}}})", toJson_(error.message));
+}
+template <class T> String_t encodeJson_(const Box_t<T> &box);
+template <class T> String_t encodeJson_(const List_t<T> &list);
+template <class... T> String_t encodeJson_(const std::tuple<T...> &tuple);
+template <class K, class V> String_t encodeJson_(const Map_t<K, V> &map);
+template <class... T> String_t encodeJson_(const Union_t<T...> &_union);
+
+template <class T> String_t encodeJson_(const Box_t<T> &box) {
+  return encodeJson_(box.get());
+}
+template <class T> String_t encodeJson_(const List_t<T> &list) {
+  String_t result = "[";
+  for (size_t i = 0; i < list.size(); i++) {
+    result += (i > 0 ? "," : "") + encodeJson_(list[i]);
+  }
+  return result + "]";
+}
+template <class... T> String_t encodeJson_(const std::tuple<T...> &tuple) {
+  String_t result;
+  std::apply(
+      [&](const auto &...elements) {
+        ((result += (result.empty() ? "" : ",") + encodeJson_(elements)), ...);
+      },
+      tuple);
+  return "[" + result + "]";
+}
+template <class K, class V> String_t encodeJson_(const Map_t<K, V> &map) {
+  String_t result = "[";
+  for (const auto &[key, value] : map) {
+    result += (result.size() > 1 ? "," : "") +
+              std::format("[{},{}]", encodeJson_(key), encodeJson_(value));
+  }
+  return result + "]";
+}
+template <class... T> String_t encodeJson_(const Union_t<T...> &_union) {
+  return std::visit([](const auto &variant) { return encodeJson_(variant); },
+                    _union.variant);
+}
+
+// Each decoding function returns an error message, which is empty on success.
+
+inline String_t jsonKindError_(const char *expected, const JsonValue_ &json) {
+  constexpr const char *kinds[] = {"null",   "boolean", "number",
+                                   "string", "array",   "object"};
+  return std::format("expected {}, found {}", expected,
+                     kinds[static_cast<int>(json.kind)]);
+}
+
+inline bool isJsonInteger_(const JsonValue_ &json) {
+  return json.kind == JsonValue_::Kind::Number &&
+         json.text.find_first_of(".eE") == String_t::npos;
+}
+
+inline String_t decodeJson_(const JsonValue_ &json, int &out) {
+  if (!isJsonInteger_(json)) {
+    return jsonKindError_("integer", json);
+  }
+  const char *end = json.text.data() + json.text.size();
+  auto [ptr, error] = std::from_chars(json.text.data(), end, out);
+  if (error != std::errc() || ptr != end) {
+    return std::format("integer {} is out of range", json.text);
+  }
+  return "";
+}
+inline String_t decodeJson_(const JsonValue_ &json, float &out) {
+  if (json.kind == JsonValue_::Kind::String) {
+    if (json.text == "NaN") {
+      out = std::numeric_limits<float>::quiet_NaN();
+    } else if (json.text == "Infinity") {
+      out = std::numeric_limits<float>::infinity();
+    } else if (json.text == "-Infinity") {
+      out = -std::numeric_limits<float>::infinity();
+    } else {
+      return jsonKindError_("number", json);
+    }
+    return "";
+  }
+  if (json.kind != JsonValue_::Kind::Number) {
+    return jsonKindError_("number", json);
+  }
+  char *end;
+  out = std::strtof(json.text.c_str(), &end);
+  if (end != json.text.c_str() + json.text.size()) {
+    return std::format("invalid number {}", json.text);
+  }
+  return "";
+}
+inline String_t decodeJson_(const JsonValue_ &json, bool &out) {
+  if (json.kind != JsonValue_::Kind::Bool) {
+    return jsonKindError_("boolean", json);
+  }
+  out = json.boolean;
+  return "";
+}
+inline String_t decodeJson_(const JsonValue_ &json, String_t &out) {
+  if (json.kind != JsonValue_::Kind::String) {
+    return jsonKindError_("string", json);
+  }
+  out = json.text;
+  return "";
+}
+inline String_t decodeJson_(const JsonValue_ &json, Error_t &out) {
+  if (json.kind != JsonValue_::Kind::Object) {
+    return jsonKindError_("object", json);
+  }
+  const JsonValue_ *message = json.field("message");
+  if (message == nullptr) {
+    return "missing field 'message'";
+  }
+  return decodeJson_(*message, out.message);
+}
+template <class T> String_t decodeJson_(const JsonValue_ &json, List_t<T> &out);
+template <class... T>
+String_t decodeJson_(const JsonValue_ &json, std::tuple<T...> &out);
+template <class K, class V>
+String_t decodeJson_(const JsonValue_ &json, Map_t<K, V> &out);
+template <class... T>
+String_t decodeJson_(const JsonValue_ &json, Union_t<T...> &out);
+
+template <class T>
+String_t decodeJson_(const JsonValue_ &json, List_t<T> &out) {
+  if (json.kind != JsonValue_::Kind::Array) {
+    return jsonKindError_("array", json);
+  }
+  out.resize(json.elements.size());
+  for (size_t i = 0; i < json.elements.size(); i++) {
+    String_t error = decodeJson_(json.elements[i], out[i]);
+    if (!error.empty()) {
+      return std::format("[{}]: {}", i, error);
+    }
+  }
+  return "";
+}
+template <class... T>
+String_t decodeJson_(const JsonValue_ &json, std::tuple<T...> &out) {
+  if (json.kind != JsonValue_::Kind::Array) {
+    return jsonKindError_("array", json);
+  }
+  if (json.elements.size() != sizeof...(T)) {
+    return std::format("expected array of length {}, found length {}",
+                       sizeof...(T), json.elements.size());
+  }
+  String_t error;
+  size_t i = 0;
+  std::apply(
+      [&](auto &...elements) {
+        (([&] {
+           if (error.empty()) {
+             error = decodeJson_(json.elements[i], elements);
+             if (!error.empty()) {
+               error = std::format("[{}]: {}", i, error);
+             }
+             i++;
+           }
+         }()),
+         ...);
+      },
+      out);
+  return error;
+}
+template <class K, class V>
+String_t decodeJson_(const JsonValue_ &json, Map_t<K, V> &out) {
+  List_t<std::tuple<K, V>> entries;
+  String_t error = decodeJson_(json, entries);
+  for (auto &[key, value] : entries) {
+    out.insert_or_assign(std::move(key), std::move(value));
+  }
+  return error;
+}
+template <class... T>
+String_t decodeJson_(const JsonValue_ &json, Union_t<T...> &out) {
+  if constexpr ((std::is_same_v<T, int> || ...)) {
+    if (isJsonInteger_(json)) {
+      int value;
+      String_t error = decodeJson_(json, value);
+      if (error.empty()) {
+        out = value;
+      }
+      return error;
+    }
+  }
+  String_t errors;
+  bool decoded = false;
+  auto tryVariant = [&]<class V>(std::type_identity<V>) {
+    if (decoded) {
+      return;
+    }
+    V value;
+    String_t error = decodeJson_(json, value);
+    if (error.empty()) {
+      out = std::move(value);
+      decoded = true;
+    } else {
+      errors += (errors.empty() ? "" : "; ") + error;
+    }
+  };
+  // tries the variants in order until one succeeds
+  (tryVariant(std::type_identity<T>{}), ...);
+  return decoded ? "" : std::format("no union variant matches ({})", errors);
+}
+
+inline struct toJson_f {
+  template <class T> String_t operator()(const T &value) const {
+    return encodeJson_(value);
+  }
+  std::string toJson_() const { return R"({ "Function": "toJson" })"; }
+} toJson;
+
+// Implements `fromJson(text, T)`, where the type is known at compile time.
+// `Return` is the lowered `Union[T, Error]`, which is flattened if T is a union.
+template <class T, class Return> Return fromJson_(const String_t &text) {
+  JsonValue_ json;
+  JsonParser_ parser{.text = text};
+  if (!parser.parseDocument(json)) {
+    return Error_t{"fromJson: " + parser.error};
+  }
+  T value;
+  String_t error = decodeJson_(json, value);
+  if (!error.empty()) {
+    return Error_t{"fromJson: " + error};
+  }
+  return value;
+}
+
 template <typename U, typename... T> bool isSubset_(U _union) {
   bool found = (std::holds_alternative<T>(_union.variant) || ...);
   return found;
@@ -852,7 +2312,8 @@ template <typename U, typename T> bool isVariant_(U _union) {
   return std::holds_alternative<T>(_union.variant);
 }
 
-template <typename U, typename... T> Union_t<T...> getSubset_(U _union) {
+template <typename U, typename... T>
+Union_t<T...> getSubset_(U _union, Span_t span) {
   std::optional<Union_t<T...>> result;
   (
       [&] {
@@ -864,12 +2325,12 @@ template <typename U, typename... T> Union_t<T...> getSubset_(U _union) {
   if (result.has_value()) {
     return result.value();
   }
-  panic("getSubset: variant mismatch");
+  panic("getSubset: variant mismatch", span);
 }
 
-template <typename U, typename T> T getVariant_(U _union) {
+template <typename U, typename T> T getVariant_(U _union, Span_t span) {
   if (!std::holds_alternative<T>(_union.variant)) {
-    panic("getVariant: variant mismatch");
+    panic("getVariant: variant mismatch", span);
   }
   return std::get<T>(_union.variant);
 }
@@ -0,0 +1,107 @@
+package cpp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	fj "github.com/valyala/fastjson"
+)
+
+// Version of the protocol between the compiler and ipc.hpp (synchronised with YUNE_PROTOCOL_VERSION).
+// It must be increased whenever a message is added or changed.
+const ProtocolVersion = 2
+
+// Messages larger than this are rejected, since they can only come from a corrupted stream.
+const maxMessageSize = 1 << 30
+
+// Messages sent by ipc.hpp over the compiler connection.
+// Each message is a JSON object preceded by its length in bytes as a 32-bit big-endian integer.
+// Its "type" field selects one of these schemas, which list the other fields it must have.
+// All messages except "hello" have an "id" field with the ID of the request they belong to.
+var messageSchemas = map[string][]messageField{
+	// sent once after connecting
+	"hello": {{"version", fj.TypeNumber}},
+	// the value of an evaluation
+	"result": {{"id", fj.TypeNumber}, {"value", anyJson}},
+	// a panic ("panic") or C++ exception ("exception") that stopped an evaluation
+	"error": {{"id", fj.TypeNumber}, {"kind", fj.TypeString}, {"message", fj.TypeString}, {"callStack", fj.TypeArray}},
+	// the "result" and "error" messages of the evaluations in a batch, in order
+	"results": {{"id", fj.TypeNumber}, {"results", fj.TypeArray}},
+	// asks for the type of a declaration, answered with `compiler_connection.set_type`
+	"getType": {{"id", fj.TypeNumber}, {"name", fj.TypeString}},
+	// answers `compiler_connection.send_finished`
+	"finished": {{"id", fj.TypeNumber}},
+}
+
+type messageField struct {
+	name  string
+	_type fj.Type
+}
+
+// Accepts any JSON value in a message schema.
+const anyJson fj.Type = -1
+
+// Returned when clang-repl sends a message that does not follow the protocol.
+type ProtocolError struct {
+	Message string
+}
+
+func (e ProtocolError) Error() string {
+	return "Invalid message from clang-repl: " + e.Message
+}
+
+// A message received from ipc.hpp, which has been checked against its schema.
+type message struct {
+	Type  string
+	ID    int
+	Value *fj.Value
+}
+
+// Reads a single message, returning the error of the reader as-is so that timeouts and exits can be detected.
+func readMessage(reader io.Reader) (m message, err error) {
+	var header [4]byte
+	if _, err = io.ReadFull(reader, header[:]); err != nil {
+		return
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxMessageSize {
+		err = ProtocolError{fmt.Sprintf("Message of %d bytes exceeds the maximum size.", size)}
+		return
+	}
+	body := make([]byte, size)
+	if _, err = io.ReadFull(reader, body); err != nil {
+		return
+	}
+	value, parseErr := fj.ParseBytes(body)
+	if parseErr != nil {
+		err = ProtocolError{fmt.Sprintf("Malformed JSON '%s'. Error: %s", body, parseErr)}
+		return
+	}
+	m, err = checkMessage(value)
+	return
+}
+
+// Checks that `value` matches the schema of its message type.
+func checkMessage(value *fj.Value) (m message, err error) {
+	m.Value = value
+	m.Type = string(value.GetStringBytes("type"))
+	m.ID = value.GetInt("id")
+	schema, ok := messageSchemas[m.Type]
+	if !ok {
+		err = ProtocolError{fmt.Sprintf("Unknown message type in '%s'.", value)}
+		return
+	}
+	for _, field := range schema {
+		fieldValue := value.Get(field.name)
+		if fieldValue == nil {
+			err = ProtocolError{fmt.Sprintf("Message '%s' is missing field '%s'.", value, field.name)}
+			return
+		}
+		if field._type != anyJson && fieldValue.Type() != field._type {
+			err = ProtocolError{fmt.Sprintf("Field '%s' of message '%s' should be a %s.", field.name, value, field._type)}
+			return
+		}
+	}
+	return
+}
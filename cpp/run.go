@@ -7,7 +7,11 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
 )
 
 func createFile(dir, name string) *os.File {
@@ -27,51 +31,121 @@ func writeFile(dir, name, contents string) *os.File {
 	return file
 }
 
-func CompileLibrary(module Module) {
-	libraryPath := "library.hpp"
-	writeFile(os.ExpandEnv("$PWD"), libraryPath, module)
-	fmt.Println("-- Compilation Finished --")
-	return
+// Writes the module as a header at `outputPath`.
+func CompileLibrary(module Module, outputPath string) {
+	dir, name := path.Split(outputPath)
+	writeFile(dir, name, module)
+	fmt.Fprintln(os.Stderr, "-- Compilation Finished --")
 }
 
-func Run(module Module) (stdout, stderr string) {
-	// NOTE: main function is assumed to exist
+// Calls the main function of the module, which is assumed to exist.
+const mainFunction = `
+int main(int argc, char **argv) {
+    return runMain_(main_, argc, argv);
+}`
 
+// Compiles the translation units in parallel and links them to an executable at `outputPath`.
+// Units that are unchanged since an earlier build are not compiled again, see compileUnit.
+// Returns a CompileError if clang++ fails to compile or link the units.
+func Build(units Units, outputPath string, options BuildOptions) (err error) {
 	dir, err := os.MkdirTemp("", "yune-build")
 	if err != nil {
 		log.Fatalln("Failed to create temporary directory during compilation process. Error:", err)
 	}
-	defer os.RemoveAll(dir)
-
-	writeFile(dir, "code.cpp", module+`
-int main() {
-    main_();
-    return 0;
-}`)
+	if options.Debug {
+		log.Printf("Keeping generated sources in '%s'.\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
 
-	implementationPath := path.Join(dir, "code.cpp")
-	binaryPath := "./program"
+	header := "#pragma once\n" + units.Header
+	writeFile(dir, "module.hpp", header).Close()
+	all := append(slices.Clone(units.Units), Unit{Name: "main", Code: mainFunction})
+	objects := make([]string, len(all))
+	outputs := make([]string, len(all))
+	errs := make([]error, len(all))
 
 	fmt.Fprintln(os.Stderr, "-- Clang++ log --")
-	includes := os.ExpandEnv("-I$PWD/cpp")
-	cmd := exec.Command("clang++", "-O1", "-std=c++23", implementationPath, "-o", binaryPath, includes)
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	wg := sync.WaitGroup{}
+	parallel := make(chan struct{}, runtime.NumCPU())
+	for i, unit := range all {
+		source := `#include "module.hpp"` + "\n" + unit.Code
+		name := fmt.Sprintf("unit%d.cpp", i)
+		writeFile(dir, name, source).Close()
+		wg.Go(func() {
+			parallel <- struct{}{}
+			defer func() { <-parallel }()
+			objects[i], outputs[i], errs[i] = compileUnit(unit, path.Join(dir, name), header+source, dir, options)
+		})
+	}
+	wg.Wait()
+	compileError, failed := CompileError{}, false
+	for i := range all {
+		switch err := errs[i].(type) {
+		case nil:
+			// warnings
+			fmt.Fprint(os.Stderr, outputs[i])
+		case CompileError:
+			failed = true
+			compileError.Diagnostics = append(compileError.Diagnostics, err.Diagnostics...)
+			compileError.Output += err.Output
+		default:
+			log.Fatalln("Failed to compile a translation unit. Error:", err)
+		}
+	}
+	if failed {
+		return compileError
+	}
+
+	flags := append([]string{options.optimizationFlag()}, options.codeGenerationFlags()...)
+	flags = append(flags, objects...)
+	flags = append(flags, options.linkFlags()...)
+	output, err := runCompiler(append(flags, "-o", outputPath))
+	fmt.Fprint(os.Stderr, output)
+	return
+}
+
+// Compiles the units to a temporary executable and runs it with the given command-line arguments.
+// Stdin is forwarded to the program, while stdout and stderr are both streamed and returned.
+// Returns a CompileError if clang++ fails to compile the module.
+func Run(units Units, args []string, options BuildOptions) (stdout, stderr string, exitCode int, err error) {
+	dir, err := os.MkdirTemp("", "yune-run")
 	if err != nil {
-		log.Fatalln("Failed to compile code. Error:", err)
+		log.Fatalln("Failed to create temporary directory during compilation process. Error:", err)
+	}
+	defer os.RemoveAll(dir)
+	binaryPath := path.Join(dir, "program")
+	if err = Build(units, binaryPath, options); err != nil {
+		return
 	}
+	stdout, stderr, exitCode = RunExecutable(binaryPath, args)
+	return
+}
+
+// Runs a built executable with the given command-line arguments, like Run.
+func RunExecutable(binaryPath string, args []string) (stdout, stderr string, exitCode int) {
 	fmt.Fprintln(os.Stderr, "-- Output --")
 	stdoutWriter := strings.Builder{}
 	stderrWriter := strings.Builder{}
-	cmd = exec.Command(binaryPath)
+	cmd := exec.Command(binaryPath, args...)
+	cmd.Stdin = os.Stdin
 	cmd.Stdout = io.MultiWriter(os.Stdout, &stdoutWriter)
 	cmd.Stderr = io.MultiWriter(os.Stderr, &stderrWriter)
-	err = cmd.Run()
+	err := cmd.Run()
+	stdout = stdoutWriter.String()
+	stderr = stderrWriter.String()
+	if exitError, ok := err.(*exec.ExitError); ok {
+		// also covers programs killed by a signal, for which ExitCode returns -1
+		exitCode = exitError.ExitCode()
+		if exitCode < 0 {
+			exitCode = 128 + int(exitError.Sys().(syscall.WaitStatus).Signal())
+		}
+		fmt.Fprintf(os.Stderr, "-- Exited with status %d --\n", exitCode)
+		return
+	}
 	if err != nil {
 		log.Fatalln("Failed to run code. Error:", err)
 	}
 	fmt.Fprintln(os.Stderr, "-- Completed --")
-	stdout = stdoutWriter.String()
-	stderr = stderrWriter.String()
 	return
 }
@@ -0,0 +1,184 @@
+package cpp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A lowered module split into translation units, so that clang++ only compiles the units that changed.
+type Units struct {
+	// The declarations of everything that the units define, which every unit includes.
+	// If there are no units, it also contains the definitions, which are compiled with the unit that calls `main`.
+	Header Module
+	Units  []Unit
+}
+
+// The definitions of a translation unit.
+type Unit struct {
+	// The Yune file that the definitions come from.
+	Name string
+	Code string
+}
+
+// The version of clang++, since objects compiled by another version are not reused.
+var clangVersion = sync.OnceValue(func() string {
+	output, err := exec.Command("clang++", "--version").Output()
+	if err != nil {
+		log.Println("Failed to get the version of clang++, disabling the object cache. Error:", err)
+		return ""
+	}
+	return string(output)
+})
+
+// Compiles a translation unit to an object file, returning its path and the output of clang++.
+// `source` is the code of the unit including the header, which identifies it.
+// Objects are cached in the "objects" directory of `options.CacheDir` by the hash of the unit and flags,
+// along with the hashes of the non-system headers they include, which must not have changed to reuse them.
+// Debug builds are not cached, since their debug information refers to the generated sources.
+func compileUnit(unit Unit, sourcePath string, source string, buildDir string, options BuildOptions) (object string, output string, err error) {
+	flags := append(options.compilerFlags(), options.codeGenerationFlags()...)
+	flags = append(flags, "-DYUNE_INLINE=")
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%d\n%s\n", clangVersion(), strings.Join(flags, "\x00"), len(source), source)
+	key := hex.EncodeToString(hash.Sum(nil))
+	flags = append(flags, "-c", sourcePath)
+
+	cached := options.CacheDir != "" && !options.NoCache && !options.Debug && clangVersion() != ""
+	if !cached {
+		object = strings.TrimSuffix(sourcePath, ".cpp") + ".o"
+		output, err = runCompiler(append(flags, "-o", object))
+		return
+	}
+	object = filepath.Join(options.CacheDir, "objects", key[:2], key+".o")
+	manifest := strings.TrimSuffix(object, ".o") + ".deps"
+	if dependenciesUnchanged(manifest) {
+		log.Printf("Using cached object '%s' for '%s'.\n", object, unit.Name)
+		return
+	}
+	depfile := strings.TrimSuffix(sourcePath, ".cpp") + ".d"
+	err = replaceFile(object, func(temporary string) (err error) {
+		output, err = runCompiler(append(flags, "-o", temporary, "-MMD", "-MF", depfile))
+		return
+	})
+	if err != nil {
+		return
+	}
+	if err := writeManifest(manifest, depfile, buildDir); err != nil {
+		log.Println("Failed to write object cache manifest. Error:", err)
+	}
+	return
+}
+
+// Runs clang++, returning a CompileError if it fails.
+func runCompiler(flags []string) (output string, err error) {
+	log.Printf("Compiling with clang++ %s\n", strings.Join(flags, " "))
+	cmd := exec.Command("clang++", flags...)
+	compilerOutput := strings.Builder{}
+	cmd.Stderr = &compilerOutput
+	if err = cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			log.Fatalln("Failed to run clang++. Error:", err)
+		}
+		return "", CompileError{
+			Diagnostics: ParseDiagnostics(compilerOutput.String()),
+			Output:      compilerOutput.String(),
+		}
+	}
+	return compilerOutput.String(), nil
+}
+
+// Writes a file in the cache through a temporary file, so that concurrent compilers never read a partial file.
+func replaceFile(path string, write func(temporary string) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "writing-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	if err = write(file.Name()); err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// Records the hashes of the headers listed in the depfile written by clang++,
+// except the generated ones in `buildDir`, which are part of the cache key.
+func writeManifest(manifest string, depfile string, buildDir string) error {
+	contents, err := os.ReadFile(depfile)
+	if err != nil {
+		return err
+	}
+	lines := strings.Builder{}
+	for _, dependency := range parseDepfile(string(contents)) {
+		if strings.HasPrefix(dependency, buildDir+string(filepath.Separator)) {
+			continue
+		}
+		hash, err := hashFile(dependency)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&lines, "%s %s\n", hash, dependency)
+	}
+	return replaceFile(manifest, func(temporary string) error {
+		return os.WriteFile(temporary, []byte(lines.String()), 0o644)
+	})
+}
+
+// Whether the object of a manifest exists and none of the headers it includes have changed.
+func dependenciesUnchanged(manifest string) bool {
+	contents, err := os.ReadFile(manifest)
+	if err != nil {
+		return false
+	}
+	if _, err := os.Stat(strings.TrimSuffix(manifest, ".deps") + ".o"); err != nil {
+		return false
+	}
+	for line := range strings.Lines(string(contents)) {
+		expected, dependency, ok := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		if !ok {
+			return false
+		}
+		if hash, err := hashFile(dependency); err != nil || hash != expected {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the prerequisites of a Makefile rule written by clang++ with -MF.
+func parseDepfile(contents string) (dependencies []string) {
+	_, prerequisites, _ := strings.Cut(contents, ": ")
+	prerequisites = strings.ReplaceAll(prerequisites, "\\\n", " ")
+	// spaces in paths are escaped
+	prerequisites = strings.ReplaceAll(prerequisites, "\\ ", "\x00")
+	for _, field := range strings.Fields(prerequisites) {
+		dependencies = append(dependencies, strings.ReplaceAll(field, "\x00", " "))
+	}
+	return
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
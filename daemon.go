@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"yune/ast"
+	"yune/cpp"
+)
+
+// Compile through the daemon started with `yune daemon`, set by -daemon.
+var useDaemon bool
+
+// Path of the socket that the daemon listens on, set by -daemon-socket.
+var daemonSocket string
+
+// The socket used when -daemon-socket is not given, which is private to the user.
+func defaultDaemonSocket() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	return filepath.Join(cacheDir, "yune", "daemon.sock")
+}
+
+func daemonSocketPath() string {
+	if daemonSocket != "" {
+		return daemonSocket
+	}
+	return defaultDaemonSocket()
+}
+
+// The number of sessions that the daemon keeps, each of which keeps a clang-repl running.
+const maxDaemonSessions = 4
+
+// A compile request sent to the daemon, which is encoded as a line of JSON.
+type daemonRequest struct {
+	// "build" or "run"
+	Command string
+	// Absolute path of the file to compile.
+	File string
+	// Path of the built executable or library, which may be relative to Dir. Empty selects the default of `yune build`.
+	Output string
+	// Working directory of the client.
+	Dir         string
+	Options     cpp.BuildOptions
+	ImportPaths []string
+	// The directories of the client's YUNE_PATH, which are absolute.
+	YunePath []string
+}
+
+// The answer of the daemon to a daemonRequest.
+type daemonResponse struct {
+	// Errors found while compiling, which are printed by the client.
+	Errors []string
+	// For "run", the executable built in a temporary directory, which the client runs and removes.
+	Executable string
+}
+
+// Keeps the sessions of recently compiled modules, so that their imports are only analyzed once.
+type daemon struct {
+	listener net.Listener
+	// Sessions by sessionKey, ordered from least to most recently used.
+	sessions []daemonSession
+	// The imports of files by the hash of their contents, so that unchanged files are not parsed again.
+	fileImports map[string][]string
+}
+
+type daemonSession struct {
+	key string
+	// Identifies the options of the session, which a session for other imports can only reuse if they are equal.
+	optionsKey string
+	session    *ast.Session
+}
+
+func errorStrings(errors ast.Errors) (messages []string) {
+	for _, err := range errors {
+		messages = append(messages, err.Error())
+	}
+	return
+}
+
+func hashString(s string) string {
+	hash := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(hash[:])
+}
+
+// Starts the daemon, which handles compile requests one at a time until it is interrupted.
+func runDaemon() {
+	stop := startDaemon()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	<-interrupt
+	signal.Stop(interrupt)
+	stop()
+}
+
+// Starts handling compile requests in the background, returning a function that stops the daemon
+// and waits until its sessions are closed.
+func startDaemon() (stop func()) {
+	socketPath := daemonSocketPath()
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		log.Fatalf("A daemon is already listening on '%s'.\n", socketPath)
+	}
+	// the socket of a daemon that did not exit cleanly
+	os.Remove(socketPath)
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0o700); err != nil {
+		log.Fatalln("Failed to create the directory of the daemon socket. Error:", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		log.Fatalln("Failed to listen on the daemon socket. Error:", err)
+	}
+	d := &daemon{listener: listener, fileImports: map[string][]string{}}
+	stopped := make(chan struct{})
+	go func() {
+		d.run()
+		close(stopped)
+	}()
+	log.Printf("Daemon listening on '%s'.\n", socketPath)
+	return func() {
+		listener.Close()
+		<-stopped
+	}
+}
+
+// Handles requests until the listener is closed, then closes the sessions.
+func (d *daemon) run() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			break
+		}
+		d.serve(conn)
+	}
+	log.Println("Stopping daemon...")
+	for _, s := range d.sessions {
+		s.session.Close()
+	}
+}
+
+// Answers the request sent over `conn`.
+func (d *daemon) serve(conn net.Conn) {
+	defer conn.Close()
+	var request daemonRequest
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		log.Println("Failed to read daemon request. Error:", err)
+		return
+	}
+	log.Printf("Daemon compiling '%s' for '%s'.\n", request.File, request.Command)
+	if request.Options.RuntimeDir == "" {
+		request.Options.RuntimeDir = runtimeDir()
+	}
+	if request.Options.CacheDir == "" {
+		request.Options.CacheDir = compilerCacheDir()
+	}
+	response := d.handle(request)
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		log.Println("Failed to send daemon response. Error:", err)
+	}
+}
+
+// Compiles the requested file, reusing the session of its imports if none of them changed.
+func (d *daemon) handle(request daemonRequest) (response daemonResponse) {
+	var key string
+	reportError := func(err error) {
+		response.Errors = append(response.Errors, err.Error())
+	}
+	// errors reported through Analyzer.ReportError close the evaluator, so the session cannot be reused
+	defer func() {
+		if r := recover(); r != nil {
+			analyzerError, ok := r.(ast.AnalyzerError)
+			if !ok {
+				panic(r)
+			}
+			reportError(analyzerError)
+			d.removeSession(key)
+		}
+	}()
+	// imports are searched like the client would, restoring the search path of the daemon's own process afterwards
+	defer func(paths, sourcePaths, yune []string) {
+		importPaths, sourceImportPaths, yunePath = paths, sourcePaths, yune
+	}(importPaths, sourceImportPaths, yunePath)
+	importPaths, yunePath = request.ImportPaths, request.YunePath
+	sourceCode, err := os.ReadFile(request.File)
+	if err != nil {
+		reportError(err)
+		return
+	}
+	module, err := parseFile(request.File, string(sourceCode))
+	if err != nil {
+		reportError(err)
+		return
+	}
+	options := request.Options
+	if err := applyBuildDirectives(request.File, module.BuildDirectives, &options); err != nil {
+		reportError(err)
+		return
+	}
+	files, err := importedFiles(request.File, module.Imports, d.fileImports)
+	if err != nil {
+		reportError(err)
+		return
+	}
+	key = sessionKey(files, options)
+	session, errors := d.session(key, optionsKey(options), files, options)
+	if len(errors) > 0 {
+		response.Errors = errorStrings(errors)
+		return
+	}
+	cppModule, spans, hasMainFunction, errors := session.Lower(module)
+	if len(errors) > 0 {
+		response.Errors = errorStrings(errors)
+		return
+	}
+	output := request.Output
+	switch {
+	case !hasMainFunction && output == "":
+		output = "library.hpp"
+	case hasMainFunction && request.Command == "run":
+		dir, err := os.MkdirTemp("", "yune-run")
+		if err != nil {
+			reportError(err)
+			return
+		}
+		output = filepath.Join(dir, "program")
+	case output == "":
+		output = strings.TrimSuffix(filepath.Base(request.File), ".un")
+	}
+	if !filepath.IsAbs(output) {
+		output = filepath.Join(request.Dir, output)
+	}
+	if !hasMainFunction {
+		log.Printf("Module does not have a `main` function. Compiling a library to '%s'.\n", output)
+		cpp.CompileLibrary(cppModule, output)
+		return
+	}
+	if err := cpp.Build(session.Units(), output, options); err != nil {
+		if request.Command == "run" {
+			os.RemoveAll(filepath.Dir(output))
+		}
+		response.Errors = errorStrings(spans.Translate(err.(cpp.CompileError), ast.Span{}))
+		return
+	}
+	if request.Command == "run" {
+		response.Executable = output
+	}
+	return
+}
+
+// Identifies the imported files and options that a session was created with.
+func sessionKey(files []importedFile, options cpp.BuildOptions) string {
+	key := optionsKey(options)
+	for _, file := range files {
+		key += "\n" + file.Path + " " + file.Hash
+	}
+	return hashString(key)
+}
+
+func optionsKey(options cpp.BuildOptions) string {
+	return hashString(fmt.Sprintf("%#v", options))
+}
+
+// Returns the session for the imported files, creating it if it does not exist yet.
+// A new session replaces the most recently used session with the same options,
+// reusing the declarations of its imports that have not changed.
+func (d *daemon) session(key string, optionsKey string, files []importedFile, options cpp.BuildOptions) (session *ast.Session, errors ast.Errors) {
+	if i := slices.IndexFunc(d.sessions, func(s daemonSession) bool { return s.key == key }); i >= 0 {
+		s := d.sessions[i]
+		d.sessions = append(slices.Delete(d.sessions, i, i+1), s)
+		log.Println("Reusing the analysis of the imports.")
+		return s.session, nil
+	}
+	var previous *ast.Session
+	i := -1
+	for j, s := range slices.Backward(d.sessions) {
+		if s.optionsKey == optionsKey {
+			i = j
+			break
+		}
+	}
+	if i >= 0 {
+		previous = d.sessions[i].session
+		log.Println("Analyzing the changed imports.")
+	} else {
+		log.Println("Analyzing the imports.")
+	}
+	if session, errors = importSession(files, options, previous); len(errors) > 0 {
+		return
+	}
+	if previous != nil {
+		previous.Close()
+		d.sessions = slices.Delete(d.sessions, i, i+1)
+	} else if len(d.sessions) == maxDaemonSessions {
+		d.sessions[0].session.Close()
+		d.sessions = d.sessions[1:]
+	}
+	d.sessions = append(d.sessions, daemonSession{key, optionsKey, session})
+	return
+}
+
+// Forgets a session, which has been closed.
+func (d *daemon) removeSession(key string) {
+	d.sessions = slices.DeleteFunc(d.sessions, func(s daemonSession) bool { return s.key == key })
+}
+
+// Sends a request to the daemon, returning false if no daemon is listening.
+func requestDaemon(request daemonRequest) (response daemonResponse, ok bool) {
+	conn, err := net.Dial("unix", daemonSocketPath())
+	if err != nil {
+		log.Println("No daemon is listening, compiling directly. Error:", err)
+		return
+	}
+	defer conn.Close()
+	if err = json.NewEncoder(conn).Encode(request); err != nil {
+		log.Fatalln("Failed to send request to the daemon. Error:", err)
+	}
+	if err = json.NewDecoder(conn).Decode(&response); err != nil {
+		log.Fatalln("Failed to read the response of the daemon. Error:", err)
+	}
+	return response, true
+}
+
+// Builds or runs the file through the daemon, as `command` would do directly.
+// Returns false if no daemon is listening.
+func compileWithDaemon(command string, filePath string, outputPath string, args []string, options cpp.BuildOptions) (exitCode int, ok bool) {
+	dir, err := os.Getwd()
+	if err != nil {
+		log.Fatalln("Failed to get the working directory. Error:", err)
+	}
+	absolutePath, err := filepath.Abs(filePath)
+	if err != nil {
+		log.Fatalln("Failed to get the absolute path of the file. Error:", err)
+	}
+	// the daemon runs in a different directory
+	if options.RuntimeDir != "" {
+		options.RuntimeDir, _ = filepath.Abs(options.RuntimeDir)
+	}
+	absoluteDirs := func(dirs []string) []string {
+		absolute := []string{}
+		for _, dir := range dirs {
+			absoluteDir, _ := filepath.Abs(dir)
+			absolute = append(absolute, absoluteDir)
+		}
+		return absolute
+	}
+	response, ok := requestDaemon(daemonRequest{
+		Command:     command,
+		File:        absolutePath,
+		Output:      outputPath,
+		Dir:         dir,
+		Options:     options,
+		ImportPaths: absoluteDirs(importPaths),
+		YunePath:    absoluteDirs(yunePathDirs()),
+	})
+	if !ok {
+		return
+	}
+	if len(response.Errors) > 0 {
+		for _, err := range response.Errors {
+			log.Println("Error:", err)
+		}
+		log.Fatalln("Errors found, exiting.")
+	}
+	if response.Executable != "" {
+		defer os.RemoveAll(filepath.Dir(response.Executable))
+		_, _, exitCode = cpp.RunExecutable(response.Executable, args)
+	}
+	return
+}
@@ -1,8 +1,22 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"yune/ast"
+	"yune/cpp"
 )
 
 func assertEq[T comparable](found T, expected T) {
@@ -31,6 +45,49 @@ func expectPanic(run func(), failMessage string) {
 	}
 }
 
+// Runs a compilation that is expected to fail, returning the message of the error it reports.
+func expectAnalyzerError(run func(), failMessage string) (message string) {
+	defer func() {
+		r := recover()
+		analyzerError, ok := r.(ast.AnalyzerError)
+		if !ok {
+			panic(fmt.Sprintf("%s Recovered: %v", failMessage, r))
+		}
+		message = analyzerError.Message
+	}()
+	run()
+	return
+}
+
+func assertContains(text string, substring string) {
+	if !strings.Contains(text, substring) {
+		panic(fmt.Sprintf(`Assertion failed. text does not contain substring.
+    text     : %q
+    substring: %q`, text, substring))
+	}
+}
+
+// Captures the log output of the test, which is still written to stderr as well.
+func captureLogs(t *testing.T) *strings.Builder {
+	logs := &strings.Builder{}
+	log.SetOutput(io.MultiWriter(os.Stderr, logs))
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return logs
+}
+
+// Points the user cache directory, and with it the compiler's cache, at a temporary directory,
+// so that tests neither use nor fill the cache of the user's own compilations.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "yune-test-cache-")
+	if err != nil {
+		log.Fatalln("Failed to create the test cache directory. Error:", err)
+	}
+	os.Setenv("XDG_CACHE_HOME", dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func TestPrimitives(t *testing.T) {
 	parseAndRunModule("primitives.un", `
 main(): () =
@@ -160,6 +217,455 @@ true
 `)
 }
 
+func TestIndexing(t *testing.T) {
+	stdout, _ := parseAndRunModule("indexing.un", `
+import "std.un"
+
+main(): () =
+    xs := [1, 2, 3]
+    xs[0] = xs[1] + xs[2]
+    xs[2] += 10
+    println xs[0]
+    println xs[2]
+    println len(xs[1:3])
+    s := "Hello, World!"
+    println s[0:5]
+    println s[7]
+`)
+	assertEq(stdout, `5
+13
+2
+Hello
+W
+`)
+}
+
+func TestMap(t *testing.T) {
+	stdout, _ := parseAndRunModule("map.un", `
+import "std.un"
+
+// Tests serialization of Map
+AGES: Map(String, Int) = toMap([("Alice", 31), ("Bob", 27)])
+
+main(): () =
+    empty: Map(Int, String) = toMap([])
+    println len(empty)
+    ages := insert(AGES, "Carol", 45)
+    ages = remove(ages, "Bob")
+    println len(ages)
+    println get(keys(ages), 1)
+    lookup(ages, "Bob") is missing: () -> println "missing"
+    println "found"
+    // lookup on a map of unions returns a flat union
+    names: Map(Int, Union[Int, String]) = toMap([])
+    names = insert(names, 1, "one")
+    lookup(names, 1) is name: String -> println name
+    println "not a name"
+`)
+	assertEq(stdout, `0
+2
+Carol
+missing
+one
+`)
+}
+
+func TestFloatMapKey(t *testing.T) {
+	message := expectAnalyzerError(func() {
+		parseAndRunModule("floatMapKey.un", `
+M: Map(Float, Int) = toMap([(1.5, 1)])
+`)
+	}, "Float map key not rejected.")
+	assertContains(message, "cannot be used as map key")
+}
+
+func TestStringBuiltins(t *testing.T) {
+	stdout, _ := parseAndRunModule("stringBuiltins.un", `
+import "std.un"
+
+main(): () =
+    println join(split("a,b,c", ","), ";")
+    println replace("one two two", "two", "three")
+    println trim("  padded ")
+    println startsWith("prefix", "pre") and endsWith("suffix", "fix")
+    println toUpper("Hello") + toLower("Hello")
+    println repeat("ab", 3)
+    println charToCode("A")
+    println codeToChar(98)
+    println findChar("hello", 3, "l")
+    println stringToInt("-42")
+    println stringToInt("4x2")
+    println formatFloat(1.5)
+`)
+	assertEq(stdout, `a;b;c
+one three three
+padded
+true
+HELLOhello
+ababab
+65
+b
+3
+-42
+()
+1.5
+`)
+}
+
+// Tests that the string functions of std.un do not recurse per character, which overflowed the stack.
+func TestLongStrings(t *testing.T) {
+	stdout, _ := parseAndRunModule("longStrings.un", `
+import "std.un"
+
+main(): () =
+    digits := repeat("7", 1000000)
+    println isDigits(digits)
+    println isDigits(digits + "x")
+    println stringToUint(repeat("0", 100000) + "42")
+    println len(mapString(repeat("ab", 500000), "ab", "ba"))
+    println mapString("abc", "ab", "ba")
+`)
+	assertEq(stdout, `true
+false
+42
+1000000
+bac
+`)
+}
+
+func TestListBuiltins(t *testing.T) {
+	stdout, _ := parseAndRunModule("listBuiltins.un", `
+import "std.un"
+
+add(sum: Int, x: Int): Int = sum + x
+
+main(): () =
+    numbers := [3, 1, 4, 1, 5]
+    println join(map(numbers, |x: Int|: String = intToString(x * 2)), ",")
+    println len(filter(numbers, |x: Int|: Bool = x > 2))
+    println fold(numbers, 0, add)
+    println len(concat(numbers, [9, 2]))
+    println join(sort(["pear", "apple", "fig"]), ",")
+    println join(map(sort(numbers, |a: Int, b: Int|: Bool = a > b), intToString), "")
+`)
+	assertEq(stdout, `6,2,8,2,10
+3
+14
+7
+apple,fig,pear
+54311
+`)
+}
+
+func TestMathBuiltins(t *testing.T) {
+	stdout, _ := parseAndRunModule("mathBuiltins.un", `
+import "std.un"
+
+main(): () =
+    println pow(2, 10)
+    println toInt(-2.7)
+    println roundToInt(2.5)
+    println toInt(sqrt(-1.0))
+    println toInt(100000000000.0)
+    println formatFloat(floor(sqrt(17.0)))
+    println max(abs(-3), min(7, 5))
+    println isNaN(log(-1.0))
+`)
+	assertEq(stdout, `1024
+-2
+3
+()
+()
+4
+5
+true
+`)
+}
+
+func TestShadowedBuiltins(t *testing.T) {
+	for _, evaluator := range []string{"clang-repl", "go"} {
+		stdout, _, _ := runModule("shadowedBuiltins.un", parseModule("shadowedBuiltins.un", `
+applyTo(abs: Fn(Int, Int), value: Int): Int = abs(value)
+
+SQUARE: Int =
+    pow := |base: Int|: Int = base * base
+    pow(3)
+
+main(): () =
+    get := |index: Int|: Int = index + 1
+    println applyTo(|x: Int|: Int = x * 2, 1)
+    println SQUARE
+    println get(1)
+    println abs(-4)
+`), nil, cpp.BuildOptions{Evaluator: evaluator})
+		assertEq(stdout, `2
+9
+2
+4
+`)
+	}
+}
+
+func TestIntegerOverflow(t *testing.T) {
+	for _, call := range []string{"pow(10, 10)", "abs(-2147483647 - 1)"} {
+		_, stderr, exitCode := runModule("integerOverflow.un", parseModule("integerOverflow.un", `
+import "std.un"
+
+main(): () =
+    println `+call+`
+`), nil, cpp.BuildOptions{})
+		assertEq(exitCode, 1)
+		assertContains(stderr, "integer overflow")
+	}
+	for _, evaluator := range []string{"clang-repl", "go"} {
+		message := expectAnalyzerError(func() {
+			runModule("integerOverflow.un", parseModule("integerOverflow.un", "X: Int = pow(3, 21)\n"), nil, cpp.BuildOptions{Evaluator: evaluator})
+		}, "Integer overflow not reported by "+evaluator+".")
+		assertContains(message, "pow: integer overflow for 3 ^ 21")
+	}
+}
+
+func TestIOBuiltins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "io.txt")
+	stdout, _ := parseAndRunModule("ioBuiltins.un", fmt.Sprintf(`
+import "std.un"
+
+main(args: List(String)): Int =
+    print "args: "
+    println len(args)
+    writeFile(%q, "line one") is error: Error -> println errorMessage(error)
+    readFile(%q) is contents: String -> println contents
+    readFile(%q) is error: Error -> println startsWith(errorMessage(error), "readFile")
+    println getEnv("YUNE_SURELY_UNSET_VARIABLE")
+    0
+`, path, path, path+".missing"))
+	assertEq(stdout, `args: 0
+line one
+true
+()
+`)
+}
+
+func TestShadowedError(t *testing.T) {
+	for _, evaluator := range []string{"clang-repl", "go"} {
+		stdout, _, _ := runModule("shadowedError.un", parseModule("shadowedError.un", `
+Error: Type = (Int, String)
+
+initial: Error = (0, "compile time")
+
+check(value: Int): Union[Int, Error] =
+    value < 0 -> (value, "negative")
+    value
+
+main(): () =
+    (offset: Int, message: String) = initial
+    println message
+    check(-1) is error: Error ->
+        (value: Int, reason: String) = error
+        println reason
+    readFile("/surely/missing/file") is contents: String -> println contents
+    println "done"
+`), nil, cpp.BuildOptions{Evaluator: evaluator})
+		assertEq(stdout, `compile time
+negative
+done
+`)
+	}
+}
+
+// Programs may declare top-level functions named like builtins, which the builtins' other users keep calling.
+func TestShadowedTopLevelBuiltins(t *testing.T) {
+	for _, evaluator := range []string{"clang-repl", "go"} {
+		stdout, _, _ := runModule("shadowedTopLevelBuiltins.un", parseModule("shadowedTopLevelBuiltins.un", `
+import "std.un"
+
+max(a: Int, b: Int): Int = a + b
+
+map(value: Int): String = "mapped " + toString(value)
+
+LARGEST: Int = max(1, 2)
+
+main(): () =
+    println LARGEST
+    println max(3, 4)
+    println map(5)
+    println min(6, 7)
+`), nil, cpp.BuildOptions{Evaluator: evaluator})
+		assertEq(stdout, `3
+7
+mapped 5
+6
+`)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	_, _, exitCode := runModule("exitStatus.un", parseModule("exitStatus.un", `
+main(args: List(String)): Int =
+    len(args) + 3
+`), []string{"a", "b"}, cpp.BuildOptions{})
+	assertEq(exitCode, 5)
+}
+
+func TestRuntimePanic(t *testing.T) {
+	_, stderr, exitCode := runModule("runtimePanic.un", parseModule("runtimePanic.un", `
+lastElement(xs: List(Int)): Int =
+    xs[len(xs)]
+
+main(): () =
+    println(lastElement([1, 2, 3]))
+`), nil, cpp.BuildOptions{})
+	assertEq(exitCode, 1)
+	assertEq(strings.Contains(stderr, "index 3 out of bounds for length 3"), true)
+	assertEq(strings.Contains(stderr, "call stack (most recent call first):"), true)
+	assertEq(strings.Contains(stderr, "    lastElement (runtimePanic.un:2:"), true)
+}
+
+func TestImportResolution(t *testing.T) {
+	projectDir := t.TempDir()
+	libraryDir := t.TempDir()
+	for _, path := range []string{
+		filepath.Join(projectDir, "local.un"),
+		filepath.Join(libraryDir, "local.un"),
+		filepath.Join(libraryDir, "library.un"),
+	} {
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("YUNE_PATH", libraryDir)
+	mainFile := filepath.Join(projectDir, "main.un")
+	resolved, _, _ := resolveImport(mainFile, "local.un")
+	assertEq(resolved, filepath.Join(projectDir, "local.un"))
+	resolved, found, _ := resolveImport(mainFile, "library.un")
+	assertEq(resolved, filepath.Join(libraryDir, "library.un"))
+	assertEq(found.Origin, "YUNE_PATH")
+	_, found, _ = resolveImport(mainFile, "std.un")
+	assertEq(found.Origin, "standard library")
+	_, _, ok := resolveImport(mainFile, "missing.un")
+	assertEq(ok, false)
+
+	// import paths of build directives are relative to the file being compiled
+	vendorDir := filepath.Join(projectDir, "vendor")
+	os.Mkdir(vendorDir, 0o755)
+	if err := os.WriteFile(filepath.Join(vendorDir, "vendored.un"), []byte("VENDORED: Int = 3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sourceImportPaths = nil })
+	options := cpp.BuildOptions{Evaluator: "go"}
+	assertEq(applyBuildDirectives(mainFile, [][]string{{"-import-path", "vendor"}}, &options), nil)
+	resolved, found, _ = resolveImport(mainFile, "vendored.un")
+	assertEq(resolved, filepath.Join(vendorDir, "vendored.un"))
+	assertEq(found.Origin, "yune:build -import-path")
+	lowerModule(mainFile, parseModule(mainFile, `// yune:build -import-path vendor
+import "vendored.un"
+
+X: Int = VENDORED
+`), &options)
+}
+
+// Strings are printed without quotes, also when they are the value of a union.
+func TestPrintlnUnion(t *testing.T) {
+	for _, evaluator := range []string{"clang-repl", "go"} {
+		stdout, _, _ := runModule("printlnUnion.un", parseModule("printlnUnion.un", `
+import "std.un"
+
+VALUE: Union[String, ()] = "compile time"
+TEXT: String = toString(VALUE)
+
+main(): () =
+    value: Union[String, ()] = "hi"
+    println value
+    print value
+    println "!"
+    println TEXT
+    other: Union[Int, String] = 3
+    println other
+`), nil, cpp.BuildOptions{Evaluator: evaluator})
+		assertEq(stdout, `hi
+hi!
+compile time
+3
+`)
+	}
+}
+
+func TestShow(t *testing.T) {
+	stdout, stderr := parseAndRunModule("show.un", `
+import "std.un"
+
+main(): () =
+    println([(1, "a"), (2, "b\n")])
+    println show("quoted")
+    println toMap([(true, 1.5)])
+    println List(Union[Int, ()])
+    println(dbg(3) + 1)
+`)
+	assertEq(stdout, `[(1, "a"), (2, "b\n")]
+"quoted"
+toMap([(true, 1.5)])
+List(Union[Int, ()])
+4
+`)
+	if !strings.HasPrefix(stderr, "[show.un:9:") || !strings.HasSuffix(stderr, "] 3: Int\n") {
+		t.Errorf("unexpected dbg output: %q", stderr)
+	}
+}
+
+func TestJsonBuiltins(t *testing.T) {
+	stdout, _ := parseAndRunModule("jsonBuiltins.un", `
+import "std.un"
+
+main(): () =
+    println toJson((1, 2.0, [true], "\"quoted\"", toMap([("key", ())])))
+    decoded := fromJson("[[1, \"one\"], [2, 3.5]]", List((Int, Union[String, Float])))
+    decoded is list: List((Int, Union[String, Float])) -> println(list)
+    println fromJson("[1, 2", List(Int))
+    println fromJson("{\"message\": \"failed\"}", Error)
+    readFile("/surely/missing/file") is error: Error -> println toJson(error)
+    println fromJson("1-2", Int)
+    println fromJson("[-]", List(Int))
+    println fromJson("1.e5", Float)
+`)
+	assertEq(stdout, `[1,2.0,[true],"\"quoted\"",[["key",[]]]]
+[(1, "one"), (2, 3.5)]
+Error("fromJson: expected ',' or ']' at offset 5")
+Error("failed")
+{"message":"readFile: cannot open '/surely/missing/file'"}
+Error("fromJson: unexpected trailing characters at offset 1")
+Error("fromJson: invalid number at offset 2")
+Error("fromJson: expected digits after '.' at offset 2")
+`)
+	message := expectAnalyzerError(func() {
+		parseAndRunModule("jsonStruct.un", "NewType: Type = `box_f(StructType_t{.name = \"NewType\"})`\n"+
+			"encode(value: NewType): String = toJson(value)\n")
+	}, "Encoding a C++ struct as JSON was not reported.")
+	assertContains(message, "Values of type 'NewType' cannot be converted to or from JSON.")
+
+	// the same encoding at compile time, which the Go evaluator implements separately
+	for _, evaluator := range []string{"clang-repl", "go"} {
+		stdout, _, _ := runModule("compileTimeJson.un", parseModule("compileTimeJson.un", `
+import "std.un"
+
+ENCODED: String = toJson((1, 2.0, [true], "\"quoted\"", toMap([("key", ())])))
+DECODED: String = show(fromJson("[[1, \"one\"], [2, 3.5]]", List((Int, Union[String, Float]))))
+INVALID: String = show(fromJson("[1, 2", List(Int)))
+ERROR: String = toJson(fromJson("{\"message\": \"failed\"}", Error))
+
+main(): () =
+    println ENCODED
+    println DECODED
+    println INVALID
+    println ERROR
+`), nil, cpp.BuildOptions{Evaluator: evaluator})
+		assertEq(stdout, `[1,2.0,[true],"\"quoted\"",[["key",[]]]]
+[(1, "one"), (2, 3.5)]
+Error("fromJson: expected ',' or ']' at offset 5")
+{"message":"failed"}
+`)
+	}
+}
+
 func TestExpressionCreation(t *testing.T) {
 	parseAndRunModule("expressionCreation.un", `
 import "std.un"
@@ -188,27 +694,32 @@ EXPRESSION: Expression = binaryExpression(0, "+", stringExpression(0, "before"),
 `)
 }
 
+// The macros of json.un and sql.un assign global variables while they are expanded.
 func TestJson(t *testing.T) {
-	parseAndRunModule("jsonTest.un", `import "json.un"`)
+	for _, evaluator := range []string{"clang-repl", "go"} {
+		runModule("jsonTest.un", parseModule("jsonTest.un", `import "json.un"`), nil, cpp.BuildOptions{Evaluator: evaluator})
+	}
 }
 
 func TestSQL(t *testing.T) {
-	stdout, _ := parseAndRunModule("sqlTest.un", `import "sql.un"`)
-	assertEq(stdout, ""+
-		"SELECT `SELECT`\n"+
-		"IDENT `first_name`\n"+
-		", `,`\n"+
-		"IDENT `last_name`\n"+
-		", `,`\n"+
-		"IDENT `grade`\n"+
-		"FROM `FROM`\n"+
-		"IDENT `students`\n"+
-		"WHERE `WHERE`\n"+
-		"IDENT `grade`\n"+
-		"> `>`\n"+
-		"$ `$`\n"+
-		"IDENT `grade`\n",
-	)
+	for _, evaluator := range []string{"clang-repl", "go"} {
+		stdout, _, _ := runModule("sqlTest.un", parseModule("sqlTest.un", `import "sql.un"`), nil, cpp.BuildOptions{Evaluator: evaluator})
+		assertEq(stdout, ""+
+			"SELECT `SELECT`\n"+
+			"IDENT `first_name`\n"+
+			", `,`\n"+
+			"IDENT `last_name`\n"+
+			", `,`\n"+
+			"IDENT `grade`\n"+
+			"FROM `FROM`\n"+
+			"IDENT `students`\n"+
+			"WHERE `WHERE`\n"+
+			"IDENT `grade`\n"+
+			"> `>`\n"+
+			"$ `$`\n"+
+			"IDENT `grade`\n",
+		)
+	}
 }
 
 func TestFmt(t *testing.T) {
@@ -239,6 +750,45 @@ func TestRawCppExpression(t *testing.T) {
 	_, _ = parseAndRunModule("rawCppExpression.un", "T: Type = `Int`")
 }
 
+func TestGeneratedLineDirectives(t *testing.T) {
+	_, units, _, _ := lowerModule("generatedLines.un", parseModule("generatedLines.un", `
+square(x: Int): Int = x * x
+
+main(): () =
+    println square(3)
+`), &cpp.BuildOptions{Evaluator: "go"})
+	// the code generated after a function body is not attributed to the last line of the body
+	for _, function := range []string{"square", "main"} {
+		assertContains(units.Units[0].Code, "\n#line 1 \"<generated>\"\nYUNE_INLINE std::string "+function+"_::toJson_() const")
+	}
+}
+
+func TestRawCppError(t *testing.T) {
+	// clang-repl reports errors at compile time on the construct being evaluated
+	message := expectAnalyzerError(func() {
+		parseAndRunModule("rawCppError.un", "Y: Int = 1\nX: Int = `undeclaredIdentifier`\n")
+	}, "C++ error not reported.")
+	assertContains(message, "use of undeclared identifier 'undeclaredIdentifier'")
+	assertContains(message, "---> rawCppError.un line 2")
+
+	// clang++ reports errors in raw C++ code on the raw block
+	options := cpp.BuildOptions{Evaluator: "go"}
+	_, units, spans, _ := lowerModule("rawCppError.un", parseModule("rawCppError.un", `
+main(): () =
+    x: Int = 1
+    y: Int = `+"`undeclaredIdentifier`"+`
+    println x + y
+`), &options)
+	compileError, failed := cpp.Build(units, filepath.Join(t.TempDir(), "rawCppError"), options).(cpp.CompileError)
+	assertEq(failed, true)
+	errors := spans.Translate(compileError, ast.Span{})
+	assertEq(len(errors) > 0, true)
+	message = errors[0].Error()
+	assertContains(message, "C++ error in raw C++ code: use of undeclared identifier 'undeclaredIdentifier'")
+	assertContains(message, "---> rawCppError.un line 4")
+	assertContains(message, "in this C++ block")
+}
+
 func TestClosureExpression(t *testing.T) {
 	stdout, _ := parseAndRunModule("closureExpression.un", `
 Error: Type = (Int, String)
@@ -260,6 +810,383 @@ main(): () =
 	assertEq(stdout, "correct\n")
 }
 
+// Each compilation connects to clang-repl through its own socket, so they can run concurrently.
+func TestConcurrentCompilation(t *testing.T) {
+	outputs := make(chan string)
+	for _, value := range []string{"1", "2"} {
+		go func() {
+			stdout, _ := parseAndRunModule("concurrent"+value+".un", `
+VALUE: Int = `+value+`
+
+main(): () =
+    println(VALUE)
+`)
+			outputs <- stdout
+		}()
+	}
+	first, second := <-outputs, <-outputs
+	assertEq(first+second == "1\n2\n" || first+second == "2\n1\n", true)
+}
+
+func TestGoEvaluator(t *testing.T) {
+	stdout, _, _ := runModule("goEvaluator.un", parseModule("goEvaluator.un", `
+Error: Type = (Int, String)
+square(text: String, getType: Fn(String, Union[Type, ()])): Union[Error, Expression] =
+    result := getType(text)
+    result is undefined: () -> (0, "Variable does not exist")
+    parameters: List((String, Expression)) = []
+    statements: List(Statement) = [expressionStatement(binaryExpression(0, "*", variableExpression(0, text), variableExpression(0, text)))]
+    closureExpression(0, parameters, inject(Int), statements)
+
+double(x: Int): Int = x * 2
+
+SQUARES: List(Int) = map([1, 2, 3], |x: Int|: Int = x * x)
+SHOWN: String = show(toMap([("b", 2.5), ("a", 1.0)]))
+DOUBLE: Int = fold(SQUARES, 0, |total: Int, x: Int|: Int = total + double(x))
+
+main(): () =
+    n: Int = 10
+    squareClosure := square#n
+    println(squareClosure())
+    println(SQUARES)
+    printlnString(SHOWN)
+    println(DOUBLE)
+`), nil, cpp.BuildOptions{Evaluator: "go"})
+	assertEq(stdout, `100
+[1, 4, 9]
+toMap([("a", 1.0), ("b", 2.5)])
+28
+`)
+}
+
+func TestGoEvaluatorRawCpp(t *testing.T) {
+	message := expectAnalyzerError(func() {
+		runModule("goEvaluatorRawCpp.un", parseModule("goEvaluatorRawCpp.un", "T: Type = `Int`"), nil, cpp.BuildOptions{Evaluator: "go"})
+	}, "Raw C++ evaluated by the Go evaluator.")
+	assertContains(message, "Raw C++ cannot be evaluated by the Go evaluator, use `-evaluator clang-repl` instead.")
+	assertContains(message, "goEvaluatorRawCpp.un line 1")
+}
+
+// A constant that never finishes is reported instead of hanging the compiler.
+func TestEvaluationLimits(t *testing.T) {
+	for _, evaluator := range []string{"clang-repl", "go"} {
+		message := expectAnalyzerError(func() {
+			runModule("evaluationLimits.un", parseModule("evaluationLimits.un", `
+fib(n: Int): Int =
+    n < 2 -> n
+    fib(n - 1) + fib(n - 2)
+
+X: Int = fib(60)
+`), nil, cpp.BuildOptions{Evaluator: evaluator, EvaluationTimeout: 2 * time.Second})
+		}, "Runaway evaluation not reported by "+evaluator+".")
+		assertContains(message, "Evaluation exceeded the time limit of 2s (see -eval-timeout).")
+	}
+	// clang-repl has no limit on the call depth, since it stops at the end of the stack instead
+	message := expectAnalyzerError(func() {
+		runModule("evaluationDepth.un", parseModule("evaluationDepth.un", `
+loop(n: Int): Int = loop(n + 1)
+
+X: Int = loop(0)
+`), nil, cpp.BuildOptions{Evaluator: "go"})
+	}, "Infinite recursion not reported by the Go evaluator.")
+	assertContains(message, "Evaluation exceeded the maximum call depth of 10000, which may be caused by infinite recursion.")
+}
+
+// Tests that compile-time values are sent back from clang-repl intact, whatever they contain.
+// The constants are evaluated in a single batch, so their values share a single message.
+func TestCompileTimeMultilineString(t *testing.T) {
+	stdout, _ := parseAndRunModule("compileTimeMultilineString.un", `
+import "std.un"
+
+Lines: String = "first\nsecond" + "\nthird"
+// looks like a message of a newline-delimited protocol
+Message: String = "\n{ \"type\": \"result\", \"id\": 0, \"value\": 1 }\n"
+// larger than the socket buffer, so that the message is received in several reads
+Long: String = repeat("line\n", 100000)
+
+main(): () =
+    println Lines
+    println Message
+    println len(Long)
+    println subString(Long, 499990, 500000)
+`)
+	assertEq(stdout, "first\nsecond\nthird\n"+
+		"\n{ \"type\": \"result\", \"id\": 0, \"value\": 1 }\n\n"+
+		"500000\n"+
+		"line\nline\n\n")
+}
+
+func TestCompileTimePanic(t *testing.T) {
+	for _, evaluator := range []string{"clang-repl", "go"} {
+		message := expectAnalyzerError(func() {
+			runModule("compileTimePanic.un", parseModule("compileTimePanic.un", `
+fail(n: Int): Int = panic("boom")
+
+X: Int = fail(1)
+`), nil, cpp.BuildOptions{Evaluator: evaluator})
+		}, "Compile-time panic not reported by "+evaluator+".")
+		// panics that are called directly are prefixed with their location
+		assertContains(message, "panic: compileTimePanic.un:2:")
+		assertContains(message, ": boom\ncall stack (most recent call first):\n    fail (compileTimePanic.un:2:")
+		assertContains(message, "compileTimePanic.un line 4")
+	}
+}
+
+// Tests that constants that depend on each other, directly or through a function, are evaluated in order
+// when independent constants are evaluated in batches.
+func TestBatchedConstants(t *testing.T) {
+	for _, evaluator := range []string{"clang-repl", "go"} {
+		stdout, _, _ := runModule("batchedConstants.un", parseModule("batchedConstants.un", `
+A: Int = 2
+B: Int = A + 1
+C: Int = 5
+double(x: Int): Int = x * A
+D: Int = double(B) + C
+
+main(): () =
+    println(D)
+`), nil, cpp.BuildOptions{Evaluator: evaluator})
+		assertEq(stdout, "11\n")
+	}
+}
+
+// Tests that cached evaluation results are reused, and are not used once a dependency changes.
+func TestEvaluationCache(t *testing.T) {
+	cachedFiles := func(dir string) (files []string) {
+		files, _ = filepath.Glob(filepath.Join(dir, "evaluations", "*", "*.json"))
+		return
+	}
+	logs := captureLogs(t)
+	hits := func() int {
+		return strings.Count(logs.String(), "Using cached evaluation result")
+	}
+	for _, evaluator := range []string{"clang-repl", "go"} {
+		dir := t.TempDir()
+		for i, base := range []int{2, 2, 4} {
+			logs.Reset()
+			stdout, _, _ := runModule("evaluationCache.un", parseModule("evaluationCache.un", `
+A: Int = `+strconv.Itoa(base)+`
+B: Int = A + 1
+
+main(): () =
+    println(B)
+`), nil, cpp.BuildOptions{Evaluator: evaluator, CacheDir: dir})
+			assertEq(stdout, strconv.Itoa(base+1)+"\n")
+			switch i {
+			case 0:
+				assertEq(hits(), 0)
+			case 1:
+				// every evaluation of the first run is reused instead of evaluated again
+				if hits() == 0 || hits() < len(cachedFiles(dir)) {
+					t.Fatalf("Only %d of %d cached evaluation results were used.", hits(), len(cachedFiles(dir)))
+				}
+			}
+		}
+		if len(cachedFiles(dir)) == 0 {
+			t.Fatal("No evaluation results were cached.")
+		}
+
+		// a macro that assigns a global variable is expanded again, instead of reusing
+		// a result that depends on the expansions before it
+		globalDir := t.TempDir()
+		for _, first := range []string{"count#first", "5"} {
+			stdout, _, _ := runModule("evaluationCacheGlobal.un", parseModule("evaluationCacheGlobal.un", `
+Error: Type = (Int, String)
+COUNT: Int = 0
+
+count(text: String, getType: Fn(String, Union[Type, ()])): Union[Error, Expression] =
+    COUNT += 1
+    integerExpression(0, COUNT)
+
+FIRST: Int = `+first+`
+SECOND: Int = count#second
+
+main(): () =
+    println(SECOND)
+`), nil, cpp.BuildOptions{Evaluator: evaluator, CacheDir: globalDir})
+			assertEq(stdout, map[string]string{"count#first": "2\n", "5": "1\n"}[first])
+		}
+
+		uncachedDir := t.TempDir()
+		stdout, _, _ := runModule("evaluationCache.un", parseModule("evaluationCache.un", `
+B: Int = 1 + 1
+
+main(): () =
+    println(B)
+`), nil, cpp.BuildOptions{Evaluator: evaluator, CacheDir: uncachedDir, NoCache: true})
+		assertEq(stdout, "2\n")
+		assertEq(len(cachedFiles(uncachedDir)), 0)
+	}
+}
+
+// Tests that imported files are loaded from their interfaces, which are written again when the files change.
+func TestModuleInterfaces(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "cache")
+	mainFile := filepath.Join(dir, "main.un")
+	source := `
+import "std.un"
+import "base.un"
+
+main(): () =
+    println(triple(BASE))
+`
+	logs := captureLogs(t)
+	for i, base := range []int{2, 2, 4} {
+		baseSource := "import \"std.un\"\n\nBASE: Int = " + strconv.Itoa(base) + "\ntriple(x: Int): Int = x * 3\n"
+		if err := os.WriteFile(filepath.Join(dir, "base.un"), []byte(baseSource), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		logs.Reset()
+		stdout, _, _ := runModule(mainFile, parseModule(mainFile, source), nil, cpp.BuildOptions{CacheDir: cacheDir})
+		assertEq(stdout, strconv.Itoa(base*3)+"\n")
+		// base.un is only loaded from its interface while it is unchanged, instead of being analyzed again
+		loaded := strings.Contains(logs.String(), "Loading the interface of '"+filepath.Join(dir, "base.un")+"'.")
+		assertEq(loaded, i == 1)
+	}
+	interfaces, _ := filepath.Glob(filepath.Join(cacheDir, "interfaces", "*", "*.json"))
+	// std.un, and base.un before and after it changed
+	assertEq(len(interfaces), 3)
+}
+
+// Tests that directives set build options, and that command-line options take precedence over directives.
+func TestBuildDirectives(t *testing.T) {
+	options := cpp.BuildOptions{}
+	assertEq(options.ParseDirective([]string{"-O", "3", "-l", "sqlite3", "-D", "A=1", "-g"}), nil)
+	assertEq(options.Optimization, "3")
+	assertEq(options.Debug, true)
+	assertEq(strings.Join(options.Libraries, " "), "sqlite3")
+	assertEq(strings.Join(options.Defines, " "), "A=1")
+	assertContains(options.ParseDirective([]string{"-O", "4"}).Error(), "invalid optimization level '4'")
+	assertContains(options.ParseDirective([]string{"-O", "2", "extra"}).Error(), "unexpected argument 'extra'")
+	assertContains(options.ParseDirective([]string{"-unknown"}).Error(), "flag provided but not defined: -unknown")
+
+	// command-line options take precedence over directives, and lists are appended
+	options = cpp.BuildOptions{Optimization: "1", Libraries: []string{"m"}}
+	assertEq(options.ApplyDirectives([][]string{{"-O", "3", "-l", "sqlite3"}, {"-lto"}}), nil)
+	assertEq(options.Optimization, "1")
+	assertEq(options.LTO, true)
+	assertEq(strings.Join(options.Libraries, " "), "sqlite3 m")
+	assertContains(options.ApplyDirectives([][]string{{"-O", "4"}}).Error(), "invalid yune:build directive '-O 4'")
+
+	// options set to their zero value on the command line take precedence too
+	flags := flag.NewFlagSet("yune", flag.ContinueOnError)
+	options = cpp.BuildOptions{}
+	options.RegisterFlags(flags)
+	assertEq(flags.Parse([]string{"-lto=false", "-g=false", "-eval-timeout", "0", "-I", "include"}), nil)
+	options.RecordSetFlags(flags)
+	assertEq(options.ApplyDirectives([][]string{{"-lto", "-g", "-eval-timeout", "1m", "-I", "directive"}}), nil)
+	assertEq(options.LTO, false)
+	assertEq(options.Debug, false)
+	assertEq(options.EvaluationTimeout, time.Duration(0))
+	assertEq(strings.Join(options.IncludeDirs, " "), "directive include")
+
+	// every flag names the option it sets, so that it can take precedence
+	flags.VisitAll(func(f *flag.Flag) {
+		named := slices.ContainsFunc(reflect.VisibleFields(reflect.TypeFor[cpp.BuildOptions]()), func(field reflect.StructField) bool {
+			return field.Tag.Get("flag") == f.Name
+		})
+		if !named {
+			t.Errorf("No field of BuildOptions has the tag `flag:\"%s\"`.", f.Name)
+		}
+	})
+
+	// directives of imported files are ignored
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "directiveLibrary.un"), []byte("// yune:build -D FROM_IMPORT\nVALUE: Int = 1\n"), 0o644)
+	mainFile := filepath.Join(dir, "directives.un")
+	options = cpp.BuildOptions{Evaluator: "go", Defines: []string{"FROM_COMMAND_LINE"}}
+	lowerModule(mainFile, parseModule(mainFile, `// yune:build -D FROM_MAIN
+import "directiveLibrary.un"
+
+X: Int = VALUE
+`), &options)
+	assertEq(strings.Join(options.Defines, " "), "FROM_MAIN FROM_COMMAND_LINE")
+}
+
+// Tests that only the translation unit of a changed file is compiled again.
+func TestIncrementalBuild(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "cache")
+	mainFile := filepath.Join(dir, "main.un")
+	for _, offset := range []int{1, 1, 2} {
+		source := `
+import "std.un"
+
+offset(): Int = ` + strconv.Itoa(offset) + `
+
+main(): () =
+    println(offset() + 1)
+`
+		stdout, _, _ := runModule(mainFile, parseModule(mainFile, source), nil, cpp.BuildOptions{CacheDir: cacheDir})
+		assertEq(stdout, strconv.Itoa(offset+1)+"\n")
+	}
+	objects, _ := filepath.Glob(filepath.Join(cacheDir, "objects", "*", "*.o"))
+	// std.un and the call to `main`, and main.un before and after it changed
+	assertEq(len(objects), 4)
+}
+
+// Tests that the daemon reuses the analysis of imports while recompiling a changed file.
+func TestDaemon(t *testing.T) {
+	dir := t.TempDir()
+	daemonSocket = filepath.Join(dir, "daemon.sock")
+	t.Cleanup(func() { daemonSocket = "" })
+	t.Cleanup(startDaemon())
+	logs := captureLogs(t)
+	writeFile := func(name string, contents string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mainFile := filepath.Join(dir, "main.un")
+	run := func(base string, extra string, expectedLog string) {
+		writeFile("base.un", base)
+		writeFile("main.un", `
+import "base.un"
+
+main(args: List(String)): Int =
+    len(args) + BASE + `+extra+"\n")
+		logs.Reset()
+		exitCode, ok := compileWithDaemon("run", mainFile, "", []string{"a", "b"}, cpp.BuildOptions{})
+		assertEq(ok, true)
+		assertEq(exitCode, 2+int(base[len("BASE: Int = ")]-'0')+int(extra[0]-'0'))
+		assertContains(logs.String(), expectedLog)
+	}
+	run("BASE: Int = 3\nOTHER: Int = 1\n", "0", "Analyzing the imports.")
+	run("BASE: Int = 3\nOTHER: Int = 1\n", "1", "Reusing the analysis of the imports.")
+	// only the changed declaration of the import is analyzed again
+	run("BASE: Int = 4\nOTHER: Int = 1\n", "1", "Reusing 1 of 2 declarations, which have not changed.")
+}
+
+// The daemon searches imports in the client's YUNE_PATH, whose directories may be relative to the client.
+func TestDaemonRequest(t *testing.T) {
+	dir := t.TempDir()
+	daemonSocket = filepath.Join(dir, "daemon.sock")
+	t.Cleanup(func() { daemonSocket = "" })
+	listener, err := net.Listen("unix", daemonSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	requests := make(chan daemonRequest, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var request daemonRequest
+		json.NewDecoder(conn).Decode(&request)
+		requests <- request
+		json.NewEncoder(conn).Encode(daemonResponse{})
+	}()
+	t.Setenv("YUNE_PATH", "relative"+string(filepath.ListSeparator)+dir)
+	_, ok := compileWithDaemon("build", "main.un", "", nil, cpp.BuildOptions{})
+	assertEq(ok, true)
+	workingDir, _ := os.Getwd()
+	assertEq(fmt.Sprint((<-requests).YunePath), fmt.Sprint([]string{filepath.Join(workingDir, "relative"), dir}))
+}
+
 // // Tests the deterministic evaluation order of macros.
 // // It currently does not pass and was deemed too much work to fix before the thesis deadline.
 // func TestMacroEvalOrder(t *testing.T) {
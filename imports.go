@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"yune/ast"
+	"yune/cpp"
+)
+
+// Directories given with -import-path, searched after the directory of the importing file.
+var importPaths []string
+
+// Directories given with `// yune:build -import-path` in the file being compiled, relative to that file,
+// searched after the -import-path directories.
+var sourceImportPaths []string
+
+// Directories of YUNE_PATH, which the daemon sets to those of its client.
+// If nil, they are read from the environment.
+var yunePath []string
+
+func yunePathDirs() []string {
+	if yunePath != nil {
+		return yunePath
+	}
+	dirs := []string{}
+	for _, dir := range filepath.SplitList(os.Getenv("YUNE_PATH")) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// A directory that imports are searched in, along with a description of where it comes from.
+type importDirectory struct {
+	Dir    string
+	Origin string
+}
+
+// The directories that the imports of `importingFile` are searched in, in order:
+// the directory of the importing file, the -import-path directories of the command line and then of the
+// compiled file's build directives, the directories in YUNE_PATH, and the bundled standard library.
+func importSearchPath(importingFile string) (dirs []importDirectory) {
+	dirs = append(dirs, importDirectory{filepath.Dir(importingFile), "importing file's directory"})
+	for _, dir := range importPaths {
+		dirs = append(dirs, importDirectory{dir, "-import-path"})
+	}
+	for _, dir := range sourceImportPaths {
+		dirs = append(dirs, importDirectory{dir, "yune:build -import-path"})
+	}
+	for _, dir := range yunePathDirs() {
+		dirs = append(dirs, importDirectory{dir, "YUNE_PATH"})
+	}
+	dirs = append(dirs, importDirectory{runtimeDir(), "standard library"})
+	return
+}
+
+// Applies the build directives of the file being compiled to `options`,
+// including `-import-path`, whose directories are relative to the file.
+func applyBuildDirectives(fileName string, directives [][]string, options *cpp.BuildOptions) error {
+	sourceImportPaths = nil
+	return options.ApplyDirectives(directives, func(flags *flag.FlagSet) {
+		flags.Func("import-path", "search `dir` for imports", func(dir string) error {
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(filepath.Dir(fileName), dir)
+			}
+			sourceImportPaths = append(sourceImportPaths, dir)
+			return nil
+		})
+	})
+}
+
+// Finds the file that an import refers to, returning the directory it was found in.
+// Absolute paths are used as is.
+func resolveImport(importingFile string, path string) (resolved string, found importDirectory, ok bool) {
+	if filepath.IsAbs(path) {
+		_, err := os.Stat(path)
+		return path, importDirectory{filepath.Dir(path), "absolute path"}, err == nil
+	}
+	for _, dir := range importSearchPath(importingFile) {
+		candidate := filepath.Join(dir.Dir, path)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, dir, true
+		}
+	}
+	return
+}
+
+// Describes where an import that cannot be found was searched for.
+func importNotFound(importingFile string, path string) error {
+	searched := []string{}
+	for _, dir := range importSearchPath(importingFile) {
+		searched = append(searched, fmt.Sprintf("    %s (%s)", dir.Dir, dir.Origin))
+	}
+	return fmt.Errorf("Import '%s' in file '%s' not found. Searched:\n%s", path, importingFile, strings.Join(searched, "\n"))
+}
+
+// Prints where each import of the file resolves to, recursively.
+// Files that have already been listed are not expanded again.
+func printImports(filePath string) {
+	// the import paths of the file's build directives apply to all imports
+	if err := applyBuildDirectives(filePath, parseBuildDirectives(readFile(filePath)), &cpp.BuildOptions{}); err != nil {
+		log.Fatalln(err)
+	}
+	listed := map[string]bool{}
+	var printFile func(filePath string, depth int)
+	printFile = func(filePath string, depth int) {
+		indent := strings.Repeat("    ", depth)
+		module := mustParseFile(filePath, readFile(filePath))
+		for _, path := range module.Imports {
+			resolved, found, ok := resolveImport(filePath, path)
+			if !ok {
+				fmt.Printf("%s%q -> not found\n", indent, path)
+				continue
+			}
+			if listed[resolved] {
+				fmt.Printf("%s%q -> %s (%s, listed above)\n", indent, path, resolved, found.Origin)
+				continue
+			}
+			listed[resolved] = true
+			fmt.Printf("%s%q -> %s (%s)\n", indent, path, resolved, found.Origin)
+			printFile(resolved, depth+1)
+		}
+	}
+	fmt.Println(filePath)
+	printFile(filePath, 1)
+}
+
+// A file imported by the module being compiled.
+type importedFile struct {
+	Path     string
+	Contents string
+	Hash     string
+}
+
+// Reads the files imported by `fileName`, recursively, with each file after the files it imports.
+// Files imported more than once are only included once.
+// `fileImports` maps the hashes of files to their imports, so that unchanged files are not parsed again.
+func importedFiles(fileName string, imports []string, fileImports map[string][]string) (files []importedFile, err error) {
+	seen := map[string]bool{}
+	var visit func(importingFile string, imports []string) error
+	visit = func(importingFile string, imports []string) error {
+		for _, path := range imports {
+			resolved, _, ok := resolveImport(importingFile, path)
+			if !ok {
+				return importNotFound(importingFile, path)
+			}
+			absolute, _ := filepath.Abs(resolved)
+			if seen[absolute] {
+				continue
+			}
+			seen[absolute] = true
+			contents, err := os.ReadFile(resolved)
+			if err != nil {
+				return err
+			}
+			file := importedFile{Path: resolved, Contents: string(contents), Hash: hashString(string(contents))}
+			imports, parsed := fileImports[file.Hash]
+			if !parsed {
+				module, err := parseFile(resolved, file.Contents)
+				if err != nil {
+					return err
+				}
+				imports = module.Imports
+				fileImports[file.Hash] = imports
+			}
+			if err := visit(resolved, imports); err != nil {
+				return err
+			}
+			files = append(files, file)
+		}
+		return nil
+	}
+	err = visit(fileName, imports)
+	return
+}
+
+// Creates a session with the imported files, loading the interface of each file
+// that has not changed since it was last analyzed.
+// If `previous` is not nil, the files are analyzed instead, reusing the declarations of `previous` that have not changed.
+func importSession(files []importedFile, options cpp.BuildOptions, previous *ast.Session) (session *ast.Session, errors ast.Errors) {
+	session = ast.NewSession(options)
+	if previous != nil {
+		session.ReuseImports(previous)
+	}
+	for _, file := range files {
+		// loaded declarations are new, so the declarations using them could not be reused
+		loaded := false
+		if previous == nil {
+			loaded, errors = session.LoadInterface(file.Path, file.Contents)
+		}
+		if !loaded && len(errors) == 0 {
+			module, err := parseFile(file.Path, file.Contents)
+			if err != nil {
+				errors = ast.Errors{err}
+			} else {
+				errors = session.Import(file.Path, file.Contents, module)
+			}
+		}
+		if len(errors) > 0 {
+			session.Close()
+			return nil, errors
+		}
+	}
+	errors = session.FinishImports()
+	return
+}
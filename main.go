@@ -1,9 +1,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"yune/ast"
@@ -62,7 +65,23 @@ func printTokens(lexer antlr.Recognizer, tokenStream *antlr.CommonTokenStream) {
 	}
 }
 
-func parseModule(fileName string, sourceCode string) ast.Module {
+// The syntax errors in a file.
+type ParseErrors struct {
+	FileName string
+	Errors   []error
+}
+
+func (e ParseErrors) Error() string {
+	lines := []string{}
+	for _, err := range e.Errors {
+		lines = append(lines, fmt.Sprintf("Parse error in file '%s': %s", e.FileName, err))
+	}
+	lines = append(lines, fmt.Sprintf("%d parse errors found. Stopping compilation.", len(e.Errors)))
+	return strings.Join(lines, "\n")
+}
+
+// Parses a single file, without loading its imports.
+func parseFile(fileName string, sourceCode string) (module ast.Module, err error) {
 	inputStream := antlr.NewInputStream(sourceCode + "\n")
 	errorListener := ParserErrorListener{}
 	lexer := parser.NewYuneLexer(inputStream)
@@ -78,70 +97,248 @@ func parseModule(fileName string, sourceCode string) ast.Module {
 	parseTreeModule := _parser.Module()
 
 	if len(errorListener.Errors) > 0 {
-		for _, error := range errorListener.Errors {
-			log.Printf("Parse error in file '%s': %s\n", fileName, error)
-		}
-		log.Fatalf("%d parse errors found. Stopping compilation.", len(errorListener.Errors))
+		err = ParseErrors{FileName: fileName, Errors: errorListener.Errors}
+		return
 	}
 	log.Printf("Lowering Parse Tree to AST for file '%s'...\n", fileName)
 	parser.FileName = fileName
 	parser.SourceCode = sourceCode
-	module := parser.LowerModule(parseTreeModule)
+	module = parser.LowerModule(parseTreeModule)
+	module.BuildDirectives = parseBuildDirectives(sourceCode)
+	return
+}
 
-	// NOTE: maybe move this to ast.Module.Lower?
-	for _, _import := range module.Imports {
-		// TODO: prevent import cycles
-		// TODO: import resolution magic for standard library files?
-		module = ast.JoinModules(module, parseModuleFromFile(_import))
+// Like parseFile, but exits if the file has syntax errors.
+func mustParseFile(fileName string, sourceCode string) ast.Module {
+	module, err := parseFile(fileName, sourceCode)
+	if err != nil {
+		log.Fatalln(err)
 	}
 	return module
 }
 
+// Parses a file. The files it imports are read when it is lowered, see lowerModule.
+func parseModule(fileName string, sourceCode string) ast.Module {
+	return mustParseFile(fileName, sourceCode)
+}
+
+const buildDirectivePrefix = "// yune:build "
+
+// Finds the `// yune:build <flags>` lines, which set build options from source, e.g. `// yune:build -O 3 -l sqlite3`.
+func parseBuildDirectives(sourceCode string) (directives [][]string) {
+	for line := range strings.Lines(sourceCode) {
+		if arguments, ok := strings.CutPrefix(line, buildDirectivePrefix); ok {
+			directives = append(directives, strings.Fields(arguments))
+		}
+	}
+	return
+}
+
 func parseModuleFromFile(filePath string) ast.Module {
 	return parseModule(filePath, readFile(filePath))
 }
 
-func runModule(fileName string, astModule ast.Module) (stdout, stderr string) {
+// Lowers the module along with the files it imports to C++, applying the build directives of the module to `options`.
+// The C++ is returned both as a single module, for libraries, and split into translation units, for executables.
+// Imported files are loaded from their interfaces if they have not changed since they were last analyzed.
+// Reports the errors and exits if there are any.
+func lowerModule(fileName string, astModule ast.Module, options *cpp.BuildOptions) (cppModule cpp.Module, units cpp.Units, spans *ast.SpanTable, hasMainFunction bool) {
 	log.Printf("Lowering AST to CPP for file '%s'...\n", fileName)
-	cppModule, hasMainFunction, errors := astModule.Lower()
+	// only the directives of the main file apply, so that imported files cannot change how the program is built
+	if err := applyBuildDirectives(fileName, astModule.BuildDirectives, options); err != nil {
+		log.Fatalln(err)
+	}
+	files, err := importedFiles(fileName, astModule.Imports, map[string][]string{})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if options.RuntimeDir == "" {
+		options.RuntimeDir = runtimeDir()
+	}
+	if options.CacheDir == "" {
+		options.CacheDir = compilerCacheDir()
+	}
+	session, errors := importSession(files, *options, nil)
 	if len(errors) > 0 {
-		for _, err := range errors {
-			log.Println("Error:", err)
+		reportErrors(errors)
+	}
+	cppModule, spans, hasMainFunction, errors = session.Lower(astModule)
+	if len(errors) > 0 {
+		reportErrors(errors)
+	}
+	units = session.Units()
+	session.Close()
+	return
+}
+
+// Builds an executable, or a library if the module does not have a `main` function, at `outputPath`.
+// If `outputPath` is empty, the name of the file is used for executables and "library.hpp" for libraries.
+func buildModule(fileName string, astModule ast.Module, outputPath string, options cpp.BuildOptions) {
+	cppModule, units, spans, hasMainFunction := lowerModule(fileName, astModule, &options)
+	if !hasMainFunction {
+		if outputPath == "" {
+			outputPath = "library.hpp"
 		}
-		log.Fatalln("Errors found, exiting.")
+		log.Printf("Module does not have a `main` function. Compiling a library to '%s'.\n", outputPath)
+		cpp.CompileLibrary(cppModule, outputPath)
+		return
+	}
+	if outputPath == "" {
+		outputPath = strings.TrimSuffix(filepath.Base(fileName), ".un")
 	}
+	log.Printf("Module has a `main` function. Building '%s'.\n", outputPath)
+	if err := cpp.Build(units, outputPath, options); err != nil {
+		reportErrors(spans.Translate(err.(cpp.CompileError), ast.Span{}))
+	}
+}
+
+// Builds and runs the module, returning the output and exit status of the program.
+// Modules without a `main` function are compiled to a library instead.
+func runModule(fileName string, astModule ast.Module, args []string, options cpp.BuildOptions) (stdout, stderr string, exitCode int) {
+	cppModule, units, spans, hasMainFunction := lowerModule(fileName, astModule, &options)
 	fmt.Fprintln(os.Stderr, "--- Output ---")
 	if !hasMainFunction {
 		log.Println("Module does not have a `main` function. Compiling a library.")
-		cpp.CompileLibrary(cppModule)
+		cpp.CompileLibrary(cppModule, "library.hpp")
 		return
-	} else {
-		log.Println("Module has a `main` function. Running.")
-		return cpp.Run(cppModule)
 	}
+	log.Println("Module has a `main` function. Running.")
+	stdout, stderr, exitCode, err := cpp.Run(units, args, options)
+	if err != nil {
+		reportErrors(spans.Translate(err.(cpp.CompileError), ast.Span{}))
+	}
+	return
+}
+
+func reportErrors(errors ast.Errors) {
+	for _, err := range errors {
+		log.Println("Error:", err)
+	}
+	log.Fatalln("Errors found, exiting.")
 }
 
 func parseAndRunModule(filePath string, sourceCode string) (stdout, stderr string) {
-	return runModule(filePath, parseModule(filePath, sourceCode))
+	stdout, stderr, _ = runModule(filePath, parseModule(filePath, sourceCode), nil, cpp.BuildOptions{})
+	return
 }
 
-func runModuleFromFile(filePath string) (stdout, stderr string) {
-	return runModule(filePath, parseModuleFromFile(filePath))
+func runModuleFromFile(filePath string, args []string, options cpp.BuildOptions) (stdout, stderr string, exitCode int) {
+	return runModule(filePath, parseModuleFromFile(filePath), args, options)
+}
+
+const usage = `Usage:
+  yune [flags] [run] <file.un> [args...]   build and run a program, exiting with its exit status
+  yune build [flags] [-o <output>] <file.un>   build a program or library without running it
+  yune imports [flags] <file.un>   show where the imports of a file resolve to
+  yune daemon [flags]   keep compiling in the background for run and build with -daemon
+  yune clean-cache   remove the cached results of compile-time evaluations, module interfaces and objects
+
+Flags:
+`
+
+func registerFlags(flags *flag.FlagSet, options *cpp.BuildOptions) {
+	options.RegisterFlags(flags)
+	flags.Func("import-path", "search `dir` for imports, after the directory of the importing file (repeatable)", func(dir string) error {
+		importPaths = append(importPaths, dir)
+		return nil
+	})
+	flags.BoolVar(&useDaemon, "daemon", useDaemon, "compile through `yune daemon`, or directly if it is not running")
+	flags.StringVar(&daemonSocket, "daemon-socket", daemonSocket, "`path` of the daemon's socket (default in the user cache directory)")
 }
 
 func main() {
-	filePath := "test.un"
-	if len(os.Args) > 1 {
-		filePath = os.Args[2]
-	}
-	defer func() {
-		if err := recover(); err != nil {
-			if analyzerError, ok := err.(ast.AnalyzerError); ok {
-				fmt.Fprintln(os.Stderr, analyzerError.Error())
-			} else {
-				panic(err)
+	options := cpp.BuildOptions{}
+	registerFlags(flag.CommandLine, &options)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	options.RecordSetFlags(flag.CommandLine)
+	command := "run"
+	arguments := flag.Args()
+	outputPath := ""
+	if len(arguments) > 0 && slices.Contains([]string{"run", "build", "imports", "daemon", "clean-cache"}, arguments[0]) {
+		command = arguments[0]
+		// flags may also follow the command
+		commandFlags := flag.NewFlagSet(command, flag.ExitOnError)
+		commandFlags.Usage = flag.Usage
+		registerFlags(commandFlags, &options)
+		if command == "build" {
+			commandFlags.StringVar(&outputPath, "o", "", "path of the built executable or library")
+		}
+		commandFlags.Parse(arguments[1:])
+		options.RecordSetFlags(commandFlags)
+		arguments = commandFlags.Args()
+	}
+	if options.RuntimeDir != "" {
+		runtimeDir = func() string { return options.RuntimeDir }
+	}
+	if command == "imports" {
+		if len(arguments) != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		printImports(arguments[0])
+		return
+	}
+	if command == "daemon" {
+		if len(arguments) != 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		runDaemon()
+		return
+	}
+	if command == "clean-cache" {
+		if len(arguments) != 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		cleanCache()
+		return
+	}
+	if command == "build" {
+		if len(arguments) != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if useDaemon {
+			if _, ok := compileWithDaemon(command, arguments[0], outputPath, nil, options); ok {
+				return
 			}
 		}
-	}()
-	runModuleFromFile(filePath)
+		defer recoverAnalyzerError()
+		buildModule(arguments[0], parseModuleFromFile(arguments[0]), outputPath, options)
+		return
+	}
+	filePath := "test.un"
+	if len(arguments) > 0 {
+		filePath = arguments[0]
+	}
+	// arguments after the file path are passed on to the program
+	args := []string{}
+	if len(arguments) > 1 {
+		args = arguments[1:]
+	}
+	if useDaemon {
+		if exitCode, ok := compileWithDaemon(command, filePath, "", args, options); ok {
+			os.Exit(exitCode)
+		}
+	}
+	defer recoverAnalyzerError()
+	_, _, exitCode := runModuleFromFile(filePath, args, options)
+	os.Exit(exitCode)
+}
+
+// Prints errors reported through Analyzer.ReportError.
+func recoverAnalyzerError() {
+	if err := recover(); err != nil {
+		if analyzerError, ok := err.(ast.AnalyzerError); ok {
+			fmt.Fprintln(os.Stderr, analyzerError.Error())
+			os.Exit(1)
+		} else {
+			panic(err)
+		}
+	}
 }
@@ -27,8 +27,17 @@ func GetSpan(ctx antlr.ParserRuleContext) ast.Span {
 	}
 }
 
-func LowerAssignment(ctx IAssignmentContext) ast.Assignment {
-	return ast.Assignment{
+func LowerAssignment(ctx IAssignmentContext) ast.Statement {
+	if ctx.GetSubscript() != nil {
+		return &ast.IndexAssignment{
+			Span:   GetSpan(ctx),
+			Target: LowerVariable(ctx.Variable()),
+			Index:  LowerExpression(ctx.GetSubscript()),
+			Op:     LowerAssignmentOp(ctx.AssignmentOp()),
+			Body:   LowerStatementBody(ctx.StatementBody()),
+		}
+	}
+	return &ast.Assignment{
 		Target: LowerVariable(ctx.Variable()),
 		Op:     LowerAssignmentOp(ctx.AssignmentOp()),
 		Body:   LowerStatementBody(ctx.StatementBody()),
@@ -78,6 +87,19 @@ func LowerBinaryExpression(ctx IBinaryExpressionContext) ast.Expression {
 			Function: LowerPrimaryExpression(ctx.GetFunction()),
 			Argument: LowerParenExpression(ctx.GetParenArgument()),
 		}
+	case ctx.GetIndexed() != nil && ctx.GetSubscript() != nil:
+		return &ast.IndexExpression{
+			Span:       GetSpan(ctx),
+			Expression: LowerBinaryExpression(ctx.GetIndexed()),
+			Index:      LowerExpression(ctx.GetSubscript()),
+		}
+	case ctx.GetIndexed() != nil:
+		return &ast.SliceExpression{
+			Span:       GetSpan(ctx),
+			Expression: LowerBinaryExpression(ctx.GetIndexed()),
+			Low:        LowerExpression(ctx.GetLow()),
+			High:       LowerExpression(ctx.GetHigh()),
+		}
 	case ctx.GetLeft() != nil:
 		return &ast.BinaryExpression{
 			Span:  GetSpan(ctx),
@@ -315,8 +337,7 @@ func LowerStatement(ctx IStatementContext) iter.Seq[ast.Statement] {
 		case ctx.VariableDeclaration() != nil:
 			LowerVariableDeclaration(ctx.VariableDeclaration())(yield)
 		case ctx.Assignment() != nil:
-			stmt := LowerAssignment(ctx.Assignment())
-			yield(&stmt)
+			yield(LowerAssignment(ctx.Assignment()))
 		case ctx.ClosureExpression() != nil:
 			yield(&ast.ExpressionStatement{
 				Expression: LowerClosureExpression(ctx.ClosureExpression()),
@@ -409,7 +430,7 @@ func LowerIsStatement(ctx IIsStatementContext) ast.Statement {
 				},
 				Argument: &ast.String{
 					Span:  span,
-					Value: fmt.Sprintf("is-statement assertion at %s returned false", span),
+					Value: "is-statement assertion returned false",
 				},
 			}},
 		},
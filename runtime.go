@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"yune/cpp"
+)
+
+//go:embed std.un
+var standardLibrary embed.FS
+
+// Directory containing the runtime headers and the standard library.
+// Overridden by the -runtime flag, e.g. to work on pb.hpp without rebuilding the compiler.
+var runtimeDir = sync.OnceValue(extractRuntime)
+
+// Reads the embedded runtime headers and standard library, mapping their names to their contents.
+func runtimeFiles() map[string][]byte {
+	files := map[string][]byte{}
+	for _, fileSystem := range []embed.FS{cpp.RuntimeHeaders, standardLibrary} {
+		err := fs.WalkDir(fileSystem, ".", func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			files[path], err = fileSystem.ReadFile(path)
+			return err
+		})
+		if err != nil {
+			log.Fatalln("Failed to read embedded runtime files. Error:", err)
+		}
+	}
+	return files
+}
+
+// Writes the embedded runtime files to a cache directory named after a hash of their contents,
+// so that different versions of the compiler do not overwrite each other's files.
+// The files are extracted once, after which the directory is reused.
+func extractRuntime() string {
+	files := runtimeFiles()
+	hash := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		hash.Write([]byte(name))
+		hash.Write(files[name])
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	dir := filepath.Join(cacheDir, "yune", "runtime-"+hex.EncodeToString(hash.Sum(nil))[:16])
+	if _, err := os.Stat(dir); err == nil {
+		return dir
+	}
+	// extract to a temporary directory first, so that concurrent compilers never see a partial runtime
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		log.Fatalln("Failed to create runtime cache directory. Error:", err)
+	}
+	tempDir, err := os.MkdirTemp(filepath.Dir(dir), "extracting-")
+	if err != nil {
+		log.Fatalln("Failed to create runtime cache directory. Error:", err)
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(tempDir, name), contents, 0o644); err != nil {
+			log.Fatalf("Failed to extract runtime file '%s'. Error: %s\n", name, err)
+		}
+	}
+	if err := os.Rename(tempDir, dir); err != nil {
+		os.RemoveAll(tempDir)
+		if _, statErr := os.Stat(dir); statErr != nil {
+			log.Fatalln("Failed to move extracted runtime files into the cache. Error:", err)
+		}
+	}
+	log.Printf("Extracted runtime files to '%s'.\n", dir)
+	return dir
+}
+
+// Directory in which the results of compile-time evaluations, module interfaces and objects are cached,
+// which is removed by `yune clean-cache`.
+func compilerCacheDir() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	return filepath.Join(cacheDir, "yune", "cache")
+}
+
+// Removes all cached evaluation results, module interfaces and objects.
+func cleanCache() {
+	dir := compilerCacheDir()
+	if err := os.RemoveAll(dir); err != nil {
+		log.Fatalln("Failed to remove the cache. Error:", err)
+	}
+	log.Printf("Removed the cache at '%s'.\n", dir)
+}